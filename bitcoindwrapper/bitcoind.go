@@ -71,6 +71,70 @@ func (b *Bitcoind) GetBlockHash(index uint64) (string, error) {
 	return hash, err
 }
 
+// GetBlockHashes returns the hashes of the blocks in best-block-chain at <indexes> using a single batch request
+func (b *Bitcoind) GetBlockHashes(indexes []uint64) ([]string, error) {
+	params := make([]interface{}, len(indexes))
+	for i, index := range indexes {
+		params[i] = []uint64{index}
+	}
+	responses, err := b.client.batchCall("getblockhash", params)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, len(responses))
+	for i := range responses {
+		if err = handleError(nil, &responses[i]); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(responses[i].Result, &hashes[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return hashes, nil
+}
+
+// EstimateSmartFee estimates the fee rate needed for a transaction to confirm within <confTarget> blocks.
+func (b *Bitcoind) EstimateSmartFee(confTarget uint64) (*EstimateSmartFeeResult, error) {
+	log.Println("Calling 'estimatesmartfee'")
+	r, err := b.client.call("estimatesmartfee", []uint64{confTarget})
+	if err = handleError(err, &r); err != nil {
+		return nil, err
+	}
+
+	result := &EstimateSmartFeeResult{}
+	err = json.Unmarshal(r.Result, result)
+
+	return result, err
+}
+
+// GetRawChangeAddress returns a new wallet address of <addressType> ("legacy", "p2sh-segwit", "bech32" or "bech32m") for receiving change.
+func (b *Bitcoind) GetRawChangeAddress(addressType string) (string, error) {
+	var address string
+	log.Println("Calling 'getrawchangeaddress'")
+	r, err := b.client.call("getrawchangeaddress", []string{addressType})
+	if err = handleError(err, &r); err != nil {
+		return "", err
+	}
+	err = json.Unmarshal(r.Result, &address)
+
+	return address, err
+}
+
+// GetAddressInfo returns information about the given wallet address.
+func (b *Bitcoind) GetAddressInfo(address string) (*GetAddressInfoResult, error) {
+	r, err := b.client.call("getaddressinfo", []string{address})
+	if err = handleError(err, &r); err != nil {
+		return nil, err
+	}
+
+	result := &GetAddressInfoResult{}
+	err = json.Unmarshal(r.Result, result)
+
+	return result, err
+}
+
 // SignRawTransactionWithWallet RPC sign inputs for raw transaction (serialized, hex-encoded).
 func (b *Bitcoind) SignRawTransactionWithWallet(rawTx string) (*SignRawTransactionWithWalletResult, error) {
 	log.Println("Calling 'signrawtransactionwithwallet'")
@@ -98,6 +162,31 @@ func (b *Bitcoind) SendRawTransaction(signedTx string) (string, error) {
 	return txHash, err
 }
 
+// GetTransaction returns the wallet transaction with the given id, watch-only ones included.
+func (b *Bitcoind) GetTransaction(txID string) (*GetTransactionResult, error) {
+	r, err := b.client.call("gettransaction", []interface{}{txID, true})
+	if err = handleError(err, &r); err != nil {
+		return nil, err
+	}
+
+	result := &GetTransactionResult{}
+	err = json.Unmarshal(r.Result, result)
+
+	return result, err
+}
+
+// GetRawMempool returns the ids of the transactions in the mempool.
+func (b *Bitcoind) GetRawMempool() ([]string, error) {
+	r, err := b.client.call("getrawmempool", nil)
+	if err = handleError(err, &r); err != nil {
+		return nil, err
+	}
+	var txIDs []string
+	err = json.Unmarshal(r.Result, &txIDs)
+
+	return txIDs, err
+}
+
 // GetBlock returns information about the block with the given hash.
 func (b *Bitcoind) GetBlock(blockHash string) (*GetBlockResult, error) {
 	r, err := b.client.call("getblock", []interface{}{blockHash, 2})
@@ -110,6 +199,18 @@ func (b *Bitcoind) GetBlock(blockHash string) (*GetBlockResult, error) {
 	return result, err
 }
 
+// GetRawBlock returns the hex encoded serialized block with the given hash.
+func (b *Bitcoind) GetRawBlock(blockHash string) (string, error) {
+	r, err := b.client.call("getblock", []interface{}{blockHash, 0})
+	if err = handleError(err, &r); err != nil {
+		return "", err
+	}
+	var rawBlock string
+	err = json.Unmarshal(r.Result, &rawBlock)
+
+	return rawBlock, err
+}
+
 // WalletPassphrase stores the wallet decryption key in memory for <timeout> seconds.
 func (b *Bitcoind) WalletPassphrase(passPhrase string, timeout uint64) error {
 	log.Println("Calling 'walletpassphrase'")
@@ -117,3 +218,27 @@ func (b *Bitcoind) WalletPassphrase(passPhrase string, timeout uint64) error {
 
 	return handleError(err, &r)
 }
+
+// GetRawBlocks returns the hex encoded serialized blocks with the given hashes using a single batch request
+func (b *Bitcoind) GetRawBlocks(blockHashes []string) ([]string, error) {
+	params := make([]interface{}, len(blockHashes))
+	for i, blockHash := range blockHashes {
+		params[i] = []interface{}{blockHash, 0}
+	}
+	responses, err := b.client.batchCall("getblock", params)
+	if err != nil {
+		return nil, err
+	}
+
+	rawBlocks := make([]string, len(responses))
+	for i := range responses {
+		if err = handleError(nil, &responses[i]); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(responses[i].Result, &rawBlocks[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return rawBlocks, nil
+}
@@ -11,6 +11,7 @@ type ListUnspentResult struct {
 	Amount        float64 `json:"amount"`
 	Confirmations int64   `json:"confirmations"`
 	Spendable     bool    `json:"spendable"`
+	Solvable      bool    `json:"solvable"`
 }
 
 type GetBlockResult struct {
@@ -133,3 +134,42 @@ type ScriptVerificationError struct {
 	// Verification or signing error related to the input
 	Error string `json:"error"`
 }
+
+type EstimateSmartFeeResult struct {
+
+	// Estimated fee rate in BTC/kvB, missing when there isn't enough data
+	FeeRate float64 `json:"feerate,omitempty"`
+	// Errors encountered during processing
+	Errors []string `json:"errors,omitempty"`
+	// Block number where the estimate was found
+	Blocks int64 `json:"blocks"`
+}
+
+type GetAddressInfoResult struct {
+
+	// The bitcoin address
+	Address string `json:"address"`
+	// The hex-encoded scriptPubKey generated by the address
+	ScriptPubKey string `json:"scriptPubKey"`
+	// If the address belongs to the wallet
+	IsMine bool `json:"ismine"`
+	// If the address is a witness address
+	IsWitness bool `json:"iswitness"`
+	// The version number of the witness program
+	WitnessVersion int `json:"witness_version,omitempty"`
+	// The hex-encoded public key of single key addresses
+	PubKey string `json:"pubkey,omitempty"`
+	// The BIP32 path the key was derived with, if the wallet knows it
+	HDKeyPath string `json:"hdkeypath,omitempty"`
+	// The fingerprint of the master key the key was derived from
+	HDMasterFingerprint string `json:"hdmasterfingerprint,omitempty"`
+}
+
+type GetTransactionResult struct {
+	// The transaction id
+	TxID string `json:"txid"`
+	// The number of confirmations, negative when the transaction conflicts with the chain
+	Confirmations int64 `json:"confirmations"`
+	// The hex-encoded serialized transaction
+	Hex string `json:"hex"`
+}
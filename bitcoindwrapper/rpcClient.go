@@ -99,11 +99,48 @@ func (c *rpcClient) doTimeoutRequest(timer *time.Timer, req *http.Request) (*htt
 
 // call prepare & exec the request
 func (c *rpcClient) call(method string, params interface{}) (rr rpcResponse, err error) {
-	connectTimer := time.NewTimer(time.Duration(c.timeout) * time.Second)
 	rpcR := rpcRequest{method, params, time.Now().UnixNano(), "1.0"}
+	err = c.post(rpcR, &rr)
+	return
+}
+
+// batchCall sends every request in a single JSON-RPC batch and returns the responses in the
+// order of the requests
+func (c *rpcClient) batchCall(method string, params []interface{}) ([]rpcResponse, error) {
+	requests := make([]rpcRequest, len(params))
+	for i, param := range params {
+		requests[i] = rpcRequest{method, param, int64(i), "1.0"}
+	}
+
+	var responses []rpcResponse
+	if err := c.post(requests, &responses); err != nil {
+		return nil, err
+	}
+
+	// The server is free to answer in any order
+	ordered := make([]rpcResponse, len(requests))
+	answered := make([]bool, len(requests))
+	for _, response := range responses {
+		if response.Id < 0 || response.Id >= int64(len(requests)) || answered[response.Id] {
+			return nil, errors.New("Unexpected response id in batch")
+		}
+		ordered[response.Id] = response
+		answered[response.Id] = true
+	}
+	if len(responses) != len(requests) {
+		return nil, errors.New("Missing responses in batch")
+	}
+
+	return ordered, nil
+}
+
+// post sends the JSON encoded payload and decodes the answer into result
+func (c *rpcClient) post(payload interface{}, result interface{}) (err error) {
+	connectTimer := time.NewTimer(time.Duration(c.timeout) * time.Second)
+	defer connectTimer.Stop()
 	payloadBuffer := &bytes.Buffer{}
 	jsonEncoder := json.NewEncoder(payloadBuffer)
-	err = jsonEncoder.Encode(rpcR)
+	err = jsonEncoder.Encode(payload)
 	if err != nil {
 		return
 	}
@@ -130,6 +167,6 @@ func (c *rpcClient) call(method string, params interface{}) (rr rpcResponse, err
 		return
 	}
 
-	err = json.Unmarshal(data, &rr)
+	err = json.Unmarshal(data, result)
 	return
 }
@@ -0,0 +1,538 @@
+package chainfake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/jsmvalente/ldRouting/bitcoindwrapper"
+)
+
+const (
+	//bitcoind's error code for heights above the tip
+	rpcInvalidParameter bitcoindwrapper.RPCErrorCode = -8
+	//bitcoind's error code for unknown blocks and transactions
+	rpcInvalidAddressOrKey bitcoindwrapper.RPCErrorCode = -5
+
+	//LDR registration output script prefix: OP_RETURN OP_PUSHDATA1 76 "lar"
+	registrationScriptPrefix = "6a4c4c6c6172"
+)
+
+//block is a mined block in the fake chain
+type block struct {
+	header wire.BlockHeader
+	height uint64
+	txs    []*wire.MsgTx
+}
+
+//A Chain is a scripted in-memory blockchain with a wallet holding a set of unspent outputs
+type Chain struct {
+	mutex   sync.Mutex
+	blocks  []*block
+	mempool []*wire.MsgTx
+	utxos   []bitcoindwrapper.ListUnspentResult
+	nonce   uint32
+	//feeRate is the fee rate estimate in BTC/kvB, 0 when there isn't enough data like on a new regtest chain
+	feeRate float64
+	//addresses maps the wallet addresses to their output scripts
+	addresses map[string][]byte
+	//keys maps the addresses of the imported keys to what the wallet knows about them
+	keys map[string]*bitcoindwrapper.GetAddressInfoResult
+}
+
+//New returns a chain holding only a genesis block
+func New() *Chain {
+	c := &Chain{addresses: make(map[string][]byte), keys: make(map[string]*bitcoindwrapper.GetAddressInfoResult)}
+	c.blocks = append(c.blocks, c.newBlock(chainhash.Hash{}, 0, nil))
+	return c
+}
+
+//newBlock builds a block on top of prevHash, the nonce makes competing blocks unique
+func (c *Chain) newBlock(prevHash chainhash.Hash, height uint64, txs []*wire.MsgTx) *block {
+
+	var txHashes bytes.Buffer
+	for _, tx := range txs {
+		txHash := tx.TxHash()
+		txHashes.Write(txHash[:])
+	}
+
+	c.nonce++
+	header := wire.BlockHeader{Version: 1, PrevBlock: prevHash,
+		MerkleRoot: chainhash.DoubleHashH(txHashes.Bytes()),
+		Timestamp:  time.Unix(1231006505+int64(height)*600, 0), Nonce: c.nonce}
+
+	return &block{header: header, height: height, txs: txs}
+}
+
+//Mine mines a block with every transaction in the mempool plus txs and returns its hash
+func (c *Chain) Mine(txs ...*wire.MsgTx) string {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tip := c.blocks[len(c.blocks)-1]
+	blockTxs := append(c.mempool, txs...)
+	c.mempool = nil
+
+	newBlock := c.newBlock(tip.header.BlockHash(), tip.height+1, blockTxs)
+	c.blocks = append(c.blocks, newBlock)
+
+	return newBlock.header.BlockHash().String()
+}
+
+//MineEmpty mines n blocks without transactions
+func (c *Chain) MineEmpty(n int) {
+	for i := 0; i < n; i++ {
+		c.Mine()
+	}
+}
+
+//Reorg disconnects the last depth blocks dropping their transactions, as if they had
+//been double spent by the competing branch. New blocks are then mined on top of the fork point
+func (c *Chain) Reorg(depth int) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if depth >= len(c.blocks) {
+		depth = len(c.blocks) - 1
+	}
+	c.blocks = c.blocks[:len(c.blocks)-depth]
+}
+
+//AddUTXO gives the wallet an unspent output worth amount BTC paying to address
+func (c *Chain) AddUTXO(address btcutil.Address, amount float64) error {
+	return c.addUTXO(address, amount, true)
+}
+
+//AddWatchOnlyUTXO gives the wallet an unspent output paying to address without holding its key,
+//like the outputs of an imported public descriptor
+func (c *Chain) AddWatchOnlyUTXO(address btcutil.Address, amount float64) error {
+	return c.addUTXO(address, amount, false)
+}
+
+//ImportKey makes the wallet aware of the legacy, nested segwit and native segwit addresses of pubKey,
+//derived at path from the master key with fingerprint, like an imported public descriptor
+func (c *Chain) ImportKey(pubKey []byte, fingerprint string, path string) error {
+
+	keyHash := btcutil.Hash160(pubKey)
+	legacy, err := btcutil.NewAddressPubKeyHash(keyHash, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return err
+	}
+	segwit, err := btcutil.NewAddressWitnessPubKeyHash(keyHash, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return err
+	}
+	witnessProgram, err := txscript.PayToAddrScript(segwit)
+	if err != nil {
+		return err
+	}
+	nested, err := btcutil.NewAddressScriptHash(witnessProgram, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, address := range []btcutil.Address{legacy, segwit, nested} {
+		script, err := txscript.PayToAddrScript(address)
+		if err != nil {
+			return err
+		}
+		c.keys[address.EncodeAddress()] = &bitcoindwrapper.GetAddressInfoResult{Address: address.EncodeAddress(),
+			ScriptPubKey: hex.EncodeToString(script), IsWitness: txscript.IsWitnessProgram(script),
+			PubKey: hex.EncodeToString(pubKey), HDKeyPath: path, HDMasterFingerprint: fingerprint}
+	}
+
+	return nil
+}
+
+func (c *Chain) addUTXO(address btcutil.Address, amount float64, spendable bool) error {
+
+	script, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		return err
+	}
+
+	//Nested segwit outputs of imported keys are listed with their redeem script
+	var redeemScript string
+	if info, imported := c.keys[address.EncodeAddress()]; imported && txscript.IsPayToScriptHash(script) {
+		pubKey, err := hex.DecodeString(info.PubKey)
+		if err != nil {
+			return err
+		}
+		witnessProgram, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(pubKey)).Script()
+		if err != nil {
+			return err
+		}
+		redeemScript = hex.EncodeToString(witnessProgram)
+	}
+
+	//Fund the output with a transaction mined in its own block
+	fundingTx := wire.NewMsgTx(wire.TxVersion)
+	fundingTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: wire.MaxPrevOutIndex}, nil, nil))
+	fundingTx.AddTxOut(wire.NewTxOut(int64(amount*btcutil.SatoshiPerBitcoin), script))
+	c.Mine(fundingTx)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.utxos = append(c.utxos, bitcoindwrapper.ListUnspentResult{TxID: fundingTx.TxHash().String(),
+		Vout: 0, Address: address.EncodeAddress(), ScriptPubKey: hex.EncodeToString(script), RedeemScript: redeemScript,
+		Amount: amount, Confirmations: 1, Spendable: spendable, Solvable: true})
+
+	return nil
+}
+
+//SetFeeRate sets the fee rate estimate returned by EstimateSmartFee in BTC/kvB, 0 leaves no estimate
+func (c *Chain) SetFeeRate(feeRate float64) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.feeRate = feeRate
+}
+
+//Mempool returns the transactions waiting to be mined
+func (c *Chain) Mempool() []*wire.MsgTx {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]*wire.MsgTx{}, c.mempool...)
+}
+
+//GetRawMempool returns the ids of the transactions waiting to be mined
+func (c *Chain) GetRawMempool() ([]string, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	txIDs := make([]string, len(c.mempool))
+	for i, tx := range c.mempool {
+		txIDs[i] = tx.TxHash().String()
+	}
+
+	return txIDs, nil
+}
+
+//GetBlockCount returns the height of the tip
+func (c *Chain) GetBlockCount() (uint64, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.blocks[len(c.blocks)-1].height, nil
+}
+
+//GetBlockHash returns the hash of the block at height index
+func (c *Chain) GetBlockHash(index uint64) (string, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if index >= uint64(len(c.blocks)) {
+		return "", bitcoindwrapper.RPCError{Code: rpcInvalidParameter, Message: "Block height out of range"}
+	}
+
+	return c.blocks[index].header.BlockHash().String(), nil
+}
+
+//GetBlockHashes returns the hashes of the blocks at every height in indexes
+func (c *Chain) GetBlockHashes(indexes []uint64) ([]string, error) {
+
+	var hashes []string
+	for _, index := range indexes {
+		hash, err := c.GetBlockHash(index)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+//GetRawBlock returns the hex encoded serialization of the block identified by blockHash
+func (c *Chain) GetRawBlock(blockHash string) (string, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, b := range c.blocks {
+		if b.header.BlockHash().String() != blockHash {
+			continue
+		}
+
+		msgBlock := wire.MsgBlock{Header: b.header, Transactions: b.txs}
+		var buffer bytes.Buffer
+		if err := msgBlock.Serialize(&buffer); err != nil {
+			return "", err
+		}
+
+		return hex.EncodeToString(buffer.Bytes()), nil
+	}
+
+	return "", bitcoindwrapper.RPCError{Code: rpcInvalidAddressOrKey, Message: "Block not found"}
+}
+
+//GetRawBlocks returns the hex encoded serialization of the blocks identified by blockHashes
+func (c *Chain) GetRawBlocks(blockHashes []string) ([]string, error) {
+
+	var rawBlocks []string
+	for _, blockHash := range blockHashes {
+		rawBlock, err := c.GetRawBlock(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		rawBlocks = append(rawBlocks, rawBlock)
+	}
+
+	return rawBlocks, nil
+}
+
+//ListUnspent returns the wallet's unspent outputs
+func (c *Chain) ListUnspent() ([]bitcoindwrapper.ListUnspentResult, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]bitcoindwrapper.ListUnspentResult{}, c.utxos...), nil
+}
+
+//EstimateSmartFee returns the fee rate set with SetFeeRate
+func (c *Chain) EstimateSmartFee(confTarget uint64) (*bitcoindwrapper.EstimateSmartFeeResult, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.feeRate == 0 {
+		return &bitcoindwrapper.EstimateSmartFeeResult{Errors: []string{"Insufficient data or no feerate found"}}, nil
+	}
+
+	return &bitcoindwrapper.EstimateSmartFeeResult{FeeRate: c.feeRate, Blocks: int64(confTarget)}, nil
+}
+
+//GetRawChangeAddress returns a new regtest wallet address of addressType, "legacy" or "bech32"
+func (c *Chain) GetRawChangeAddress(addressType string) (string, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	//Every address gets a different made up key hash
+	keyHash := make([]byte, 20)
+	binary.BigEndian.PutUint32(keyHash, uint32(len(c.addresses)+1))
+
+	var address btcutil.Address
+	var err error
+	switch addressType {
+	case "legacy":
+		address, err = btcutil.NewAddressPubKeyHash(keyHash, &chaincfg.RegressionNetParams)
+	case "bech32":
+		address, err = btcutil.NewAddressWitnessPubKeyHash(keyHash, &chaincfg.RegressionNetParams)
+	default:
+		return "", bitcoindwrapper.RPCError{Code: rpcInvalidAddressOrKey, Message: "Unknown address type '" + addressType + "'"}
+	}
+	if err != nil {
+		return "", err
+	}
+	script, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		return "", err
+	}
+	c.addresses[address.EncodeAddress()] = script
+
+	return address.EncodeAddress(), nil
+}
+
+//GetAddressInfo returns the output script of an address, along with the key and its derivation for imported keys
+func (c *Chain) GetAddressInfo(address string) (*bitcoindwrapper.GetAddressInfoResult, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if info, imported := c.keys[address]; imported {
+		return info, nil
+	}
+
+	script, isMine := c.addresses[address]
+	if !isMine {
+		decoded, err := btcutil.DecodeAddress(address, &chaincfg.RegressionNetParams)
+		if err != nil {
+			return nil, bitcoindwrapper.RPCError{Code: rpcInvalidAddressOrKey, Message: "Invalid address"}
+		}
+		if script, err = txscript.PayToAddrScript(decoded); err != nil {
+			return nil, err
+		}
+	}
+
+	return &bitcoindwrapper.GetAddressInfoResult{Address: address, ScriptPubKey: hex.EncodeToString(script),
+		IsMine: isMine, IsWitness: txscript.IsWitnessProgram(script)}, nil
+}
+
+//GetTransaction returns a transaction of the chain or the mempool
+func (c *Chain) GetTransaction(txID string) (*bitcoindwrapper.GetTransactionResult, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tip := c.blocks[len(c.blocks)-1].height
+	find := func(txs []*wire.MsgTx, confirmations int64) (*bitcoindwrapper.GetTransactionResult, error) {
+		for _, tx := range txs {
+			if tx.TxHash().String() != txID {
+				continue
+			}
+			var rawTx bytes.Buffer
+			if err := tx.Serialize(&rawTx); err != nil {
+				return nil, err
+			}
+			return &bitcoindwrapper.GetTransactionResult{TxID: txID, Confirmations: confirmations,
+				Hex: hex.EncodeToString(rawTx.Bytes())}, nil
+		}
+		return nil, nil
+	}
+
+	if result, err := find(c.mempool, 0); result != nil || err != nil {
+		return result, err
+	}
+	for _, block := range c.blocks {
+		if result, err := find(block.txs, int64(tip-block.height)+1); result != nil || err != nil {
+			return result, err
+		}
+	}
+
+	return nil, bitcoindwrapper.RPCError{Code: rpcInvalidAddressOrKey, Message: "Invalid or non-wallet transaction id"}
+}
+
+//SignRawTransactionWithWallet accepts the transaction as signed, the fake wallet doesn't check scripts
+func (c *Chain) SignRawTransactionWithWallet(rawTx string) (*bitcoindwrapper.SignRawTransactionWithWalletResult, error) {
+
+	if _, err := deserializeTx(rawTx); err != nil {
+		return nil, err
+	}
+
+	return &bitcoindwrapper.SignRawTransactionWithWalletResult{Hex: rawTx, Complete: true}, nil
+}
+
+//SendRawTransaction adds the transaction to the mempool and spends the wallet outputs it uses
+//Mempool transactions spending the same outputs are replaced, along with the transactions spending them
+func (c *Chain) SendRawTransaction(signedTx string) (string, error) {
+
+	tx, err := deserializeTx(signedTx)
+	if err != nil {
+		return "", err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	spent := make(map[wire.OutPoint]bool)
+	for _, txIn := range tx.TxIn {
+		spent[txIn.PreviousOutPoint] = true
+	}
+	evicted := make(map[chainhash.Hash]bool)
+	var mempool []*wire.MsgTx
+	for _, mempoolTx := range c.mempool {
+		for _, txIn := range mempoolTx.TxIn {
+			if spent[txIn.PreviousOutPoint] || evicted[txIn.PreviousOutPoint.Hash] {
+				evicted[mempoolTx.TxHash()] = true
+			}
+		}
+		if !evicted[mempoolTx.TxHash()] {
+			mempool = append(mempool, mempoolTx)
+		}
+	}
+	c.mempool = mempool
+
+	for _, txIn := range tx.TxIn {
+		for i, utxo := range c.utxos {
+			if utxo.TxID == txIn.PreviousOutPoint.Hash.String() && utxo.Vout == txIn.PreviousOutPoint.Index {
+				c.utxos = append(c.utxos[:i], c.utxos[i+1:]...)
+				break
+			}
+		}
+	}
+	c.mempool = append(c.mempool, tx)
+
+	return tx.TxHash().String(), nil
+}
+
+//RegistrationTx returns a transaction registering address in the format broadcast by ldrlib
+//sig is the 65 byte lightning node signature of the address
+func RegistrationTx(version uint32, address [4]byte, sig []byte) (*wire.MsgTx, error) {
+
+	if len(sig) != 65 {
+		return nil, errors.New("registration signatures are 65 bytes long")
+	}
+
+	script, err := hex.DecodeString(registrationScriptPrefix)
+	if err != nil {
+		return nil, err
+	}
+	versionBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(versionBytes, version)
+	script = append(script, versionBytes...)
+	script = append(script, address[:]...)
+	script = append(script, sig...)
+
+	//Spend a made up output so every registration has a different id
+	var prevHash chainhash.Hash
+	copy(prevHash[:], sig)
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(100, script))
+	tx.AddTxOut(wire.NewTxOut(10000, []byte{txscript.OP_TRUE}))
+
+	return tx, nil
+}
+
+//decodeTx transforms tx into the verbose format used by bitcoind
+func decodeTx(tx *wire.MsgTx) (*bitcoindwrapper.GetRawTransactionResult, error) {
+
+	var buffer bytes.Buffer
+	if err := tx.Serialize(&buffer); err != nil {
+		return nil, err
+	}
+
+	result := &bitcoindwrapper.GetRawTransactionResult{Hex: hex.EncodeToString(buffer.Bytes()),
+		Txid: tx.TxHash().String(), Version: uint32(tx.Version), LockTime: tx.LockTime}
+
+	for _, txIn := range tx.TxIn {
+		result.Vin = append(result.Vin, bitcoindwrapper.Vin{Txid: txIn.PreviousOutPoint.Hash.String(),
+			Vout: int(txIn.PreviousOutPoint.Index), Sequence: txIn.Sequence,
+			ScriptSig: bitcoindwrapper.ScriptSig{Hex: hex.EncodeToString(txIn.SignatureScript)}})
+	}
+
+	for n, txOut := range tx.TxOut {
+		result.Vout = append(result.Vout, bitcoindwrapper.Vout{Value: btcutil.Amount(txOut.Value).ToBTC(), N: n,
+			ScriptPubKey: bitcoindwrapper.ScriptPubKey{Hex: hex.EncodeToString(txOut.PkScript),
+				Type: txscript.GetScriptClass(txOut.PkScript).String()}})
+	}
+
+	return result, nil
+}
+
+func deserializeTx(rawTx string) (*wire.MsgTx, error) {
+
+	txBytes, err := hex.DecodeString(rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err = tx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
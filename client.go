@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -13,9 +15,8 @@ import (
 	"strings"
 	"syscall"
 
-	"github.com/jsmvalente/ldRouting/bitcoindwrapper"
+	"github.com/btcsuite/btcutil"
 	"github.com/jsmvalente/ldRouting/ldrlib"
-	"github.com/jsmvalente/ldRouting/lndwrapper"
 )
 
 func main() {
@@ -32,21 +33,56 @@ func main() {
 	var tlsCertPath string
 	var dataPath string
 	var port string
+	var confirmationsString string
+	var zmqBlockAddress string
+	var networkName string
+	var changeAddressType string
+	var registrationWallet string
+	var activationHeightString string
+	var vppnFiles string
 	var localAddress [4]byte
 
 	//Get values from command line arguments
+	flag.StringVar(&networkName, "network", ldrlib.DefaultNetwork, "Bitcoin network: mainnet, testnet, signet or regtest")
 	flag.StringVar(&bitcoinClientHost, "bitcoinClientHost", "localhost", "Bitcoin core host address")
-	flag.StringVar(&bitcoinClientPortString, "bitcoinClientPort", "8332", "Bitcoin core RPC port")
+	flag.StringVar(&bitcoinClientPortString, "bitcoinClientPort", "", "Bitcoin core RPC port (default depends on the network)")
 	flag.StringVar(&bitcoinRPCUser, "bitcoinRPCUser", "rpcUserExample", "Bitcoin core RPC user")
 	flag.StringVar(&bitcoinRPCPassword, "bitcoinRPCPassword", "rpcPasswordExample", "Bitcoin core RPC password")
 	flag.StringVar(&lightningClientHost, "lightningClientHost", "localhost", "LND host address")
 	flag.StringVar(&lightningClientPortString, "lightningClientPort", "10009", "LND host port")
 	flag.StringVar(&port, "port", ldrlib.DefaultPort, "Port to listen for new connections to the client")
-	flag.StringVar(&macaroonPath, "macaroonPath", path.Join(os.Getenv("HOME"), ".lnd/data/chain/bitcoin/mainnet/admin.macaroon"), "Path to the macaroon used with LND for authenticate")
+	flag.StringVar(&macaroonPath, "macaroonPath", "", "Path to the macaroon used with LND for authenticate (default depends on the network)")
 	flag.StringVar(&tlsCertPath, "tlsCertPath", path.Join(os.Getenv("HOME"), ".lnd/tls.cert"), "Path to the TLS certificate used with LND for authentication")
-	flag.StringVar(&dataPath, "dataPath", path.Join(os.Getenv("HOME"), ".ldRouting/data"), "Path to directory holding the application's data")
+	flag.StringVar(&dataPath, "dataPath", "", "Path to directory holding the application's data (default depends on the network)")
+	flag.StringVar(&confirmationsString, "confirmations", strconv.FormatUint(ldrlib.DefaultConfirmationDepth, 10), "Number of confirmations an address registration needs to be accepted")
+	flag.StringVar(&zmqBlockAddress, "zmqBlockAddress", "tcp://127.0.0.1:28332", "Bitcoin core zmqpubrawblock or zmqpubhashblock address, empty to poll for new blocks")
+	flag.StringVar(&registrationWallet, "registrationWallet", "bitcoind", "Wallet funding address and prefix registrations, revocations and transfers: bitcoind or lnd (needs lnd built with the walletrpc tag)")
+	flag.StringVar(&changeAddressType, "changeAddressType", ldrlib.DefaultChangeAddressType, "Bitcoin core wallet address type of the registration change: legacy, p2sh-segwit, bech32 or bech32m")
+	flag.StringVar(&activationHeightString, "activationHeight", "", "Height of the first block that can hold address registrations (default: 0, every block is scanned)")
+	flag.StringVar(&vppnFiles, "vppn", "", "Comma separated paths to the definitions of the VPPNs to join")
 	flag.Parse()
 
+	//Fill in the defaults that depend on the network
+	network, err := ldrlib.GetNetwork(networkName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if bitcoinClientPortString == "" {
+		bitcoinClientPortString = strconv.Itoa(network.BitcoinRPCPort)
+	}
+	if macaroonPath == "" {
+		macaroonPath = network.MacaroonPath(os.Getenv("HOME"))
+	}
+	if dataPath == "" {
+		dataPath = network.DataPath(os.Getenv("HOME"))
+	}
+
+	//Maintenance commands only need the data directory, imports are checked against the chain later
+	if flag.Arg(0) == "db" && !chainDBCommands[flag.Arg(1)] {
+		dbCommand(dataPath, network, flag.Args()[1:])
+		return
+	}
+
 	bitcoinClientPort, err := strconv.Atoi(bitcoinClientPortString)
 	if err != nil {
 		log.Fatal(err)
@@ -55,6 +91,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	confirmations, err := strconv.ParseUint(confirmationsString, 10, 64)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	log.Println("Connecting to bitcoin client")
 	btcClient, err := ldrlib.ConnectToBitcoinClient(bitcoinClientHost, bitcoinClientPort, bitcoinRPCUser, bitcoinRPCPassword)
@@ -68,12 +108,62 @@ func main() {
 		log.Fatal(err)
 	}
 
+	register := newRegisterFunc(btcClient, lnClient, registrationWallet, changeAddressType)
+
+	//Make sure both clients run on the chosen network
+	err = ldrlib.VerifyNetwork(btcClient, lnClient, network)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	//Read our address database into memory
 	log.Println("Reading addresses database")
-	db := ldrlib.ReadDBFromDisk(dataPath, lnClient)
+	db := ldrlib.ReadDBFromDisk(dataPath, network, lnClient)
+	db.SetConfirmationDepth(confirmations)
+	if activationHeightString != "" {
+		activationHeight, err := strconv.ParseUint(activationHeightString, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db.SetActivationHeight(activationHeight)
+	}
+
+	//Join the private networks before any peer connects, so members can exchange their tables
+	if vppnFiles != "" {
+		for _, vppnFile := range strings.Split(vppnFiles, ",") {
+			vppn, err := ldrlib.ReadVPPN(vppnFile, lnClient)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err = db.JoinVPPN(vppn); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if flag.Arg(0) == "register" {
+		registerCommand(btcClient, lnClient, db, registrationWallet, changeAddressType, flag.Args()[1:])
+		return
+	}
+
+	if flag.Arg(0) == "db" {
+		chainDBCommand(btcClient, lnClient, db, flag.Args()[1:])
+		return
+	}
 
 	// Update the database and start a subroutine to keep it keep up to database
-	db.UpdateAddressDB(btcClient, lnClient)
+	err = db.UpdateAddressDB(btcClient, lnClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var blockNotifications <-chan struct{}
+	if zmqBlockAddress != "" {
+		blockNotifications, err = ldrlib.SubscribeToBlocks(zmqBlockAddress)
+		if err != nil {
+			log.Println("Couldn't subscribe to block notifications:", err)
+		}
+	}
+	go db.SynchronizeAddressDB(btcClient, lnClient, blockNotifications, ldrlib.DefaultPollInterval)
 	log.Println("Started sync address DB routine.")
 
 	// synchronize the local routing entry DB with the changes that might happen
@@ -83,12 +173,14 @@ func main() {
 
 	//Register a routing address if the user doesn't have one
 	log.Println("Verifying local address registration...")
-	localAddress, valid := verifyLocalAddressRegistration(btcClient, lnClient, db)
-	if !valid {
-		//Enter the address regitration menu to get the user to register an address
-		localAddress = addressRegistrationMenu(btcClient, lnClient, db)
+	localAddress, valid, pending := verifyLocalAddressRegistration(btcClient, lnClient, db)
+	if valid {
+		db.SaveLocalAddress(localAddress)
+	} else if !pending {
+		//Enter the address regitration menu to get the user to register an address,
+		//it becomes the local address once the sync routine accepts it
+		addressRegistrationMenu(lnClient, register, db)
 	}
-	db.SaveLocalAddress(localAddress)
 
 	//Tries to connect to LN peers that share a channel and are registered by using their
 	//lightning node public IP addresses
@@ -101,27 +193,325 @@ func main() {
 
 	setupSigTermHandler(db)
 
-	optionMenu(lnClient, db)
+	optionMenu(btcClient, lnClient, db)
+}
+
+//dbCommand runs the 'db migrate', 'db verify [-repair]' and 'db export [file]' maintenance commands on the DB in dataPath
+func dbCommand(dataPath string, network *ldrlib.Network, args []string) {
+
+	if len(args) == 0 {
+		log.Fatal("Usage: ldRouting [options] db migrate|verify [-repair]|export [file]|import <file>|snapshot <file>|bootstrap <file> <signer pubkey>[,<signer pubkey>...]")
+	}
+
+	switch args[0] {
+	case "migrate":
+		err := ldrlib.MigrateDB(dataPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("DB in", dataPath, "is up to date")
+	case "verify":
+		verifyFlags := flag.NewFlagSet("verify", flag.ExitOnError)
+		repair := verifyFlags.Bool("repair", false, "Remove the records causing inconsistencies")
+		verifyFlags.Parse(args[1:])
+
+		problems, err := ldrlib.VerifyDB(dataPath, *repair)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) == 0 {
+			fmt.Println("DB in", dataPath, "is consistent")
+		} else if *repair {
+			fmt.Println("Repaired", len(problems), "problems")
+		} else {
+			fmt.Println("Found", len(problems), "problems, run 'db verify -repair' to fix them")
+			os.Exit(1)
+		}
+	case "export":
+		db := ldrlib.ReadDBFromDisk(dataPath, network, nil)
+		defer db.Close()
+
+		out := os.Stdout
+		if len(args) > 1 {
+			fp, err := os.Create(args[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer fp.Close()
+			out = fp
+		}
+		err := db.ExportJSON(out)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal("Unknown db command '" + args[0] + "'")
+	}
 }
 
-func verifyLocalAddressRegistration(btcClient *bitcoindwrapper.Bitcoind, lnClient *lndwrapper.Lnd, addressDB *ldrlib.DB) ([4]byte, bool) {
+//chainDBCommands are the db commands that need the bitcoin and lightning clients
+var chainDBCommands = map[string]bool{"import": true, "snapshot": true, "bootstrap": true}
+
+//chainDBCommand runs the 'db import <file>', 'db snapshot <file>' and 'db bootstrap <file> <signers>' commands
+func chainDBCommand(btcClient ldrlib.ChainBackend, lnClient ldrlib.LightningBackend, db *ldrlib.DB, args []string) {
+
+	defer db.Close()
+
+	if len(args) < 2 {
+		log.Fatal("Usage: ldRouting [options] db import|snapshot|bootstrap <file>")
+	}
+	filePath := args[1]
+
+	switch args[0] {
+	case "import":
+		fp, err := os.Open(filePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fp.Close()
+
+		err = db.ImportJSON(fp, btcClient, lnClient)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Imported", filePath)
+	case "snapshot":
+		//Snapshots only hold confirmed blocks
+		err := db.UpdateAddressDB(btcClient, lnClient)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fp, err := os.Create(filePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fp.Close()
+
+		err = db.WriteSnapshot(fp, lnClient)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Wrote snapshot to", filePath)
+	case "bootstrap":
+		if len(args) < 3 {
+			log.Fatal("Usage: ldRouting [options] db bootstrap <file> <signer pubkey>[,<signer pubkey>...]")
+		}
+		var trustedSigners [][33]byte
+		for _, signer := range strings.Split(args[2], ",") {
+			if len(signer) != 66 {
+				log.Fatal("Invalid signer public key '" + signer + "'")
+			}
+			trustedSigners = append(trustedSigners, ldrlib.PubKeyStringToArray(signer))
+		}
+
+		fp, err := os.Open(filePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fp.Close()
+
+		err = db.LoadSnapshot(fp, btcClient, trustedSigners)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Bootstrapped DB from", filePath)
+	}
+}
+
+//registerCommand runs the 'register psbt <address> [file]' and 'register broadcast <file>' commands registering
+//an address with a bitcoin wallet whose keys are kept offline. Broadcast registrations are tracked in db.
+//'register revoke' and 'register transfer <node pubkey>' release the address of the local node or move it to another node
+//and 'register prefix <prefix>' registers a prefix in CIDR notation instead of a single address
+func registerCommand(btcClient ldrlib.ChainBackend, lnClient ldrlib.LightningBackend, db *ldrlib.DB, registrationWallet string, changeAddressType string, args []string) {
+
+	defer db.Close()
+	messages := newAddressMessageFuncs(btcClient, lnClient, db, registrationWallet, changeAddressType)
+
+	usage := "Usage: ldRouting [options] register psbt <address> [file]|broadcast <file>|revoke|transfer <node pubkey>|prefix <prefix>"
+	if len(args) == 0 || (args[0] != "revoke" && len(args) < 2) {
+		log.Fatal(usage)
+	}
+
+	switch args[0] {
+	case "prefix":
+		address, prefixLen, err := ldrlib.ParsePrefix(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		txHash, err := messages.prefix(address, prefixLen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Broadcasted registration of", args[1], "Tx Hash:", txHash)
+	case "revoke", "transfer":
+		//The address has to be known to be revoked or transferred
+		err := db.UpdateAddressDB(btcClient, lnClient)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var txHash string
+		if args[0] == "revoke" {
+			txHash, err = messages.revoke()
+		} else {
+			pubKey, decodeErr := hex.DecodeString(args[1])
+			if decodeErr != nil || len(pubKey) != 33 {
+				log.Fatal("Invalid node public key '" + args[1] + "'")
+			}
+			var newNodePubKey [33]byte
+			copy(newNodePubKey[:], pubKey)
+			txHash, err = messages.transfer(newNodePubKey)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Broadcasted", args[0], "of the local address. Tx Hash:", txHash)
+	case "psbt":
+		ip := net.ParseIP(args[1]).To4()
+		if ip == nil {
+			log.Fatal("Invalid address '" + args[1] + "'")
+		}
+		var address [4]byte
+		copy(address[:], ip)
+
+		unsignedPSBT, err := ldrlib.CreateRegistrationPSBT(btcClient, lnClient, changeAddressType, address)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(args) < 3 {
+			fmt.Println(unsignedPSBT)
+			return
+		}
+		err = ioutil.WriteFile(args[2], []byte(unsignedPSBT+"\n"), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Wrote the unsigned registration of", ip, "to", args[2])
+	case "broadcast":
+		signedPSBT, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		registration, err := ldrlib.BroadcastSignedPSBT(btcClient, string(signedPSBT))
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = db.TrackRegistration(registration)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Broadcasted registration. Tx Hash:", registration.TxHash())
+	default:
+		log.Fatal("Unknown register command '" + args[0] + "'")
+	}
+}
+
+//verifyLocalAddressRegistration returns the address of the local node if it has one and if a registration
+//of the local node is still pending
+func verifyLocalAddressRegistration(btcClient ldrlib.ChainBackend, lnClient ldrlib.LightningBackend, addressDB *ldrlib.DB) ([4]byte, bool, bool) {
 
 	localNodePubKey := ldrlib.GetLocalNodePubKey(lnClient)
-	localAddress, valid := addressDB.GetNodeAddress(localNodePubKey)
 
 	// The local node already registered an address
-	if !valid {
+	localAddress, valid := addressDB.GetNodeAddress(localNodePubKey)
+	if valid {
+		log.Println("Local address: " + net.IP(localAddress[:]).String())
+		return localAddress, true, false
+	}
+
+	//Don't register again while a registration is on its way, the sync routine makes its address
+	//the local address once it is accepted
+	pendingRegistrations, err := addressDB.TrackedRegistrations(btcClient, lnClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(pendingRegistrations) == 0 {
 		log.Println("Didn't find an address associated with this node")
-		return [4]byte{}, false
+		return [4]byte{}, false, false
+	}
+	for _, pending := range pendingRegistrations {
+		log.Println("Local address: " + net.IP(pending.Address[:]).String() + " registration pending, " +
+			strconv.FormatUint(pending.Confirmations, 10) + " confirmations")
 	}
 
-	log.Println("Local address: " + net.IP(localAddress[:]).String())
+	return [4]byte{}, false, true
+}
+
+//registerFunc broadcasts the registration of address
+type registerFunc func(address [4]byte) (*ldrlib.RegistrationTx, error)
+
+//newRegisterFunc returns the registerFunc funding registrations with registrationWallet
+func newRegisterFunc(btcClient ldrlib.ChainBackend, lnClient ldrlib.LightningBackend, registrationWallet string, changeAddressType string) registerFunc {
+
+	switch registrationWallet {
+	case "bitcoind":
+		return func(address [4]byte) (*ldrlib.RegistrationTx, error) {
+			return ldrlib.BroadcastNewAddressTx(btcClient, lnClient, changeAddressType, address)
+		}
+	case "lnd":
+		return func(address [4]byte) (*ldrlib.RegistrationTx, error) {
+			return ldrlib.BroadcastNewAddressTxWithLnd(lnClient, address)
+		}
+	}
 
-	return localAddress, true
+	log.Fatal("Unknown registration wallet " + registrationWallet)
+	return nil
+}
+
+//addressMessageFuncs broadcast the prefix registrations, revocations and transfers of the local node
+//and return their transaction ids
+type addressMessageFuncs struct {
+	prefix   func(address [4]byte, prefixLen uint8) (string, error)
+	revoke   func() (string, error)
+	transfer func(newNodePubKey [33]byte) (string, error)
+}
+
+//newAddressMessageFuncs returns the addressMessageFuncs funding messages with registrationWallet
+func newAddressMessageFuncs(btcClient ldrlib.ChainBackend, lnClient ldrlib.LightningBackend, db *ldrlib.DB, registrationWallet string, changeAddressType string) *addressMessageFuncs {
+
+	switch registrationWallet {
+	case "bitcoind":
+		return &addressMessageFuncs{
+			prefix: func(address [4]byte, prefixLen uint8) (string, error) {
+				unlockWalletMenu(btcClient)
+				return ldrlib.BroadcastNewPrefixTx(btcClient, lnClient, changeAddressType, address, prefixLen)
+			},
+			revoke: func() (string, error) {
+				unlockWalletMenu(btcClient)
+				return db.BroadcastRevocationTx(btcClient, lnClient, changeAddressType)
+			},
+			transfer: func(newNodePubKey [33]byte) (string, error) {
+				unlockWalletMenu(btcClient)
+				return db.BroadcastTransferTx(btcClient, lnClient, changeAddressType, newNodePubKey)
+			},
+		}
+	case "lnd":
+		return &addressMessageFuncs{
+			prefix: func(address [4]byte, prefixLen uint8) (string, error) {
+				return ldrlib.BroadcastNewPrefixTxWithLnd(lnClient, address, prefixLen)
+			},
+			revoke: func() (string, error) {
+				return db.BroadcastRevocationTxWithLnd(lnClient)
+			},
+			transfer: func(newNodePubKey [33]byte) (string, error) {
+				return db.BroadcastTransferTxWithLnd(lnClient, newNodePubKey)
+			},
+		}
+	}
+
+	log.Fatal("Unknown registration wallet " + registrationWallet)
+	return nil
 }
 
 //Address registration process
-func addressRegistrationMenu(btcClient *bitcoindwrapper.Bitcoind, lnClient *lndwrapper.Lnd, addressDB *ldrlib.DB) [4]byte {
+func addressRegistrationMenu(lnClient ldrlib.LightningBackend, register registerFunc, addressDB *ldrlib.DB) [4]byte {
 
 	type addressOption struct {
 		suggested [4]byte
@@ -130,7 +520,10 @@ func addressRegistrationMenu(btcClient *bitcoindwrapper.Bitcoind, lnClient *lndw
 
 	var addressOptions []addressOption
 
-	neighborsPubKey := ldrlib.GetLocalNodeNeighboursPubKeys(lnClient)
+	neighborsPubKey, err := ldrlib.GetLocalNodeNeighboursPubKeys(lnClient)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Get one suggested address for each neighbor
 	for _, neighborPubKey := range neighborsPubKey {
@@ -172,18 +565,22 @@ func addressRegistrationMenu(btcClient *bitcoindwrapper.Bitcoind, lnClient *lndw
 			log.Fatal("Invalid option")
 		} else if userRegistrationOption == -1 {
 			fmt.Println("You choose to register a non suggested address. This is not recommended.")
-			return registerAddressMenu(btcClient, lnClient)
+			return registerAddressMenu(register, addressDB)
 		} else {
-			hash, err := ldrlib.BroadcastNewAddressTx(btcClient, lnClient, addressOptions[userRegistrationOption].suggested)
+			registration, err := register(addressOptions[userRegistrationOption].suggested)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = addressDB.TrackRegistration(registration)
 			if err != nil {
 				log.Fatal(err)
 			}
-			log.Printf("Registered '" + net.IP(addressOptions[userRegistrationOption].suggested[:]).String() + "'." + "\nTx Hash: " + hash)
+			log.Printf("Registered '" + net.IP(addressOptions[userRegistrationOption].suggested[:]).String() + "'." + "\nTx Hash: " + registration.TxHash())
 			return addressOptions[userRegistrationOption].suggested
 		}
 	} else {
 		fmt.Println("No registered neigbours, please register a new address")
-		return registerAddressMenu(btcClient, lnClient)
+		return registerAddressMenu(register, addressDB)
 	}
 
 	return [4]byte{}
@@ -217,21 +614,43 @@ func getValidAddressFromUser() [4]byte {
 	}
 }
 
+//getVPPNFromUser prompts the user for the name of a joined VPPN until it gets one
+func getVPPNFromUser(addressDB *ldrlib.DB) *ldrlib.VPPN {
+
+	reader := bufio.NewReader(os.Stdin)
+
+	for {
+		fmt.Println("VPPN name:")
+		readText, _ := reader.ReadString('\n')
+		name := strings.TrimSuffix(readText, "\n")
+
+		if vppn := addressDB.GetVPPN(name); vppn != nil {
+			return vppn
+		}
+
+		fmt.Println("Haven't joined a VPPN called '" + name + "'")
+	}
+}
+
 //Registers a new address and if the address to be registered is set to nil prompts the user for it
-func registerAddressMenu(btcClient *bitcoindwrapper.Bitcoind, lnClient *lndwrapper.Lnd) [4]byte {
+func registerAddressMenu(register registerFunc, addressDB *ldrlib.DB) [4]byte {
 
 	//Check if we should prompt the address to the user
 	address := getValidAddressFromUser()
-	hash, err := ldrlib.BroadcastNewAddressTx(btcClient, lnClient, address)
+	registration, err := register(address)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Registered '", address, "'. Tx Hash: ", hash)
+	err = addressDB.TrackRegistration(registration)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Registered '", address, "'. Tx Hash: ", registration.TxHash())
 	return address
 }
 
 // Present an option menu to the user
-func optionMenu(lnClient *lndwrapper.Lnd, addressDB *ldrlib.DB) {
+func optionMenu(btcClient ldrlib.ChainBackend, lnClient ldrlib.LightningBackend, addressDB *ldrlib.DB) {
 
 	//Present a menu to the User
 	for true {
@@ -245,6 +664,10 @@ func optionMenu(lnClient *lndwrapper.Lnd, addressDB *ldrlib.DB) {
 		fmt.Println("4 - Send Payment")
 		fmt.Println("5 - Print Routing Table")
 		fmt.Println("6 - Find routing node lightning's public key")
+		fmt.Println("7 - Print Pending Address Registrations")
+		fmt.Println("8 - Bump Local Address Registration Fee")
+		fmt.Println("9 - Find Route in VPPN")
+		fmt.Println("10 - Print VPPN Routing Table")
 		fmt.Println("0 - Exit")
 
 		//Read from command line
@@ -280,12 +703,21 @@ func optionMenu(lnClient *lndwrapper.Lnd, addressDB *ldrlib.DB) {
 			fmt.Println("Got Route!")
 			ldrlib.PrintRoute(route)
 		case 3:
-			//Get an address from the user
-			fmt.Println("Enter the IP 'address:port' of the peer you're trying to connect to, e.g. '192.1.3.56:8695")
+			//Get the lightning node key and address of the peer from the user, the handshake authenticates the key
+			fmt.Println("Enter the 'pubkey@address:port' of the peer you're trying to connect to, e.g. '02a1...@192.1.3.56:8695")
 			fmt.Println("PS: 8695 is the default port.")
 			readText, _ = reader.ReadString('\n')
-			address := strings.TrimSuffix(readText, "\n")
-			ldrlib.ConnectToPeer(lnClient, addressDB, address)
+			peer := strings.SplitN(strings.TrimSuffix(readText, "\n"), "@", 2)
+			pubKey, err := hex.DecodeString(peer[0])
+			if err != nil || len(pubKey) != 33 || len(peer) != 2 {
+				fmt.Println("Invalid peer '" + strings.Join(peer, "@") + "'")
+				continue
+			}
+			var peerPubKey [33]byte
+			copy(peerPubKey[:], pubKey)
+			if err = ldrlib.ConnectToPeer(lnClient, addressDB, peerPubKey, peer[1]); err != nil {
+				log.Println(err)
+			}
 		case 4:
 		case 5:
 			fmt.Println("Printing routing table")
@@ -299,14 +731,96 @@ func optionMenu(lnClient *lndwrapper.Lnd, addressDB *ldrlib.DB) {
 				pubKeyArray := addressDB.GetAddressNode(address)
 				fmt.Println(ldrlib.PubKeyArrayToString(pubKeyArray))
 			}
+		case 7:
+			fmt.Println("Printing pending address registrations")
+			pendingRegistrations, err := addressDB.PendingRegistrations(btcClient, lnClient)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for n, registration := range pendingRegistrations {
+				fmt.Println("Registration #:", n)
+				fmt.Println("Address:", net.IP(registration.Address[:]).String())
+				fmt.Println("Node:", ldrlib.PubKeyArrayToString(registration.NodePubKey))
+				fmt.Println("Height:", registration.Height)
+				fmt.Println("Confirmations:", registration.Confirmations)
+			}
+		case 8:
+			bumpRegistrationFeeMenu(btcClient, lnClient, addressDB)
+		case 9:
+			vppn := getVPPNFromUser(addressDB)
+			fmt.Println("Receiver's private address:")
+			address := getValidAddressFromUser()
+			route, err := vppn.GetRoute(lnClient, addressDB, address)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ldrlib.PrintRoute(route)
+		case 10:
+			vppn := getVPPNFromUser(addressDB)
+			fmt.Println("Printing", vppn.Name, "routing table")
+			vppn.PrintRoutingTable()
 		case 0:
-			addressDB.SaveRoutingDBToFile()
+			addressDB.Close()
 			os.Exit(0)
 		}
 	}
 }
 
-func unlockWalletMenu(btcClient *bitcoindwrapper.Bitcoind) {
+//bumpRegistrationFeeMenu raises the fee of a pending registration of the local node
+func bumpRegistrationFeeMenu(btcClient ldrlib.ChainBackend, lnClient ldrlib.LightningBackend, addressDB *ldrlib.DB) {
+
+	pendingRegistrations, err := addressDB.TrackedRegistrations(btcClient, lnClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(pendingRegistrations) == 0 {
+		fmt.Println("There are no pending registrations")
+		return
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for _, pending := range pendingRegistrations {
+		fmt.Println(net.IP(pending.Address[:]).String(), "registration pending,", pending.Confirmations, "confirmations. Tx Hash:", pending.TxID)
+		if pending.Confirmations > 0 {
+			continue
+		}
+
+		fmt.Println("Bump with 'rbf' (replace the registration) or 'cpfp' (spend its change), empty to skip:")
+		readText, _ := reader.ReadString('\n')
+		var method ldrlib.FeeBumpMethod
+		switch strings.TrimSuffix(readText, "\n") {
+		case "rbf":
+			method = ldrlib.ReplaceByFee
+		case "cpfp":
+			method = ldrlib.ChildPaysForParent
+		case "":
+			continue
+		default:
+			fmt.Println("Invalid method")
+			continue
+		}
+
+		fmt.Println("New fee rate in sat/vB, empty to use the estimate for the next blocks:")
+		readText, _ = reader.ReadString('\n')
+		var feeRate uint64
+		if feeRateString := strings.TrimSuffix(readText, "\n"); feeRateString != "" {
+			feeRate, err = strconv.ParseUint(feeRateString, 10, 64)
+			if err != nil {
+				fmt.Println("Invalid fee rate")
+				continue
+			}
+		}
+
+		hash, err := addressDB.BumpRegistrationFee(btcClient, pending.Address, method, btcutil.Amount(feeRate))
+		if err != nil {
+			fmt.Println("Couldn't bump the fee:", err)
+			continue
+		}
+		fmt.Println("Bumped the fee. Tx Hash:", hash)
+	}
+}
+
+func unlockWalletMenu(btcClient ldrlib.ChainBackend) {
 	for {
 		fmt.Println("Bitcoin wallet passphrase: (unlocking bitcoin client is necessary in order to register a new lightning address)")
 
@@ -324,12 +838,12 @@ func unlockWalletMenu(btcClient *bitcoindwrapper.Bitcoind) {
 }
 
 func setupSigTermHandler(db *ldrlib.DB) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		fmt.Println("\r- Ctrl+C pressed in Terminal")
-		db.SaveRoutingDBToFile()
+		db.Close()
 		os.Exit(0)
 	}()
 }
@@ -34,6 +34,21 @@ func (n *node) createRightChild() *node {
 	return n.right
 }
 
+//Remove the left child and its descendents
+func (n *node) removeLeftChild() {
+	n.left = nil
+}
+
+//Remove the right child and its descendents
+func (n *node) removeRightChild() {
+	n.right = nil
+}
+
+//Check if the node has no children and holds no data
+func (n *node) isEmpty() bool {
+	return n.left == nil && n.right == nil && n.data == nil
+}
+
 //REturn the data of the node
 func (n *node) getData() interface{} {
 	return n.data
@@ -0,0 +1,248 @@
+package ldrlib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+//newTestDataPath creates a temporary data directory removed at the end of the test
+func newTestDataPath(t *testing.T) string {
+	dataPath, err := ioutil.TempDir("", "ldrlib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dataPath) })
+	return dataPath
+}
+
+//fundTestWallet gives the wallet of chain an unspent output worth amount BTC failing the test on error
+func fundTestWallet(t *testing.T, chain *chainfake.Chain, amount float64) {
+	walletAddress, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), RegTest.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = chain.AddUTXO(walletAddress, amount); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateAddressDB(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	chain := chainfake.New()
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	registrationTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.MineEmpty(3)
+	chain.Mine(registrationTx)
+	chain.MineEmpty(2)
+
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(1)
+	db.UpdateAddressDB(chain, alice)
+
+	if db.getBlockHeight() != 6 {
+		t.Errorf("UpdateAddressDB wants height %v and got %v", 6, db.getBlockHeight())
+	}
+	address, registered := db.GetNodeAddress(alice.PubKey())
+	if !registered || address != aliceAddress {
+		t.Fatalf("UpdateAddressDB didn't register %v for alice", aliceAddress)
+	}
+
+	//The address must survive a restart
+	db.Close()
+	db = ReadDBFromDisk(db.filePath, RegTest, alice)
+	if !db.IsAddressRegistered(aliceAddress) || db.getBlockHeight() != 6 {
+		t.Errorf("address DB wasn't persisted")
+	}
+}
+
+func TestBroadcastNewAddressTx(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	chain := chainfake.New()
+	fundTestWallet(t, chain, 0.001)
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	if _, err := BroadcastNewAddressTx(chain, alice, DefaultChangeAddressType, aliceAddress); err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine()
+
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(1)
+	db.UpdateAddressDB(chain, alice)
+
+	if address, registered := db.GetNodeAddress(alice.PubKey()); !registered || address != aliceAddress {
+		t.Errorf("broadcasted registration for %v wasn't found by the scanner", aliceAddress)
+	}
+}
+
+func TestUpdateAddressDBReorg(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	chain := chainfake.New()
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	bobAddress := [4]byte{10, 0, 0, 2}
+	aliceTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobTx, err := chainfake.RegistrationTx(0, bobAddress, SignMessage(bob, bobAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Alice registers at height 3 and the DB scans up to height 5
+	chain.MineEmpty(2)
+	chain.Mine(aliceTx)
+	chain.MineEmpty(2)
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(1)
+	db.UpdateAddressDB(chain, alice)
+	if !db.IsNodeRegistered(alice.PubKey()) {
+		t.Fatal("alice's registration wasn't found")
+	}
+
+	//A longer branch without alice's registration replaces blocks 3 to 5
+	chain.Reorg(3)
+	chain.MineEmpty(1)
+	chain.Mine(bobTx)
+	chain.MineEmpty(2)
+	db.UpdateAddressDB(chain, alice)
+
+	if db.IsNodeRegistered(alice.PubKey()) || db.IsAddressRegistered(aliceAddress) {
+		t.Errorf("alice's orphaned registration is still in the DB")
+	}
+	if address, registered := db.GetNodeAddress(bob.PubKey()); !registered || address != bobAddress {
+		t.Errorf("bob's registration in the new branch wasn't found")
+	}
+	if db.getBlockHeight() != 6 {
+		t.Errorf("UpdateAddressDB wants height %v and got %v", 6, db.getBlockHeight())
+	}
+
+	//The rollback must be persisted
+	db.Close()
+	db = ReadDBFromDisk(db.filePath, RegTest, alice)
+	if db.IsAddressRegistered(aliceAddress) || !db.IsAddressRegistered(bobAddress) {
+		t.Errorf("rolled back address DB wasn't persisted")
+	}
+	hash, _ := chain.GetBlockHash(6)
+	if storedHash, ok := db.getBlockHash(6); !ok || storedHash.String() != hash {
+		t.Errorf("block hashes weren't persisted")
+	}
+}
+
+func TestConfirmationDepth(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	chain := chainfake.New()
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	aliceTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(3)
+
+	//With two confirmations the registration is only pending
+	chain.MineEmpty(4)
+	chain.Mine(aliceTx)
+	chain.MineEmpty(1)
+	db.UpdateAddressDB(chain, alice)
+
+	if db.IsAddressRegistered(aliceAddress) {
+		t.Fatal("registration was accepted without enough confirmations")
+	}
+	pending, err := db.PendingRegistrations(chain, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Address != aliceAddress ||
+		pending[0].NodePubKey != alice.PubKey() || pending[0].Confirmations != 2 {
+		t.Fatalf("PendingRegistrations wants alice's registration with 2 confirmations and got %v", pending)
+	}
+
+	//The third confirmation gets it accepted
+	chain.MineEmpty(1)
+	db.UpdateAddressDB(chain, alice)
+
+	if !db.IsAddressRegistered(aliceAddress) {
+		t.Fatal("registration wasn't accepted with enough confirmations")
+	}
+	pending, err = db.PendingRegistrations(chain, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("PendingRegistrations wants no registrations and got %v", pending)
+	}
+}
+
+func TestBroadcastNewAddressTxWithLnd(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		balance int64
+		wallet  bool
+		valid   bool
+	}{
+		{"funded wallet", 100000, true, true},
+		{"insufficient funds", 200, true, false},
+		{"no wallet", 0, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			graph := lndfake.NewGraph()
+			alice := newTestNode(t, graph, "alice")
+			chain := chainfake.New()
+			if test.wallet {
+				alice.SetWallet(test.balance, chain)
+			}
+
+			aliceAddress := [4]byte{10, 0, 0, 1}
+			registration, err := BroadcastNewAddressTxWithLnd(alice, aliceAddress)
+			if (err == nil) != test.valid {
+				t.Fatalf("BroadcastNewAddressTxWithLnd wants valid %v and got %v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+			if mempool := chain.Mempool(); len(mempool) != 1 || mempool[0].TxHash().String() != registration.TxHash() {
+				t.Fatalf("BroadcastNewAddressTxWithLnd didn't publish %v", registration.TxHash())
+			}
+			chain.Mine()
+
+			db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+			defer db.Close()
+			db.SetConfirmationDepth(1)
+			db.UpdateAddressDB(chain, alice)
+
+			if address, registered := db.GetNodeAddress(alice.PubKey()); !registered || address != aliceAddress {
+				t.Errorf("registration funded by lnd for %v wasn't found by the scanner", aliceAddress)
+			}
+		})
+	}
+}
@@ -3,24 +3,27 @@ package ldrlib
 import (
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
-	"path"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/jsmvalente/ldRouting/bitcoindwrapper"
-	"github.com/jsmvalente/ldRouting/lndwrapper"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
 	addressInfoSerializedSize  int    = 81
+	prefixInfoSerializedSize   int    = 82
 	routingEntrySerializedSize int    = 24
 	blockHeightSerializedSize  int    = 8
+	registrationTxHeaderSize   int    = 25
 	genesisBlock               uint64 = 0
+	//DefaultConfirmationDepth is the number of confirmations a registration needs to be accepted
+	DefaultConfirmationDepth uint64 = 6
 	addressDBFileName          string = "address.db"
 	routingDBFileName          string = "routing.db"
 )
@@ -31,6 +34,8 @@ const (
 //registrationHeight: the height of the block where the address was registered
 // registrationTxID: the tx id (hash of the transaction) where the address was registered
 //version: version of the protocol in which this block was registered
+//prefixLen: the length of the registered prefix, 0 when a single address is registered.
+//The address of a prefix is its network address, no two registrations share one
 //routingEntries: the routing entries associated with this address, the destionation field
 //of the routing entries should be equal to address
 type addressInfo struct {
@@ -39,10 +44,19 @@ type addressInfo struct {
 	registrationHeight uint64
 	registrationTxID   [32]byte
 	version            uint32
+	prefixLen          uint8
 	routingEntry       *routingEntry
 	peerConn           *connInfo
 }
 
+//prefixLength returns the number of leading bits of the address covered by the registration
+func (info *addressInfo) prefixLength() int {
+	if info.prefixLen == 0 {
+		return 32
+	}
+	return int(info.prefixLen)
+}
+
 //routingEntry holds a routing entry that is to be associated with an address destination and stored locally
 //destination: the destination node's address
 //hop: the next hop's address
@@ -64,6 +78,37 @@ type DB struct {
 	routingEntriesStack *routingStack
 	localAddress        [4]byte
 	destConns           map[string]*connInfo
+	//destMutex guards destConns, written by the goroutine of every accepted connection
+	destMutex sync.Mutex
+	blockHashes         map[uint64]chainhash.Hash
+	confirmationDepth   uint64
+	activationHeight    uint64
+	network             *Network
+	store               *bolt.DB
+	vppns               map[[vppnIDSize]byte]*VPPN
+	//handshakeFailures is written by the goroutine of every accepted connection
+	handshakeFailures map[string]*handshakeFailures
+	failuresMutex     sync.Mutex
+}
+
+//handshakeFailures records the failed handshakes with a remote host since its last successful one
+//count: the number of failed handshakes
+//last: when the last one failed
+//err: why the last one failed
+type handshakeFailures struct {
+	count int
+	last  time.Time
+	err   error
+}
+
+//PendingRegistration is an address registration found in a block that is not yet buried
+//under enough confirmations to be added to the DB
+type PendingRegistration struct {
+	Address       [4]byte
+	NodePubKey    [33]byte
+	TxID          [32]byte
+	Height        uint64
+	Confirmations uint64
 }
 
 func createDB(dbPath string) *DB {
@@ -71,132 +116,64 @@ func createDB(dbPath string) *DB {
 	var binaryTree = createBinaryTree()
 	var stringByteMap = make(map[[33]byte]*node)
 	var destConnMap = make(map[string]*connInfo)
+	var blockHashMap = make(map[uint64]chainhash.Hash)
 
 	db := DB{filePath: dbPath, height: genesisBlock,
 		addressTreeHead: binaryTree, keyToAddressMap: stringByteMap,
-		routingEntriesStack: createRoutingStack(), destConns: destConnMap}
+		routingEntriesStack: createRoutingStack(), destConns: destConnMap,
+		blockHashes: blockHashMap, confirmationDepth: DefaultConfirmationDepth,
+		vppns: make(map[[vppnIDSize]byte]*VPPN), handshakeFailures: make(map[string]*handshakeFailures)}
 
 	return &db
 }
 
-//ReadDBFromDisk reads the address database file and stores it in memory returning the DB
-//Address Database follows the following rules:
-//<blockHeight> (8 bytes)
-// n * <addressInfo> n * (81 bytes)
+//ReadDBFromDisk opens the DB store in dataPath and loads it into memory, importing the flat
+//files written by older clients. The store has to be closed with Close
+//Address records follow the following rules:
 //<addressInfo>:
 //<address> (4 bytes) + <nodePubKey> (33 bytes) + 8 (registrationHeight) +  32 (registrationTxID) + 4 (version)
-//Routing Database follows the following rules:
-//m * <routingEntry>
+//Routing entries follow the following rules:
 //<routingEntry>:
 //<destination> (4 bytes) + <hop> (4 bytes) + <capacity>  (8 bytes) + <height>  (8 bytes)
-func ReadDBFromDisk(dataPath string, lnClient *lndwrapper.Lnd) *DB {
-
-	//Create the local database
-	var addressInfoBytes = make([]byte, addressInfoSerializedSize)
-	var addressInfo *addressInfo
-	var blockHeightBytes = make([]byte, blockHeightSerializedSize)
-	var blockHeight uint64
-	var routingEntryBytes = make([]byte, routingEntrySerializedSize)
-	var routingEntry *routingEntry
-	var addressDBPath = path.Join(dataPath, addressDBFileName)
-	var routingDBPath = path.Join(dataPath, routingDBFileName)
+//The DB must have been built from network
+func ReadDBFromDisk(dataPath string, network *Network, lnClient LightningBackend) *DB {
+
 	var db = createDB(dataPath)
 
 	// Create the path where the data is to be stored (if it doesnt exist)
 	os.MkdirAll(dataPath, 0755)
 
-	//Open the address database file
-	log.Println("Opening Address DB file.")
-	addressfp, err := os.OpenFile(addressDBPath, os.O_CREATE|os.O_RDONLY, 0755)
+	log.Println("Opening DB store.")
+	store, err := openStore(dataPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer addressfp.Close()
+	db.store = store
 
-	fileStat, err := addressfp.Stat()
+	//Move the flat files used by older clients into the store
+	err = db.importLegacyFiles()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	//If the file is empty we write the genesis routing block into it to kickstart the address DB
-	if fileStat.Size() == 0 {
-		log.Println("Found empty address DB")
-
-		db.updateBlockHeight(genesisBlock)
-	} else {
-		// Read the last synced block of the database
-		log.Println("Reading DB block height")
-		n, err := addressfp.Read(blockHeightBytes)
-		log.Println("Read", n, "bytes from address DB file.")
-		//File is empty
-		if err == io.EOF {
-			log.Println("Reached end of file")
-			return db
-		}
-		if err != nil {
-			log.Fatal("Read failed:", err)
-		}
-
-		log.Println("Updating block height")
-		blockHeight = deserializeBlockHeight(blockHeightBytes)
-		db.updateBlockHeight(blockHeight)
-
-		for {
-			// Read an address and its associated data
-			log.Println("Reading new address")
-			n, err := addressfp.Read(addressInfoBytes)
-			log.Println("Read", n, "bytes from address DB file.")
-			//Reached end of file
-			if err == io.EOF {
-				log.Println("Reached end of file")
-				break
-			}
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			//Add address to dheadatabase
-			addressInfo = deserializeAddressInfo(addressInfoBytes)
-			db.addAddressToDB(addressInfo)
-		}
-	}
-
-	//Open the routing database file
-	log.Println("Opening Routing DB file.")
-	routingfp, err := os.OpenFile(routingDBPath, os.O_CREATE|os.O_RDONLY, 0755)
+	//Upgrade stores written by older clients
+	err = db.migrateStore()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer routingfp.Close()
 
-	fileStat, err = routingfp.Stat()
+	//Never mix addresses registered in different networks
+	err = db.checkNetwork(network)
 	if err != nil {
 		log.Fatal(err)
 	}
+	db.network = network
+	db.SetActivationHeight(network.ActivationHeight)
 
-	//If the file is empty we add our own peers (direct destinations)
-	if fileStat.Size() == 0 {
-		log.Println("Found empty routing DB")
-	} else {
-		//Otherwise we Read every routing entry for every address
-		for {
-			// Read a routing entry
-			log.Println("Reading new routing entry")
-			n, err := routingfp.Read(routingEntryBytes)
-			log.Println("Read", n, "bytes from routing DB file.")
-			//Reached end of file
-			if err == io.EOF {
-				log.Println("Reached end of file")
-				break
-			}
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			//Add routing entry to the DB
-			routingEntry = deserializeRoutingEntry(routingEntryBytes)
-			db.addRoutingEntryToDB(routingEntry)
-		}
+	log.Println("Loading DB into memory.")
+	err = db.loadStore()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	return db
@@ -216,32 +193,6 @@ func (db *DB) getLocalAddress() [4]byte {
 	return db.localAddress
 }
 
-//updateBlockHeight updates the block height by updating memory and disk
-func (db *DB) updateBlockHeight(blockHeight uint64) {
-
-	var addressDBPath = path.Join(db.filePath, addressDBFileName)
-
-	//Update memory
-	db.height = blockHeight
-	blockHeightBytes := serializeBlockHeight(blockHeight)
-
-	//Store the blockHeight in disk
-	// It will be created if it doesn't exist and close at the end of the function
-	fp, err := os.OpenFile(addressDBPath, os.O_WRONLY, 0600)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer fp.Close()
-
-	n, err := fp.Write(blockHeightBytes)
-	log.Println("Wrote", n, "bytes to DB file.")
-	if err != nil {
-		log.Fatalln("Write failed:", err)
-	}
-
-	log.Println("DB Block Height updated to " + strconv.FormatUint(blockHeight, 10))
-}
-
 //GetNodeAddress retruns the routing address of the node associated with
 //the lightning pubkey id
 func (db *DB) GetNodeAddress(pubkey [33]byte) ([4]byte, bool) {
@@ -258,6 +209,20 @@ func (db *DB) GetNodeAddress(pubkey [33]byte) ([4]byte, bool) {
 
 //GetAddressNode returns the public key associated with a certain LDR address
 func (db *DB) GetAddressNode(address [4]byte) [33]byte {
+
+	info := db.getAddressInfo(address)
+	if info == nil {
+		return [33]byte{}
+	}
+
+	return info.nodePubKey
+}
+
+//pathInfos returns the address infos stored along the path of address in the tree,
+//from the shortest prefix covering it down to the address itself
+func (db *DB) pathInfos(address [4]byte) []*addressInfo {
+
+	var infos []*addressInfo
 	// Get the head of the binaryTree
 	var head = db.addressTreeHead
 	//Get the address so we know the path in the binaryTree
@@ -266,18 +231,42 @@ func (db *DB) GetAddressNode(address [4]byte) [33]byte {
 	for i := 0; i < len(bitAddress); i++ {
 		if bitAddress[i] {
 			head = head.rightChild()
-			if head == nil {
-				return [33]byte{}
-			}
 		} else {
 			head = head.leftChild()
-			if head == nil {
-				return [33]byte{}
-			}
+		}
+		if head == nil {
+			break
+		}
+		if info, ok := head.getData().(*addressInfo); ok {
+			infos = append(infos, info)
+		}
+	}
+
+	return infos
+}
+
+//getAddressInfo returns the info of the address or prefix registered with address, nil if there is none
+func (db *DB) getAddressInfo(address [4]byte) *addressInfo {
+
+	for _, info := range db.pathInfos(address) {
+		if info.address == address {
+			return info
 		}
 	}
 
-	return (head.getData().(*addressInfo)).nodePubKey
+	return nil
+}
+
+//resolveAddress returns the most specific registration covering address, either the address itself or the
+//longest registered prefix it belongs to, nil if there is none
+func (db *DB) resolveAddress(address [4]byte) *addressInfo {
+
+	infos := db.pathInfos(address)
+	if len(infos) == 0 {
+		return nil
+	}
+
+	return infos[len(infos)-1]
 }
 
 //IsNodeRegistered checks if the node idenfied by pubkey is registered
@@ -293,26 +282,11 @@ func (db *DB) IsNodeRegistered(pubkey [33]byte) bool {
 	return false
 }
 
-//IsAddressRegistered checks if an address is registered
+//IsAddressRegistered checks if an address is registered, either by itself or as the network address of a prefix
 func (db *DB) IsAddressRegistered(address [4]byte) bool {
 
-	// Get the head of the binaryTree
-	var head = db.addressTreeHead
-	//Get the address so we know the path in the binaryTree
-	var bitAddress = byteToBit(address)
-
-	for i := 0; i < len(bitAddress); i++ {
-		if bitAddress[i] {
-			head = head.rightChild()
-			if head == nil {
-				return false
-			}
-		} else {
-			head = head.leftChild()
-			if head == nil {
-				return false
-			}
-		}
+	if db.getAddressInfo(address) == nil {
+		return false
 	}
 
 	log.Println("Address", address, "is registered in the DB.")
@@ -335,10 +309,16 @@ func (db *DB) SuggestAddress(seedAddress [4]byte) ([4]byte, error) {
 	return [4]byte{}, errors.New("Can't suggest address for " + net.IP(seedAddress[:]).String())
 }
 
+//isOccupied returns true if every address under head is taken, either because head holds an address
+//or a prefix covering the addresses registered below it
+func isOccupied(head *node) bool {
+	return head.getData() != nil || head.isEmpty()
+}
+
 func closestFreeAddress(head *node, bitSeedAddress [32]bool, positionIndex int) (bool, [4]byte) {
 
-	//We are at the leave
-	if head.leftChild() == nil && head.rightChild() == nil {
+	//We are at the leave or inside a prefix
+	if isOccupied(head) {
 		return false, [4]byte{}
 	}
 
@@ -364,8 +344,8 @@ func closestFreeAddress(head *node, bitSeedAddress [32]bool, positionIndex int)
 
 func bottomSearch(head *node, bitSeedAddress [32]bool, pathPosition int) (bool, [4]byte) {
 
-	//Can't do bottom search on leaf nodes
-	if head.leftChild() == nil && head.rightChild() == nil {
+	//Can't do bottom search on leaf nodes or prefixes
+	if isOccupied(head) {
 		return false, [4]byte{}
 	}
 
@@ -415,8 +395,8 @@ func leftToRightDFS(head *node, bitNeighbourAddress [32]bool, pathPosition int)
 		return true, rightPadBitAddress(bitNeighbourAddress, pathPosition, false)
 	}
 
-	//Got to the leaf
-	if head.leftChild() == nil && head.rightChild() == nil {
+	//Got to the leaf or a prefix
+	if isOccupied(head) {
 		return false, [32]bool{}
 	}
 
@@ -444,8 +424,8 @@ func rightToLeftDFS(head *node, bitNeighbourAddress [32]bool, pathPosition int)
 		return true, rightPadBitAddress(bitNeighbourAddress, pathPosition, false)
 	}
 
-	//Got to the leaf
-	if head.leftChild() == nil && head.rightChild() == nil {
+	//Got to the leaf or a prefix
+	if isOccupied(head) {
 		return false, [32]bool{}
 	}
 
@@ -474,7 +454,8 @@ func (db *DB) addAddressToDB(info *addressInfo) {
 	//Get the address so we know the path in the binaryTree
 	var bitAddress = byteToBit(info.address)
 
-	for i := 0; i < len(bitAddress); i++ {
+	//Prefixes are stored in the inner node their bits lead to
+	for i := 0; i < info.prefixLength(); i++ {
 		if bitAddress[i] {
 			descendent = head.rightChild()
 			//Create the right child if it doesn't exist
@@ -500,69 +481,84 @@ func (db *DB) addAddressToDB(info *addressInfo) {
 	//NodePubKey is a key to the map where we store pointers to the head where we previously stored the info
 	db.keyToAddressMap[info.nodePubKey] = head
 
-	log.Println("Address " + net.IP(info.address[:]).String() + " loaded to DB")
+	log.Println("Address " + formatAddress(info) + " loaded to DB")
 }
 
-//saveAddressToFile adds a new address to database file
-func (db *DB) saveAddressToFile(info *addressInfo) {
+//removes the address from memory pruning the branch of the tree that only led to it
+//together with the routing entries to or through it
+func (db *DB) removeAddressFromDB(info *addressInfo) {
 
-	var addressDBPath = path.Join(db.filePath, addressDBFileName)
+	// Get the head of the binaryTree
+	var head = db.addressTreeHead
+	var parents [32]*node
+	//Get the address so we know the path in the binaryTree
+	var bitAddress = byteToBit(info.address)
+	var prefixLength = info.prefixLength()
 
-	//Store the addresss in disk
-	fp, err := os.OpenFile(addressDBPath, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
+	for i := 0; i < prefixLength; i++ {
+		parents[i] = head
+		if bitAddress[i] {
+			head = head.rightChild()
+		} else {
+			head = head.leftChild()
+		}
+		if head == nil {
+			return
+		}
 	}
-	defer fp.Close()
 
-	//SErialization of the address info
-	addressInfoBytes := serializeAddressInfo(info)
+	//Remove the routing entries that depend on the address
+	for _, entry := range db.routingEntriesStack.peekFromBlock(genesisBlock) {
+		if entry.destination == info.address || entry.nextHop == info.address {
+			db.removeRoutingEntryFromDB(entry)
+		}
+	}
 
-	//Write serialization to the file
-	n, err := fp.Write(addressInfoBytes)
-	log.Println("Appended", n, "bytes to DB file.")
-	if err != nil {
-		log.Fatalln("Write failed:", err)
+	head.saveData(nil)
+	delete(db.keyToAddressMap, info.nodePubKey)
+
+	//Walk back up removing the nodes left without children, the addresses registered inside a prefix keep it
+	for i := prefixLength - 1; i >= 0 && head.isEmpty(); i-- {
+		if bitAddress[i] {
+			parents[i].removeRightChild()
+		} else {
+			parents[i].removeLeftChild()
+		}
+		head = parents[i]
 	}
 
-	log.Println("Address " + net.IP(info.address[:]).String() + " added to DB")
+	log.Println("Address " + formatAddress(info) + " removed from DB")
 }
 
+//getRoutingEntry returns the routing entry to the address or prefix registered with destination
 func (db *DB) getRoutingEntry(destination [4]byte) *routingEntry {
 
-	// Get the head of the binaryTree
-	var head = db.addressTreeHead
-	//Get the address so we know the path in the binaryTree
-	var bitAddress = byteToBit(destination)
+	info := db.getAddressInfo(destination)
+	if info == nil {
+		return nil
+	}
 
-	for i := 0; i < len(bitAddress); i++ {
-		if bitAddress[i] {
-			head = head.rightChild()
-		} else {
-			head = head.leftChild()
+	return info.routingEntry
+}
+
+//lookupRoutingEntry returns the routing entry of the longest registered prefix or address matching destination
+//that we know a route to, nil if there is none
+func (db *DB) lookupRoutingEntry(destination [4]byte) *routingEntry {
+
+	infos := db.pathInfos(destination)
+	for i := len(infos) - 1; i >= 0; i-- {
+		if infos[i].routingEntry != nil {
+			return infos[i].routingEntry
 		}
 	}
 
-	return (head.getData().(*addressInfo)).routingEntry
+	return nil
 }
 
 //loads a routing entry into the DB, replacing the existing one, if it exists
 func (db *DB) addRoutingEntryToDB(entry *routingEntry) {
 
-	// Get the head of the binaryTree
-	var head = db.addressTreeHead
-	//Get the address so we know the path in the binaryTree
-	var bitAddress = byteToBit(entry.destination)
-
-	for i := 0; i < len(bitAddress); i++ {
-		if bitAddress[i] {
-			head = head.rightChild()
-		} else {
-			head = head.leftChild()
-		}
-	}
-
-	addressInfo := (head.getData().(*addressInfo))
+	addressInfo := db.getAddressInfo(entry.destination)
 	currentEntry := addressInfo.routingEntry
 	//If there's already a routing entry for this destination we need to delete it from the stack
 	if currentEntry != nil {
@@ -579,59 +575,137 @@ func (db *DB) addRoutingEntryToDB(entry *routingEntry) {
 	log.Println("Added routing entry to DB:", entry)
 }
 
-func (db *DB) getPeerConn(destination [4]byte) *connInfo {
-
-	// Get the head of the binaryTree
-	var head = db.addressTreeHead
-	//Get the address so we know the path in the binaryTree
-	var bitAddress = byteToBit(destination)
+//removes a routing entry from the DB
+func (db *DB) removeRoutingEntryFromDB(entry *routingEntry) {
 
-	for i := 0; i < len(bitAddress); i++ {
-		if bitAddress[i] {
-			head = head.rightChild()
-		} else {
-			head = head.leftChild()
+	if addressInfo := db.getAddressInfo(entry.destination); addressInfo != nil {
+		if addressInfo.routingEntry == entry {
+			addressInfo.routingEntry = nil
 		}
 	}
 
-	return (head.getData().(*addressInfo)).peerConn
+	db.routingEntriesStack.remove(entry)
+
+	log.Println("Removed routing entry from DB:", entry)
+}
+
+func (db *DB) getPeerConn(destination [4]byte) *connInfo {
+
+	info := db.getAddressInfo(destination)
+	if info == nil {
+		return nil
+	}
+
+	return info.peerConn
 }
 
 //loads a peer connection into the DB, replacing the existing one, if it exists
 func (db *DB) addPeerConnToDB(address [4]byte, peerConn *connInfo) {
 
-	// Get the head of the binaryTree
-	var head = db.addressTreeHead
-	//Get the address so we know the path in the binaryTree
-	var bitAddress = byteToBit(address)
+	addressInfo := db.getAddressInfo(address)
 
-	for i := 0; i < len(bitAddress); i++ {
-		if bitAddress[i] {
-			head = head.rightChild()
-		} else {
-			head = head.leftChild()
+	//Add entry to the tree
+	addressInfo.peerConn = peerConn
+}
+
+//removes a peer connection from the DB, unless it was already replaced by a newer one
+func (db *DB) removePeerConnFromDB(address [4]byte, peerConn *connInfo) {
+
+	addressInfo := db.getAddressInfo(address)
+
+	if addressInfo != nil && addressInfo.peerConn == peerConn {
+		addressInfo.peerConn = nil
+	}
+}
+
+//records a failed handshake with host, forgetting the failures that expired so hosts that never succeed don't pile up
+func (db *DB) recordHandshakeFailure(host string, err error) {
+
+	db.failuresMutex.Lock()
+	defer db.failuresMutex.Unlock()
+
+	for failedHost, failures := range db.handshakeFailures {
+		if time.Since(failures.last) >= handshakeBanDuration {
+			delete(db.handshakeFailures, failedHost)
 		}
 	}
 
-	addressInfo := (head.getData().(*addressInfo))
+	failures, exists := db.handshakeFailures[host]
+	if !exists {
+		failures = &handshakeFailures{}
+		db.handshakeFailures[host] = failures
+	}
+	failures.count++
+	failures.last = time.Now()
+	failures.err = err
 
-	//Add entry to the tree
-	addressInfo.peerConn = peerConn
+	log.Println(err, "("+strconv.Itoa(failures.count), "failed handshakes with", host+")")
+}
+
+//forgets the failed handshakes with host after a successful one
+func (db *DB) clearHandshakeFailures(host string) {
+
+	db.failuresMutex.Lock()
+	defer db.failuresMutex.Unlock()
+
+	delete(db.handshakeFailures, host)
+}
+
+//handshakeBanned returns true if host failed too many handshakes recently to be accepted again
+func (db *DB) handshakeBanned(host string) bool {
+
+	db.failuresMutex.Lock()
+	defer db.failuresMutex.Unlock()
+
+	failures, exists := db.handshakeFailures[host]
+	if exists && time.Since(failures.last) >= handshakeBanDuration {
+		delete(db.handshakeFailures, host)
+		return false
+	}
+
+	return exists && failures.count >= maxHandshakeFailures
 }
 
 func (db *DB) getDestConn(token string) *connInfo {
 
+	db.destMutex.Lock()
+	defer db.destMutex.Unlock()
+
 	return db.destConns[token]
 }
 
-//loads a peer connection into the DB, replacing the existing one, if it exists
-func (db *DB) addDestConnToDB(token string, destConn *connInfo) {
+//loads a destination connection into the DB. Tokens already in use are refused, and so are new connections
+//once maxDestConns are waiting for their routes
+func (db *DB) addDestConnToDB(token string, destConn *connInfo) error {
+
+	db.destMutex.Lock()
+	defer db.destMutex.Unlock()
 
+	if _, exists := db.destConns[token]; exists {
+		return errors.New("Route token already in use")
+	}
+	if len(db.destConns) >= maxDestConns {
+		return errors.New("Too many connections waiting for routes")
+	}
 	db.destConns[token] = destConn
+
+	return nil
 }
 
-func (db *DB) removeDestConnFromDB(token string) {
+//removes the destination connection of token from the DB and returns it, unless it was replaced by another
+//one. A nil destConn removes whatever connection token has
+func (db *DB) removeDestConnFromDB(token string, destConn *connInfo) *connInfo {
+
+	db.destMutex.Lock()
+	defer db.destMutex.Unlock()
+
+	existing := db.destConns[token]
+	if existing == nil || (destConn != nil && existing != destConn) {
+		return nil
+	}
 	delete(db.destConns, token)
+
+	return existing
 }
 
 func (db *DB) getLastRoutingEntries(fromBlock uint64) []*routingEntry {
@@ -639,7 +713,7 @@ func (db *DB) getLastRoutingEntries(fromBlock uint64) []*routingEntry {
 }
 
 //Adds a new destination (shared by a peer) to the DB if it's better than the entry we have stored
-func (db *DB) addNewDestinationToDB(destination *destination, neighbourPubKey [33]byte, lnClient *lndwrapper.Lnd) {
+func (db *DB) addNewDestinationToDB(destination *destination, neighbourPubKey [33]byte, lnClient LightningBackend) {
 
 	//If we are trying to add information about ourselves, skip
 	if destination.address == db.getLocalAddress() {
@@ -666,12 +740,19 @@ func (db *DB) addNewDestinationToDB(destination *destination, neighbourPubKey [3
 		}
 	}
 
+	//Peers can know of registrations we haven't scanned yet
+	if !db.IsAddressRegistered(destination.address) {
+		log.Println("Ignoring destination", net.IP(destination.address[:]), "shared by", peerAddress, ": address isn't registered")
+		return
+	}
+
 	//Get the existing routing entry for this destination
 	entry := db.getRoutingEntry(destination.address)
 
 	//If there is no entry for this destination we just add a new one
 	if entry == nil {
 		db.addRoutingEntryToDB(newEntry)
+		db.storeRoutingEntry(newEntry)
 		return
 	}
 
@@ -685,132 +766,187 @@ func (db *DB) addNewDestinationToDB(destination *destination, neighbourPubKey [3
 
 	//Add the new ypdated routing entry, it will replace the old one
 	db.addRoutingEntryToDB(newEntry)
+	db.storeRoutingEntry(newEntry)
 }
 
-//SaveRoutingDBToFile writes the whole routing DB file.
-//To be used on client exit
-func (db *DB) SaveRoutingDBToFile() {
-
-	routingEntries := db.routingEntriesStack.peekFromBlock(genesisBlock)
-	var serializedRoutingEntry []byte
-	var entry *routingEntry
-	var routingDBPath = path.Join(db.filePath, routingDBFileName)
+//storeRoutingEntry persists a routing entry as soon as it changes
+func (db *DB) storeRoutingEntry(entry *routingEntry) {
 
-	//Open the routing database file
-	log.Println("Writing Routing DB file...")
-	fp, err := os.OpenFile(routingDBPath, os.O_CREATE|os.O_WRONLY, 0755)
+	err := db.saveRoutingEntry(entry)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Error storing routing entry:" + err.Error())
 	}
-	defer fp.Close()
+}
 
-	for _, entry = range routingEntries {
+//SetConfirmationDepth sets the number of confirmations a registration needs to be accepted
+func (db *DB) SetConfirmationDepth(confirmations uint64) {
+	if confirmations == 0 {
+		confirmations = 1
+	}
+	db.confirmationDepth = confirmations
+}
 
-		//Serialize routing entry
-		serializedRoutingEntry = serializeRoutingEntry(entry)
+//SetActivationHeight sets the height of the first block that can hold address registrations,
+//blocks below it are never scanned
+func (db *DB) SetActivationHeight(height uint64) {
+	db.activationHeight = height
+}
 
-		//Write serialization to the file
-		n, err := fp.Write(serializedRoutingEntry)
-		log.Println("Wrote", n, "bytes to routing DB file.")
-		if err != nil {
-			log.Fatalln("Write failed:", err)
-		}
+//firstUnscannedBlock returns the first block the address DB still has to scan
+func (db *DB) firstUnscannedBlock() uint64 {
+	if db.height < db.activationHeight {
+		return db.activationHeight
 	}
+	return db.height + 1
 }
 
-//UpdateAddressDB sincronizes the address database to the tip of the blockchain
-func (db *DB) UpdateAddressDB(bitcoinCLient *bitcoindwrapper.Bitcoind, lnClient *lndwrapper.Lnd) {
-
-	var lastScannedBlock = db.height
-	var newAddressRegistrationList []*addressRegistration
-	var newAddressInfo *addressInfo
-	var validAddress bool
-	var startingBlock = lastScannedBlock + 1
+//confirmedHeight returns the height of the last block buried under enough confirmations
+//for its registrations to be accepted, false if there is none
+func (db *DB) confirmedHeight(blockCount uint64) (uint64, bool) {
+	if blockCount+1 < db.confirmationDepth {
+		return 0, false
+	}
+	return blockCount + 1 - db.confirmationDepth, true
+}
 
-	log.Println("Starting DB update from block: " + strconv.FormatUint(lastScannedBlock, 10))
+//UpdateAddressDB sincronizes the address database with the blocks of the blockchain
+//that have enough confirmations. Every scanned batch of blocks is stored as it is handled
+//so an interrupted update resumes from the last stored batch
+func (db *DB) UpdateAddressDB(bitcoinCLient ChainBackend, lnClient LightningBackend) error {
 
 	//Get the number of blocks in the chain
 	blockCount, err := GetBlockCount(bitcoinCLient)
 	if err != nil {
-		log.Fatal("Error getting block count:" + err.Error())
+		return errors.New("Error getting block count:" + err.Error())
+	}
+
+	//Undo the registrations found in blocks that are no longer part of the best chain
+	err = db.handleReorg(bitcoinCLient, blockCount)
+	if err != nil {
+		return errors.New("Error checking for chain reorganizations:" + err.Error())
 	}
 
-	//If new blocks were found in the last 10 minutes we add the corresponding addresses to the DB
-	if blockCount > lastScannedBlock {
+	var startingBlock = db.firstUnscannedBlock()
+
+	log.Println("Starting DB update from block: " + strconv.FormatUint(startingBlock-1, 10))
+
+	//Only blocks buried under enough confirmations are scanned
+	confirmedHeight, confirmed := db.confirmedHeight(blockCount)
+
+	//If new confirmed blocks were found we add the corresponding addresses to the DB
+	if confirmed && confirmedHeight >= startingBlock {
+
+		//Getting new address registrations starting from the block after the one we last scanned
+		lastScannedHash, _ := db.getBlockHash(startingBlock - 1)
+		err = scanBlocks(bitcoinCLient, startingBlock, confirmedHeight, lastScannedHash, func(batch *scannedBatch) error {
 
-		//Getting new address registrations starting from the block after the one we last lastScanned
-		newAddressRegistrationList = getNewAddressRegistrations(bitcoinCLient, lnClient, startingBlock, blockCount)
+			var changes []*addressChange
 
-		//Add every new valid address to the OpenAddressesDB
-		for _, addressRegistration := range newAddressRegistrationList {
-			validAddress, newAddressInfo = db.verifyAddressRegistration(addressRegistration, lnClient)
-			if validAddress {
-				db.addAddressToDB(newAddressInfo)
-				db.saveAddressToFile(newAddressInfo)
+			//Apply every valid registration, revocation and transfer to the OpenAddressesDB in chain order
+			for _, addressRegistration := range batch.registrations {
+				change := db.verifyAddressMessage(addressRegistration, lnClient)
+				if change != nil {
+					db.applyAddressChange(change)
+					changes = append(changes, change)
+				}
+			}
+
+			//The address changes, block hashes and height are stored together so a crash can't split them
+			err := db.commitScannedBlocks(batch.fromBlock, batch.hashes, changes)
+			if err != nil {
+				//Take the changes back out of the memory, latest first, so the next update scans the batch again
+				for i := len(changes) - 1; i >= 0; i-- {
+					db.revertAddressChange(changes[i])
+				}
+				return errors.New("Error storing scanned blocks:" + err.Error())
 			}
+			return nil
+		})
+		//The batches handled before the error are kept, the next update resumes after them
+		if err != nil {
+			return err
 		}
 	}
 
-	//Update variables to reflect the update
-	db.updateBlockHeight(blockCount)
-	log.Println("Synced until block " + strconv.FormatUint(blockCount, 10))
+	log.Println("Synced until block " + strconv.FormatUint(db.getBlockHeight(), 10))
+
+	return nil
 }
 
-//SynchronizeAddressDB is to be used as a new go routine to keep updating the address db in the background
-func (db *DB) SynchronizeAddressDB(bitcoinCLient *bitcoindwrapper.Bitcoind, lnClient *lndwrapper.Lnd) {
-	//Start update routine to keep the database updated
-	var lastScannedBlock = db.height
-	var newAddressRegistrationList []*addressRegistration
-	var newAddressInfo *addressInfo
-	var validAddress bool
-	var startingBlock = lastScannedBlock + 1
-
-	//Wait for new blocks and update the address DB accordingly every 10 minutes
-	for {
-		//Try to find new addresses everry 10 minutes (average block time)
-		//Wait 10 minutes at the begging since this function is only called inside synchronizeDB
-		//which syncs the database in a synchronous way
-		time.Sleep(10 * time.Minute)
+//PendingRegistrations returns the registrations found in the blocks that don't have enough
+//confirmations to be added to the DB yet, along with their current depth
+func (db *DB) PendingRegistrations(bitcoinCLient ChainBackend, lnClient LightningBackend) ([]*PendingRegistration, error) {
 
-		log.Println("Starting DB update from block: " + strconv.FormatUint(lastScannedBlock, 10))
+	var pendingRegistrations []*PendingRegistration
 
-		//Get the number of blocks in the chain
-		blockCount, err := GetBlockCount(bitcoinCLient)
-		if err != nil {
-			log.Fatal("Error getting block count:" + err.Error())
+	blockCount, err := GetBlockCount(bitcoinCLient)
+	if err != nil {
+		return nil, err
+	}
+
+	//Every block after the last one accepted into the DB is still pending
+	startingBlock := db.firstUnscannedBlock()
+	if blockCount < startingBlock {
+		return nil, nil
+	}
+	lastScannedHash, _ := db.getBlockHash(startingBlock - 1)
+	registrations, _, err := getNewAddressRegistrations(bitcoinCLient, startingBlock, blockCount, lastScannedHash)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, registration := range registrations {
+
+		//Revocations and transfers don't register anything
+		if registration.msgType != registerMessage {
+			continue
 		}
 
-		//If new blocks were found in the last 10 minutes we add the corresponding addresses to the DB
-		if blockCount > lastScannedBlock {
+		//Recover the node registering the address, invalid signatures will never be accepted
+		validSig, nodePubKey := VerifyMessage(lnClient, registration.address[:], registration.sig[:])
+		if !validSig {
+			continue
+		}
 
-			//Getting new address registrations starting from the block after the one we last lastScanned
-			newAddressRegistrationList = getNewAddressRegistrations(bitcoinCLient, lnClient, startingBlock, blockCount)
+		pendingRegistrations = append(pendingRegistrations, &PendingRegistration{Address: registration.address,
+			NodePubKey: nodePubKey, TxID: registration.txID, Height: registration.blockHeight,
+			Confirmations: blockCount - registration.blockHeight + 1})
+	}
 
-			//Add every new valid address to the OpenAddressesDB
-			for _, addressRegistration := range newAddressRegistrationList {
+	return pendingRegistrations, nil
+}
 
-				validAddress, newAddressInfo = db.verifyAddressRegistration(addressRegistration, lnClient)
-				if validAddress {
-					db.addAddressToDB(newAddressInfo)
-					db.saveAddressToFile(newAddressInfo)
-				}
+//SynchronizeAddressDB is to be used as a new go routine to keep updating the address db in the background
+//The DB is updated every time blockNotifications delivers a new block and polls the chain every pollInterval
+//in case notifications are missed, logging the progress of the registrations broadcast by this client. A nil or closed blockNotifications channel leaves only the polling.
+func (db *DB) SynchronizeAddressDB(bitcoinCLient ChainBackend, lnClient LightningBackend, blockNotifications <-chan struct{}, pollInterval time.Duration) {
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	//Wait for new blocks and update the address DB accordingly
+	for {
+		select {
+		case _, ok := <-blockNotifications:
+			if !ok {
+				log.Println("Block notifications unavailable, polling for new blocks every", pollInterval)
+				blockNotifications = nil
+				continue
 			}
+		case <-ticker.C:
 		}
 
-		//Update variables to reflect the update
-		lastScannedBlock = blockCount
-		startingBlock = lastScannedBlock + 1
-		db.updateBlockHeight(lastScannedBlock)
-		log.Println("Synced until block " + strconv.FormatUint(lastScannedBlock, 10))
+		if err := db.UpdateAddressDB(bitcoinCLient, lnClient); err != nil {
+			log.Println("Error updating the address DB:", err)
+		}
+		db.logTrackedRegistrations(bitcoinCLient, lnClient)
 	}
 }
 
-//SynchronizeRoutingDB updates the routing DB according to changes in the local channel balances
-func (db *DB) SynchronizeRoutingDB(bitcoinCLient *bitcoindwrapper.Bitcoind, lnClient *lndwrapper.Lnd) {
+//SynchronizeRoutingDB updates the routing DB, and the routing DBs of the joined VPPNs, according to changes
+//in the local channel balances
+func (db *DB) SynchronizeRoutingDB(bitcoinCLient ChainBackend, lnClient LightningBackend) {
 
-	var registered bool
-	var neighbourPubKey [33]byte
-	var neighbourAddress [4]byte
 	var localChannels []*lnrpc.Channel
 
 	for {
@@ -818,43 +954,58 @@ func (db *DB) SynchronizeRoutingDB(bitcoinCLient *bitcoindwrapper.Bitcoind, lnCl
 		//Get the local channels
 		localChannels = GetLocalChannels(lnClient)
 
-		//Get all the routing entries
-		routingEntries := db.routingEntriesStack.peekFromBlock(genesisBlock)
+		db.updateChannelRoutes(localChannels, lnClient)
+		for _, vppn := range db.vppns {
+			vppn.db.updateChannelRoutes(localChannels, lnClient)
+		}
 
-		//Iterate thourgh all the active channels of this node
-		//Add routing entries for neighbours that are registered in the protocol
-		for _, localChannel := range localChannels {
+		//Update routing DB every minute
+		time.Sleep(time.Minute)
+	}
+}
 
-			neighbourPubKey = PubKeyStringToArray(localChannel.RemotePubkey)
-			neighbourAddress, registered = db.GetNodeAddress(neighbourPubKey)
+//updateChannelRoutes adds routing entries for the neighbours in the DB and limits the entries going through them
+//to the local balance of the channel we share
+func (db *DB) updateChannelRoutes(localChannels []*lnrpc.Channel, lnClient LightningBackend) {
 
-			//IF the channel is not registered we an skip it
-			if !registered {
-				continue
-			}
+	var registered bool
+	var neighbourPubKey [33]byte
+	var neighbourAddress [4]byte
 
-			//Update routing entries whose next hop is the other end of this channel
-			for n, routingEntry := range routingEntries {
-				if routingEntry.nextHop == neighbourAddress && routingEntry.capacity > localChannel.LocalBalance {
-					fmt.Println("Updated Entry #:", n)
-					fmt.Println("Destination:", net.IP(routingEntry.destination[:]).String())
-					fmt.Println("Next Hop:", net.IP(routingEntry.nextHop[:]).String())
-					fmt.Println("Old Capacity:", routingEntry.capacity)
-					fmt.Println("New Capacity:", localChannel.LocalBalance)
-					routingEntry.capacity = localChannel.LocalBalance
-				}
-			}
+	//Get all the routing entries
+	routingEntries := db.routingEntriesStack.peekFromBlock(genesisBlock)
+
+	//Iterate thourgh all the active channels of this node
+	//Add routing entries for neighbours that are registered in the protocol
+	for _, localChannel := range localChannels {
+
+		neighbourPubKey = PubKeyStringToArray(localChannel.RemotePubkey)
+		neighbourAddress, registered = db.GetNodeAddress(neighbourPubKey)
 
-			//Add destination to DB
-			db.addNewDestinationToDB(&destination{address: neighbourAddress, capacity: localChannel.LocalBalance}, neighbourPubKey, lnClient)
+		//IF the channel is not registered we an skip it
+		if !registered {
+			continue
 		}
 
-		//Update routing DB every minute
-		time.Sleep(time.Minute)
+		//Update routing entries whose next hop is the other end of this channel
+		for n, routingEntry := range routingEntries {
+			if routingEntry.nextHop == neighbourAddress && routingEntry.capacity > localChannel.LocalBalance {
+				fmt.Println("Updated Entry #:", n)
+				fmt.Println("Destination:", net.IP(routingEntry.destination[:]).String())
+				fmt.Println("Next Hop:", net.IP(routingEntry.nextHop[:]).String())
+				fmt.Println("Old Capacity:", routingEntry.capacity)
+				fmt.Println("New Capacity:", localChannel.LocalBalance)
+				routingEntry.capacity = localChannel.LocalBalance
+				db.storeRoutingEntry(routingEntry)
+			}
+		}
+
+		//Add destination to DB
+		db.addNewDestinationToDB(&destination{address: neighbourAddress, capacity: localChannel.LocalBalance}, neighbourPubKey, lnClient)
 	}
 }
 
-func (db *DB) verifyAddressRegistration(registration *addressRegistration, lnClient *lndwrapper.Lnd) (bool, *addressInfo) {
+func (db *DB) verifyAddressRegistration(registration *addressRegistration, lnClient LightningBackend) (bool, *addressInfo) {
 
 	sig := registration.sig[:]
 	newAddress := registration.address
@@ -876,6 +1027,12 @@ func (db *DB) verifyAddressRegistration(registration *addressRegistration, lnCli
 		return false, nil
 	}
 
+	//Nodes are found by their single registration, which can be a prefix
+	if db.IsNodeRegistered(nodePubKey) {
+		log.Println("Verification failed for " + net.IP(newAddress[:]).String() + " registration: Node already registered.")
+		return false, nil
+	}
+
 	//Check if the node registering the address has any neighbors
 	//and if it does, the address to be registered should be the first succeeding address, of an address that belongs to a one of the neighbours
 	neighbors := GetNodeNeighboursPubKeys(lnClient, nodePubKey)
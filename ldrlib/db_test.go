@@ -62,3 +62,38 @@ func TestAddAddress(t *testing.T) {
 		})
 	}
 }
+
+func TestSuggestAddressAroundPrefix(t *testing.T) {
+
+	//carol is the gateway of 10.2.0.0/16, which holds bob's address. The free addresses inside
+	//the prefix belong to carol, so suggestions are taken from outside of it
+	carolPrefix := &addressInfo{address: [4]byte{10, 2, 0, 0}, prefixLen: 16, nodePubKey: [33]byte{1}}
+	bobAddress := &addressInfo{address: [4]byte{10, 2, 0, 5}, nodePubKey: [33]byte{2}}
+	db := createDB("")
+	db.addAddressToDB(carolPrefix)
+	db.addAddressToDB(bobAddress)
+
+	var tests = []struct {
+		name string
+		seed [4]byte
+		want [4]byte
+	}{
+		{"prefix", carolPrefix.address, [4]byte{10, 3, 0, 0}},
+		{"address in prefix", bobAddress.address, [4]byte{10, 3, 0, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			suggestedAddress, err := db.SuggestAddress(test.seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if suggestedAddress != test.want {
+				t.Errorf("SuggestAddress wants %v and got %v", test.want, suggestedAddress)
+			}
+			if db.getPeerConn(suggestedAddress) != nil {
+				t.Errorf("getPeerConn found a connection to the unregistered %v", suggestedAddress)
+			}
+		})
+	}
+}
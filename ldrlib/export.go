@@ -0,0 +1,384 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+//Export is the JSON representation of the address and routing DBs
+//network: the network the addresses were registered in
+//height: the height of the last scanned block
+//block_hash: the hash of the block at height, so the export can be matched against the chain
+//addresses: every registered address, ordered by address
+//routing_entries: every routing entry of the exporting node, ordered by destination
+type Export struct {
+	Network        string                 `json:"network"`
+	Height         uint64                 `json:"height"`
+	BlockHash      string                 `json:"block_hash,omitempty"`
+	Addresses      []ExportedAddress      `json:"addresses"`
+	RoutingEntries []ExportedRoutingEntry `json:"routing_entries"`
+}
+
+//ExportedAddress is the JSON representation of an addressInfo
+//address: the routing address in dotted notation, prefixes in CIDR notation
+//node_pub_key: the hex encoded 33 byte compressed pubkey of the registering node
+//registration_height: the height of the block where the address was registered
+//registration_txid: the id of the registration transaction
+//version: version of the protocol in which the address was registered
+type ExportedAddress struct {
+	Address            string `json:"address"`
+	NodePubKey         string `json:"node_pub_key"`
+	RegistrationHeight uint64 `json:"registration_height"`
+	RegistrationTxID   string `json:"registration_txid"`
+	Version            uint32 `json:"version"`
+}
+
+//ExportedRoutingEntry is the JSON representation of a routingEntry
+//destination: the destination address in dotted notation
+//next_hop: the next hop address in dotted notation
+//capacity: the known minimum capacity for the route (in satoshis)
+//height: block height in which the entry was updated
+type ExportedRoutingEntry struct {
+	Destination string `json:"destination"`
+	NextHop     string `json:"next_hop"`
+	Capacity    int64  `json:"capacity"`
+	Height      uint64 `json:"height"`
+}
+
+//Export returns the JSON representation of the DB
+func (db *DB) Export() *Export {
+
+	export := &Export{Height: db.height, Addresses: []ExportedAddress{}, RoutingEntries: []ExportedRoutingEntry{}}
+	if db.network != nil {
+		export.Network = db.network.Name
+	}
+	if hash, ok := db.getBlockHash(db.height); ok {
+		export.BlockHash = hash.String()
+	}
+
+	for _, addressNode := range db.keyToAddressMap {
+		info := addressNode.getData().(*addressInfo)
+		export.Addresses = append(export.Addresses, ExportedAddress{Address: formatAddress(info),
+			NodePubKey: PubKeyArrayToString(info.nodePubKey), RegistrationHeight: info.registrationHeight,
+			RegistrationTxID: hex.EncodeToString(info.registrationTxID[:]), Version: info.version})
+	}
+	sort.Slice(export.Addresses, func(i, j int) bool {
+		addressI, _, _ := parseExportedPrefix(export.Addresses[i].Address)
+		addressJ, _, _ := parseExportedPrefix(export.Addresses[j].Address)
+		return bytes.Compare(addressI[:], addressJ[:]) < 0
+	})
+
+	for _, entry := range db.routingEntriesStack.peekFromBlock(genesisBlock) {
+		export.RoutingEntries = append(export.RoutingEntries, ExportedRoutingEntry{
+			Destination: net.IP(entry.destination[:]).String(), NextHop: net.IP(entry.nextHop[:]).String(),
+			Capacity: entry.capacity, Height: entry.height})
+	}
+	sort.Slice(export.RoutingEntries, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(export.RoutingEntries[i].Destination).To4(), net.ParseIP(export.RoutingEntries[j].Destination).To4()) < 0
+	})
+
+	return export
+}
+
+//ExportJSON writes the JSON representation of the DB to w
+func (db *DB) ExportJSON(w io.Writer) error {
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(db.Export())
+}
+
+//ImportJSON seeds an empty DB with the JSON representation read from r.
+//Every address is checked against its registration transaction in the chain and nothing is
+//imported unless the whole export is valid. Routing entries are only meaningful to the node that
+//exported them and can be left out when seeding a different node
+func (db *DB) ImportJSON(r io.Reader, bitcoind ChainBackend, lnClient LightningBackend) error {
+
+	var export Export
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return err
+	}
+
+	hash, err := db.checkImport(export.Network, export.Height, export.BlockHash, bitcoind)
+	if err != nil {
+		return err
+	}
+
+	infos, err := validateExportedAddresses(export.Addresses, export.Height, bitcoind, lnClient)
+	if err != nil {
+		return err
+	}
+
+	entries, err := validateExportedRoutingEntries(export.RoutingEntries, infos)
+	if err != nil {
+		return err
+	}
+
+	//Everything is valid, load and store it
+	err = db.loadImport(export.Height, hash, infos)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		db.addRoutingEntryToDB(entry)
+		if err = db.saveRoutingEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Imported", len(infos), "addresses and", len(entries), "routing entries up to block", export.Height)
+
+	return nil
+}
+
+//checkImport makes sure an import of the addresses registered in network up to height can seed the DB
+//and returns the hash of the block at height, which must match blockHash when it is known
+func (db *DB) checkImport(network string, height uint64, blockHash string, bitcoind ChainBackend) (*chainhash.Hash, error) {
+
+	if db.height != genesisBlock || len(db.keyToAddressMap) != 0 {
+		return nil, errors.New("Only empty DBs can be imported into")
+	}
+	if db.network != nil && network != db.network.Name {
+		return nil, errors.New("Import belongs to " + network + ", not " + db.network.Name)
+	}
+	if height == genesisBlock {
+		return nil, errors.New("Import doesn't hold any scanned block")
+	}
+
+	//The import has to be buried under enough confirmations in the best chain
+	blockCount, err := GetBlockCount(bitcoind)
+	if err != nil {
+		return nil, err
+	}
+	if confirmedHeight, confirmed := db.confirmedHeight(blockCount); !confirmed || height > confirmedHeight {
+		return nil, errors.New("Import height " + strconv.FormatUint(height, 10) + " doesn't have enough confirmations")
+	}
+	chainBlockHash, err := bitcoind.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+	if blockHash != "" && blockHash != chainBlockHash {
+		return nil, errors.New("Import was made on a chain that was reorganized at height " + strconv.FormatUint(height, 10))
+	}
+
+	return chainhash.NewHashFromStr(chainBlockHash)
+}
+
+//loadImport loads the imported addresses into the DB and stores them, resuming the scan after height
+func (db *DB) loadImport(height uint64, hash *chainhash.Hash, infos []*addressInfo) error {
+
+	var changes []*addressChange
+	for _, info := range infos {
+		changes = append(changes, &addressChange{height: info.registrationHeight, info: info})
+	}
+
+	//The memory only gets the addresses once they are stored
+	err := db.commitScannedBlocks(height, []chainhash.Hash{*hash}, changes)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		db.addAddressToDB(info)
+	}
+
+	return nil
+}
+
+//validateExportedAddresses decodes the exported addresses and checks each one against the
+//registration transaction found in the chain at its registration height
+func validateExportedAddresses(addresses []ExportedAddress, height uint64, bitcoind ChainBackend, lnClient LightningBackend) ([]*addressInfo, error) {
+
+	infos, err := decodeExportedAddresses(addresses, height)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, info := range infos {
+
+		exported := addresses[i]
+		registration, err := findAddressRegistration(bitcoind, info.registrationHeight, exported.RegistrationTxID)
+		if err != nil {
+			return nil, errors.New("Address " + exported.Address + ": " + err.Error())
+		}
+		if registration.address != info.address || registration.version != info.version {
+			return nil, errors.New("Address " + exported.Address + " doesn't match its registration transaction")
+		}
+		//The signature of a transfer commits to the registration of the previous owner, which isn't exported,
+		//so only a scan of the chain can tell a transfer from a forged one
+		signedMessage := registration.address[:]
+		switch registration.msgType {
+		case transferMessage:
+			return nil, errors.New("Address " + exported.Address + " was transferred and can only be verified by scanning the chain")
+		case revokeMessage:
+			return nil, errors.New("Address " + exported.Address + " points to its revocation")
+		case prefixMessage:
+			if registration.prefixLen != info.prefixLen {
+				return nil, errors.New("Address " + exported.Address + " doesn't match its registration transaction")
+			}
+			signedMessage = prefixRegistrationMessage(registration.address, registration.prefixLen)
+		}
+		validSig, nodePubKey := VerifyMessage(lnClient, signedMessage, registration.sig[:])
+		if !validSig || nodePubKey != info.nodePubKey {
+			return nil, errors.New("Address " + exported.Address + " wasn't registered by " + exported.NodePubKey)
+		}
+	}
+
+	return infos, nil
+}
+
+//decodeExportedAddresses decodes the addresses registered up to height, which must be unique per node
+func decodeExportedAddresses(addresses []ExportedAddress, height uint64) ([]*addressInfo, error) {
+
+	var infos []*addressInfo
+	var registeredAddresses = make(map[[4]byte]bool)
+	var registeredNodes = make(map[[33]byte]bool)
+
+	for _, exported := range addresses {
+
+		info, err := decodeExportedAddress(&exported)
+		if err != nil {
+			return nil, err
+		}
+		if info.registrationHeight > height {
+			return nil, errors.New("Address " + exported.Address + " was registered after the import height")
+		}
+		if registeredAddresses[info.address] || registeredNodes[info.nodePubKey] {
+			return nil, errors.New("Address " + exported.Address + " or its node is registered twice")
+		}
+
+		registeredAddresses[info.address] = true
+		registeredNodes[info.nodePubKey] = true
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+//validateExportedRoutingEntries decodes the exported routing entries, which can only lead to imported addresses
+func validateExportedRoutingEntries(entries []ExportedRoutingEntry, infos []*addressInfo) ([]*routingEntry, error) {
+
+	var routingEntries []*routingEntry
+	var registeredAddresses = make(map[[4]byte]bool)
+	var destinations = make(map[[4]byte]bool)
+
+	for _, info := range infos {
+		registeredAddresses[info.address] = true
+	}
+
+	for _, exported := range entries {
+
+		destination, err := parseExportedAddress(exported.Destination)
+		if err != nil {
+			return nil, err
+		}
+		nextHop, err := parseExportedAddress(exported.NextHop)
+		if err != nil {
+			return nil, err
+		}
+		if !registeredAddresses[destination] || !registeredAddresses[nextHop] {
+			return nil, errors.New("Routing entry to " + exported.Destination + " uses an unregistered address")
+		}
+		if destinations[destination] {
+			return nil, errors.New("Found two routing entries to " + exported.Destination)
+		}
+		if exported.Capacity < 0 {
+			return nil, errors.New("Routing entry to " + exported.Destination + " has a negative capacity")
+		}
+
+		destinations[destination] = true
+		routingEntries = append(routingEntries, &routingEntry{destination: destination, nextHop: nextHop,
+			capacity: exported.Capacity, height: exported.Height})
+	}
+
+	return routingEntries, nil
+}
+
+//findAddressRegistration returns the registration made by the transaction txID in the block at height
+func findAddressRegistration(bitcoind ChainBackend, height uint64, txID string) (*addressRegistration, error) {
+
+	blockHash, err := bitcoind.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+	rawBlock, err := bitcoind.GetRawBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	block, err := decodeRawBlock(rawBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.TxHash().String() != txID {
+			continue
+		}
+		registration, err := decodeRegistrationTx(tx, height)
+		if err != nil {
+			return nil, errors.New("transaction " + txID + " isn't an address registration: " + err.Error())
+		}
+		return registration, nil
+	}
+
+	return nil, errors.New("transaction " + txID + " isn't in block " + strconv.FormatUint(height, 10))
+}
+
+func decodeExportedAddress(exported *ExportedAddress) (*addressInfo, error) {
+
+	var info = addressInfo{registrationHeight: exported.RegistrationHeight, version: exported.Version}
+
+	address, prefixLen, err := parseExportedPrefix(exported.Address)
+	if err != nil {
+		return nil, err
+	}
+	info.address = address
+	info.prefixLen = prefixLen
+
+	pubKey, err := hex.DecodeString(exported.NodePubKey)
+	if err != nil || len(pubKey) != 33 {
+		return nil, errors.New("Invalid node public key " + exported.NodePubKey)
+	}
+	copy(info.nodePubKey[:], pubKey)
+
+	txID, err := hex.DecodeString(exported.RegistrationTxID)
+	if err != nil || len(txID) != 32 {
+		return nil, errors.New("Invalid registration transaction id " + exported.RegistrationTxID)
+	}
+	copy(info.registrationTxID[:], txID)
+
+	return &info, nil
+}
+
+//parseExportedPrefix parses an exported address, which can be a prefix in CIDR notation
+func parseExportedPrefix(address string) ([4]byte, uint8, error) {
+
+	if strings.Contains(address, "/") {
+		return ParsePrefix(address)
+	}
+
+	parsed, err := parseExportedAddress(address)
+	return parsed, 0, err
+}
+
+func parseExportedAddress(address string) ([4]byte, error) {
+
+	var parsed [4]byte
+
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return parsed, errors.New("Invalid address " + address)
+	}
+	copy(parsed[:], ip)
+
+	return parsed, nil
+}
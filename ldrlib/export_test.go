@@ -0,0 +1,106 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+func TestExportImportJSON(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	carol := newTestNode(t, graph, "carol")
+	chain := chainfake.New()
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	bobAddress := [4]byte{10, 0, 0, 2}
+	aliceTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobTx, err := chainfake.RegistrationTx(0, bobAddress, SignMessage(bob, bobAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(aliceTx, bobTx)
+	//carol forges the transfer of alice's address to herself
+	forgedTransfer := ownershipTx(t, carol, transferMessage, &addressInfo{address: aliceAddress, registrationTxID: aliceTx.TxHash()},
+		carol.PubKey())
+	chain.Mine(forgedTransfer)
+	chain.MineEmpty(2)
+
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(1)
+	db.UpdateAddressDB(chain, alice)
+	db.addRoutingEntryToDB(&routingEntry{destination: bobAddress, nextHop: bobAddress, capacity: 5000, height: 4})
+
+	var exported bytes.Buffer
+	if err = db.ExportJSON(&exported); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(export *Export)
+		valid  bool
+	}{
+		{"untouched", func(export *Export) {}, true},
+		{"wrong node", func(export *Export) { export.Addresses[0].NodePubKey = export.Addresses[1].NodePubKey }, false},
+		{"wrong height", func(export *Export) { export.Addresses[0].RegistrationHeight = 2 }, false},
+		{"wrong network", func(export *Export) { export.Network = TestNet.Name }, false},
+		{"unconfirmed", func(export *Export) { export.Height = 5; export.BlockHash = "" }, false},
+		{"unregistered next hop", func(export *Export) { export.RoutingEntries[0].NextHop = "10.0.0.3" }, false},
+		{"forged transfer", func(export *Export) {
+			export.Addresses[0].NodePubKey = PubKeyArrayToString(carol.PubKey())
+			export.Addresses[0].RegistrationTxID = forgedTransfer.TxHash().String()
+			export.Addresses[0].RegistrationHeight = 2
+			export.Addresses[0].Version = messageVersion
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var export Export
+			if err := json.Unmarshal(exported.Bytes(), &export); err != nil {
+				t.Fatal(err)
+			}
+			test.tamper(&export)
+			tampered, err := json.Marshal(&export)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			imported := ReadDBFromDisk(newTestDataPath(t), RegTest, bob)
+			defer imported.Close()
+			imported.SetConfirmationDepth(1)
+
+			err = imported.ImportJSON(bytes.NewReader(tampered), chain, bob)
+			if (err == nil) != test.valid {
+				t.Fatalf("ImportJSON wants valid %v and got %v", test.valid, err)
+			}
+			if !test.valid {
+				if imported.IsAddressRegistered(aliceAddress) || imported.getBlockHeight() != genesisBlock {
+					t.Errorf("rejected import changed the DB")
+				}
+				return
+			}
+
+			if address, registered := imported.GetNodeAddress(alice.PubKey()); !registered || address != aliceAddress {
+				t.Errorf("alice's address wasn't imported")
+			}
+			if imported.getBlockHeight() != db.getBlockHeight() {
+				t.Errorf("imported DB wants height %v and got %v", db.getBlockHeight(), imported.getBlockHeight())
+			}
+			if entry := imported.getRoutingEntry(bobAddress); entry == nil || entry.capacity != 5000 {
+				t.Errorf("routing entry to bob wasn't imported")
+			}
+		})
+	}
+}
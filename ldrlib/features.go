@@ -0,0 +1,146 @@
+package ldrlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const (
+	//initMessageType is the first message sent by both peers once the handshake is done
+	initMessageType uint16 = 16
+
+	//protocolVersion is the version of the LDR protocol spoken by the local node
+	protocolVersion uint16 = 1
+	//minProtocolVersion is the oldest version of the protocol a peer can speak to connect to the local node
+	minProtocolVersion uint16 = 1
+
+	//The size of an init message header (in bytes)
+	//<version> (2 bytes) + <features length> (2 bytes)
+	initHeaderSize = 4
+)
+
+//Feature bits come in pairs like in BOLT 9. The even bit of a pair is set by nodes requiring the feature
+//and the odd one by nodes supporting it. It's OK to be odd: peers only reject unknown even bits
+const (
+	//vppnFeatureRequired and vppnFeatureOptional advertise VPPN overlay messages
+	vppnFeatureRequired = 0
+	vppnFeatureOptional = 1
+)
+
+//knownFeatures are the feature bits understood by the local node
+var knownFeatures = map[int]string{
+	vppnFeatureRequired: "vppn",
+	vppnFeatureOptional: "vppn",
+}
+
+//localFeatures are the features advertised by the local node
+var localFeatures = newFeatureVector(vppnFeatureOptional)
+
+//featureVector is a big endian bit field, bit 0 being the least significant bit of the last byte
+type featureVector []byte
+
+//newFeatureVector returns the smallest feature vector with the bits set
+func newFeatureVector(bits ...int) featureVector {
+
+	var features featureVector
+
+	for _, bit := range bits {
+		if size := bit/8 + 1; size > len(features) {
+			features = append(make(featureVector, size-len(features)), features...)
+		}
+		features[len(features)-1-bit/8] |= 1 << uint(bit%8)
+	}
+
+	return features
+}
+
+func (features featureVector) isSet(bit int) bool {
+
+	if bit/8 >= len(features) {
+		return false
+	}
+
+	return features[len(features)-1-bit/8]&(1<<uint(bit%8)) != 0
+}
+
+//supports returns true if either bit of the pair of feature is set
+func (features featureVector) supports(feature int) bool {
+
+	feature -= feature % 2
+
+	return features.isSet(feature) || features.isSet(feature+1)
+}
+
+//unknownRequired returns the even bits set that aren't known by the local node
+func (features featureVector) unknownRequired() []int {
+
+	var bits []int
+
+	for bit := 0; bit < 8*len(features); bit += 2 {
+		if _, known := knownFeatures[bit]; features.isSet(bit) && !known {
+			bits = append(bits, bit)
+		}
+	}
+
+	return bits
+}
+
+//isKnownMessageType returns true for the peer messages the local node can process
+func isKnownMessageType(messageType uint16) bool {
+
+	switch messageType {
+	case tableRequestType, tableResponseType, forwardRouteType, overlayMessageType, initMessageType:
+		return true
+	}
+
+	return false
+}
+
+//Create a serialized init message
+//<type> (2 bytes) + <version> (2 bytes) + <features length> (2 bytes) + <features>
+func createInitMessage(version uint16, features featureVector) []byte {
+
+	message := make([]byte, messageTypeSize+initHeaderSize, messageTypeSize+initHeaderSize+len(features))
+	binary.BigEndian.PutUint16(message, initMessageType)
+	binary.BigEndian.PutUint16(message[2:], version)
+	binary.BigEndian.PutUint16(message[4:], uint16(len(features)))
+
+	return append(message, features...)
+}
+
+//Processes the init message of a peer and returns the version both peers speak and the features of the peer
+func processInitMessage(message []byte) (uint16, featureVector, error) {
+
+	//Check if the message has enough length for it to be valid
+	if len(message) < messageTypeSize+initHeaderSize {
+		return 0, nil, errors.New("Invalid init message size")
+	}
+
+	//Validate the type of message
+	if binary.BigEndian.Uint16(message[:2]) != initMessageType {
+		return 0, nil, errors.New("Invalid init message type")
+	}
+
+	version := binary.BigEndian.Uint16(message[2:4])
+	featuresSize := int(binary.BigEndian.Uint16(message[4:6]))
+	if len(message) != messageTypeSize+initHeaderSize+featuresSize {
+		return 0, nil, errors.New("Invalid init message size")
+	}
+	features := featureVector(message[6:])
+
+	if version < minProtocolVersion {
+		return 0, nil, errors.New("Peer speaks version " + strconv.Itoa(int(version)) + " of the protocol, older than " +
+			strconv.Itoa(int(minProtocolVersion)))
+	}
+	if bits := features.unknownRequired(); len(bits) > 0 {
+		return 0, nil, errors.New("Peer requires unknown feature bit " + strconv.Itoa(bits[0]))
+	}
+
+	//Peers speak the oldest version of the two
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+
+	return version, features, nil
+}
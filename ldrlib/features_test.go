@@ -0,0 +1,59 @@
+package ldrlib
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFeatureVector(t *testing.T) {
+
+	features := newFeatureVector(vppnFeatureOptional, 10)
+	if !bytes.Equal(features, []byte{0x04, 0x02}) {
+		t.Fatalf("feature vector is %x", []byte(features))
+	}
+	if !features.isSet(vppnFeatureOptional) || features.isSet(vppnFeatureRequired) || !features.isSet(10) || features.isSet(42) {
+		t.Errorf("feature vector has the wrong bits set")
+	}
+	if !features.supports(vppnFeatureRequired) || !newFeatureVector(vppnFeatureRequired).supports(vppnFeatureOptional) ||
+		newFeatureVector().supports(vppnFeatureOptional) {
+		t.Errorf("feature pairs aren't supported with either bit")
+	}
+	if bits := features.unknownRequired(); len(bits) != 1 || bits[0] != 10 {
+		t.Errorf("unknown required bits are %v", bits)
+	}
+}
+
+func TestInitMessage(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		message  []byte
+		valid    bool
+		version  uint16
+		features featureVector
+	}{
+		{"local node", createInitMessage(protocolVersion, localFeatures), true, protocolVersion, localFeatures},
+		{"newer version", createInitMessage(protocolVersion+1, nil), true, protocolVersion, nil},
+		{"older version", createInitMessage(minProtocolVersion-1, nil), false, 0, nil},
+		//It's OK to be odd
+		{"unknown optional feature", createInitMessage(protocolVersion, newFeatureVector(21)), true, protocolVersion,
+			newFeatureVector(21)},
+		{"unknown required feature", createInitMessage(protocolVersion, newFeatureVector(20)), false, 0, nil},
+		{"truncated features", createInitMessage(protocolVersion, localFeatures)[:messageTypeSize+initHeaderSize], false, 0, nil},
+		{"too short", createInitMessage(protocolVersion, nil)[:messageTypeSize+1], false, 0, nil},
+		{"table request", append([]byte{0, byte(tableRequestType)}, make([]byte, initHeaderSize)...), false, 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, features, err := processInitMessage(test.message)
+			if (err == nil) != test.valid {
+				t.Fatalf("processInitMessage wants valid %v and got %v", test.valid, err)
+			}
+			if version != test.version || !bytes.Equal(features, test.features) {
+				t.Errorf("processInitMessage wants version %d with features %x and got %d with %x", test.version,
+					[]byte(test.features), version, []byte(features))
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package ldrlib
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+//Number of blocks a bumped registration should take to confirm, used to estimate its new fee rate
+const bumpConfTarget = 2
+
+//FeeBumpMethod is the way the fee of a pending registration is raised
+type FeeBumpMethod int
+
+const (
+	//ReplaceByFee broadcasts a new version of the registration paying a higher fee out of its change (BIP 125)
+	ReplaceByFee FeeBumpMethod = iota
+	//ChildPaysForParent broadcasts a transaction spending the change of the registration and paying
+	//for both of them
+	ChildPaysForParent
+)
+
+//txVSize returns the virtual size of tx
+func txVSize(tx *wire.MsgTx) int64 {
+	return (blockchain.GetTransactionWeight(btcutil.NewTx(tx)) + blockchain.WitnessScaleFactor - 1) /
+		blockchain.WitnessScaleFactor
+}
+
+//changeOutput returns the index of the output of the registration tx that isn't the registration itself
+func changeOutput(tx *wire.MsgTx) (int, bool) {
+
+	for i, txOut := range tx.TxOut {
+		if _, err := decodeRegistrationScript(txOut.PkScript); err == errNotRegistration {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+//BumpRegistrationFee raises the fee of the pending registration of address to feeRate (sat/vB) with
+//method and returns the id of the new transaction. A 0 fee rate uses the estimate for the next blocks.
+//Only registrations funded by the bitcoind wallet can be bumped
+//Note: Requires bitcoin wallet to be unlocked
+func (db *DB) BumpRegistrationFee(bitcoind ChainBackend, address [4]byte, method FeeBumpMethod, feeRate btcutil.Amount) (string, error) {
+
+	registrations, err := db.loadTrackedRegistrations()
+	if err != nil {
+		return "", err
+	}
+	var registration *RegistrationTx
+	for _, trackedRegistration := range registrations {
+		if trackedRegistration.Address == address {
+			registration = trackedRegistration
+		}
+	}
+	if registration == nil {
+		return "", errors.New("There is no pending registration of " + net.IP(address[:]).String())
+	}
+	if registration.funding != fundedByBitcoind {
+		return "", errors.New("Only registrations funded by the bitcoind wallet can be bumped")
+	}
+
+	if feeRate == 0 {
+		feeRate, err = estimateFeeRate(bitcoind, bumpConfTarget)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	switch method {
+	case ReplaceByFee:
+		err = replaceByFee(bitcoind, registration, feeRate)
+	case ChildPaysForParent:
+		err = childPaysForParent(bitcoind, registration, feeRate)
+	default:
+		err = errors.New("Unknown fee bump method")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err = db.saveTrackedRegistration(registration); err != nil {
+		return "", err
+	}
+	if method == ChildPaysForParent {
+		return registration.child.TxHash().String(), nil
+	}
+	return registration.TxHash(), nil
+}
+
+//replaceByFee replaces the registration tx with a version paying feeRate, taking the extra fee from its change.
+//The replacement has to pay for the transactions it evicts plus its own relay fee
+func replaceByFee(bitcoind ChainBackend, registration *RegistrationTx, feeRate btcutil.Amount) error {
+
+	vSize := txVSize(registration.tx)
+	fee := btcutil.Amount(vSize) * feeRate
+	if minFee := registration.fee + registration.childFee + btcutil.Amount(vSize)*minRelayFeeRate; fee < minFee {
+		fee = minFee
+	}
+
+	tx := registration.tx.Copy()
+	for _, txIn := range tx.TxIn {
+		txIn.SignatureScript = nil
+		txIn.Witness = nil
+	}
+
+	change, hasChange := changeOutput(tx)
+	if !hasChange {
+		return errors.New("The registration has no change output to pay a higher fee")
+	}
+	available := btcutil.Amount(tx.TxOut[change].Value)
+	newChange := available - (fee - registration.fee)
+	switch {
+	case newChange < 0:
+		return InsufficientFundsError{Required: fee - registration.fee, Available: available}
+	case newChange < dustThreshold(tx.TxOut[change].PkScript):
+		//The whole change goes to the fee
+		fee += newChange
+		tx.TxOut = append(tx.TxOut[:change], tx.TxOut[change+1:]...)
+	default:
+		tx.TxOut[change].Value = int64(newChange)
+	}
+
+	signedTx, err := signAndSendTx(bitcoind, tx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replaced registration %v with %v, paying %v in fees\n", registration.TxHash(), signedTx.TxHash(), fee)
+
+	//Replacing the registration evicts the child spending its old change
+	registration.tx = signedTx
+	registration.fee = fee
+	registration.child = nil
+	registration.childFee = 0
+
+	return nil
+}
+
+//childPaysForParent spends the change of the registration tx back to the same script with a child paying
+//for both transactions at feeRate. A previous child is replaced
+func childPaysForParent(bitcoind ChainBackend, registration *RegistrationTx, feeRate btcutil.Amount) error {
+
+	change, hasChange := changeOutput(registration.tx)
+	if !hasChange {
+		return errors.New("The registration has no change output to spend")
+	}
+	changeOut := registration.tx.TxOut[change]
+
+	//Sending the change back to its own script saves asking the wallet for another address
+	childVSize := txOverheadVSize + inputVSize(changeOut.PkScript) + outputVSize(changeOut.PkScript)
+	childFee := btcutil.Amount(txVSize(registration.tx)+childVSize)*feeRate - registration.fee
+	if minFee := registration.childFee + btcutil.Amount(childVSize)*minRelayFeeRate; childFee < minFee {
+		childFee = minFee
+	}
+
+	value := btcutil.Amount(changeOut.Value) - childFee
+	if value < dustThreshold(changeOut.PkScript) {
+		return InsufficientFundsError{Required: childFee + dustThreshold(changeOut.PkScript),
+			Available: btcutil.Amount(changeOut.Value)}
+	}
+
+	parentHash := registration.tx.TxHash()
+	child := wire.NewMsgTx(wire.TxVersion)
+	txIn := wire.NewTxIn(wire.NewOutPoint(&parentHash, uint32(change)), nil, nil)
+	txIn.Sequence = rbfSequence
+	child.AddTxIn(txIn)
+	child.AddTxOut(wire.NewTxOut(int64(value), changeOut.PkScript))
+
+	signedChild, err := signAndSendTx(bitcoind, child)
+	if err != nil {
+		return err
+	}
+	log.Printf("Bumped registration %v with child %v, paying %v in fees\n", registration.TxHash(), signedChild.TxHash(), childFee)
+
+	registration.child = signedChild
+	registration.childFee = childFee
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package ldrlib
+
+import (
+	"testing"
+
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+func TestBumpRegistrationFee(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	aliceAddress := [4]byte{10, 0, 0, 1}
+
+	tests := []struct {
+		name    string
+		lnd     bool
+		methods []FeeBumpMethod
+		mempool int
+		valid   bool
+	}{
+		{"replace by fee", false, []FeeBumpMethod{ReplaceByFee}, 1, true},
+		{"child pays for parent", false, []FeeBumpMethod{ChildPaysForParent}, 2, true},
+		{"replace the child", false, []FeeBumpMethod{ChildPaysForParent, ChildPaysForParent}, 2, true},
+		{"replace the parent and its child", false, []FeeBumpMethod{ChildPaysForParent, ReplaceByFee}, 1, true},
+		{"funded by lnd", true, []FeeBumpMethod{ReplaceByFee}, 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			alice := newTestNode(t, graph, test.name)
+			chain := chainfake.New()
+			chain.SetFeeRate(0.00002)
+
+			var registration *RegistrationTx
+			var err error
+			if test.lnd {
+				alice.SetWallet(100000, chain)
+				registration, err = BroadcastNewAddressTxWithLnd(alice, aliceAddress)
+			} else {
+				fundTestWallet(t, chain, 0.001)
+				registration, err = BroadcastNewAddressTx(chain, alice, DefaultChangeAddressType, aliceAddress)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+			defer db.Close()
+			if err = db.TrackRegistration(registration); err != nil {
+				t.Fatal(err)
+			}
+
+			//Every bump has to pay more than the one before
+			paid := registration.fee
+			for _, method := range test.methods {
+				_, err = db.BumpRegistrationFee(chain, aliceAddress, method, 50)
+				if (err == nil) != test.valid {
+					t.Fatalf("BumpRegistrationFee wants valid %v and got %v", test.valid, err)
+				}
+				if !test.valid {
+					return
+				}
+
+				registrations, err := db.loadTrackedRegistrations()
+				if err != nil || len(registrations) != 1 {
+					t.Fatalf("bumped registration isn't tracked: %v", err)
+				}
+				if bumped := registrations[0].fee + registrations[0].childFee; bumped <= paid {
+					t.Errorf("BumpRegistrationFee paid %v after %v", bumped, paid)
+				} else {
+					paid = bumped
+				}
+				if registrations[0].Address != aliceAddress {
+					t.Errorf("BumpRegistrationFee changed the address to %v", registrations[0].Address)
+				}
+			}
+
+			mempool := chain.Mempool()
+			if len(mempool) != test.mempool {
+				t.Fatalf("mempool wants %v transactions and got %v", test.mempool, len(mempool))
+			}
+			if _, err = decodeRegistrationTx(mempool[0], 0); err != nil {
+				t.Errorf("bumped transaction isn't a registration: %v", err)
+			}
+		})
+	}
+}
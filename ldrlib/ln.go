@@ -1,6 +1,7 @@
 package ldrlib
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -10,6 +11,33 @@ import (
 	"github.com/tv42/zbase32"
 )
 
+//LightningBackend is the set of lightning node operations used by ldrlib.
+//lndwrapper.Lnd is the production implementation and lndfake provides an
+//in-memory one for tests.
+type LightningBackend interface {
+	GetInfo() (*lndwrapper.GetInfoResponse, error)
+	GetNodeInfo(pubkey string, includeChannels bool) (*lndwrapper.NodeInfo, error)
+	ListChannels() (*lndwrapper.ListChannelsResponse, error)
+	SignMessage(message []byte) (*lndwrapper.SignMessageResponse, error)
+	VerifyMessage(message []byte, signature string) (*lndwrapper.VerifyMessageResponse, error)
+}
+
+//lightningWallet is implemented by lightning backends with an on-chain wallet able to fund transactions
+type lightningWallet interface {
+	EstimateFee(confTarget int32) (*lndwrapper.EstimateFeeResponse, error)
+	SendOutputs(satPerKw int64, outputs []*lndwrapper.TxOut) (*lndwrapper.SendOutputsResponse, error)
+}
+
+//graphReader is implemented by lightning backends able to list every node of the graph
+type graphReader interface {
+	DescribeGraph() (*lndwrapper.ChannelGraph, error)
+}
+
+//Make sure lnd satisfies the lightning backend interfaces
+var _ LightningBackend = (*lndwrapper.Lnd)(nil)
+var _ lightningWallet = (*lndwrapper.Lnd)(nil)
+var _ graphReader = (*lndwrapper.Lnd)(nil)
+
 //ConnectToLNClient connects to the local instance lnd
 func ConnectToLNClient(host string, port int, macaroonPath string, tlsCertPath string) (*lndwrapper.Lnd, error) {
 
@@ -22,7 +50,7 @@ func ConnectToLNClient(host string, port int, macaroonPath string, tlsCertPath s
 }
 
 //GetLocalNodePubKey returns the lightning network id of the local node string
-func GetLocalNodePubKey(client *lndwrapper.Lnd) [33]byte {
+func GetLocalNodePubKey(client LightningBackend) [33]byte {
 
 	nodeInfo, err := client.GetInfo()
 	if err != nil {
@@ -33,7 +61,7 @@ func GetLocalNodePubKey(client *lndwrapper.Lnd) [33]byte {
 }
 
 //GetNodeIPs - Get the IP of a certain node
-func GetNodeIPs(client *lndwrapper.Lnd, nodePubKey [33]byte) []string {
+func GetNodeIPs(client LightningBackend, nodePubKey [33]byte) []string {
 
 	var addrs []string
 	var i int
@@ -53,14 +81,14 @@ func GetNodeIPs(client *lndwrapper.Lnd, nodePubKey [33]byte) []string {
 }
 
 //GetLocalNodeNeighboursPubKeys - Returns the pubkeys associated  of the the current node active neighbours
-func GetLocalNodeNeighboursPubKeys(client *lndwrapper.Lnd) [][33]byte {
+func GetLocalNodeNeighboursPubKeys(client LightningBackend) ([][33]byte, error) {
 
 	neighboursPubKey := []string{}
 	neighboursArrayPubKey := [][33]byte{}
 
 	openChannels, err := client.ListChannels()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	for _, channel := range openChannels.GetChannels() {
@@ -70,11 +98,11 @@ func GetLocalNodeNeighboursPubKeys(client *lndwrapper.Lnd) [][33]byte {
 
 	fmt.Println("Local neighbours: " + strings.Join(neighboursPubKey, ", "))
 
-	return neighboursArrayPubKey
+	return neighboursArrayPubKey, nil
 }
 
 //GetLocalChannels - Returns the channels assocatited with the local node
-func GetLocalChannels(client *lndwrapper.Lnd) []*lnrpc.Channel {
+func GetLocalChannels(client LightningBackend) []*lnrpc.Channel {
 
 	openChannels, err := client.ListChannels()
 	if err != nil {
@@ -85,7 +113,7 @@ func GetLocalChannels(client *lndwrapper.Lnd) []*lnrpc.Channel {
 }
 
 //GetNodeNeighboursPubKeys - Returns the pubkeys associated  with neighbors of nodePubKey
-func GetNodeNeighboursPubKeys(client *lndwrapper.Lnd, nodePubKey [33]byte) [][33]byte {
+func GetNodeNeighboursPubKeys(client LightningBackend, nodePubKey [33]byte) [][33]byte {
 
 	neighboursPubKey := []string{}
 	neighboursArrayPubKey := [][33]byte{}
@@ -97,8 +125,9 @@ func GetNodeNeighboursPubKeys(client *lndwrapper.Lnd, nodePubKey [33]byte) [][33
 	}
 
 	for _, channel := range nodeInfo.GetChannels() {
-		neighboursPubKey = append(neighboursPubKey, channel.Node1Pub)
-		neighboursArrayPubKey = append(neighboursArrayPubKey, PubKeyStringToArray(channel.Node1Pub))
+		neighbourPubKey := channelNeighbour(channel, nodePubKeyHexString)
+		neighboursPubKey = append(neighboursPubKey, neighbourPubKey)
+		neighboursArrayPubKey = append(neighboursArrayPubKey, PubKeyStringToArray(neighbourPubKey))
 	}
 
 	fmt.Println("Neigbours of " + nodePubKeyHexString + ": " + strings.Join(neighboursPubKey, ", "))
@@ -106,8 +135,42 @@ func GetNodeNeighboursPubKeys(client *lndwrapper.Lnd, nodePubKey [33]byte) [][33
 	return neighboursArrayPubKey
 }
 
+//channelNeighbour returns the pubkey of the node on the other end of the channel edge from nodePubKey,
+//which can be either end of the edge
+func channelNeighbour(channel *lnrpc.ChannelEdge, nodePubKey string) string {
+
+	if channel.Node1Pub == nodePubKey {
+		return channel.Node2Pub
+	}
+
+	return channel.Node1Pub
+}
+
+//getNodesByKeyHint returns the pubkeys of the nodes of the graph identified by hint in transfers
+func getNodesByKeyHint(client LightningBackend, hint [nodeKeyHintSize]byte) ([][33]byte, error) {
+
+	reader, ok := client.(graphReader)
+	if !ok {
+		return nil, errors.New("The lightning backend can't list the nodes of the graph")
+	}
+
+	graph, err := reader.DescribeGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	var pubKeys [][33]byte
+	for _, node := range graph.GetNodes() {
+		if pubKey := PubKeyStringToArray(node.PubKey); nodeKeyHint(pubKey) == hint {
+			pubKeys = append(pubKeys, pubKey)
+		}
+	}
+
+	return pubKeys, nil
+}
+
 //SignMessage signs a message using the keys provided by the lightning node
-func SignMessage(client *lndwrapper.Lnd, message []byte) []byte {
+func SignMessage(client LightningBackend, message []byte) []byte {
 
 	resp, err := client.SignMessage(message)
 	if err != nil {
@@ -124,7 +187,7 @@ func SignMessage(client *lndwrapper.Lnd, message []byte) []byte {
 }
 
 //VerifyMessage verifies a message using the keys DB in the lightning node
-func VerifyMessage(client *lndwrapper.Lnd, message []byte, signature []byte) (bool, [33]byte) {
+func VerifyMessage(client LightningBackend, message []byte, signature []byte) (bool, [33]byte) {
 
 	//Get the corresponding zbase32 signature
 	zbase32Signature := zbase32.EncodeToString(signature)
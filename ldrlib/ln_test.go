@@ -0,0 +1,146 @@
+package ldrlib
+
+import (
+	"testing"
+
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+//newTestNode adds a node to the fake graph failing the test on error
+func newTestNode(t *testing.T, graph *lndfake.Graph, alias string) *lndfake.Node {
+	node, err := graph.AddNode(alias, "127.0.0.1:9735")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+//signedRegistration builds the registration a node would broadcast for address
+func signedRegistration(node *lndfake.Node, address [4]byte, height uint64) *addressRegistration {
+	registration := &addressRegistration{address: address, blockHeight: height}
+	copy(registration.sig[:], SignMessage(node, address[:]))
+	return registration
+}
+
+func TestVerifyAddressRegistration(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	graph.OpenChannel(alice, bob, 100000, 50000)
+	stranger, err := lndfake.NewGraph().AddNode("stranger")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+
+	var tests = []struct {
+		name    string
+		signer  *lndfake.Node
+		address [4]byte
+		want    bool
+	}{
+		{"suggested address", bob, [4]byte{10, 0, 0, 0}, true},
+		{"non suggested address", bob, [4]byte{10, 0, 0, 7}, false},
+		{"already registered", bob, aliceAddress, false},
+		{"signer not in graph", stranger, [4]byte{10, 0, 0, 0}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := createDB("")
+			db.addAddressToDB(&addressInfo{address: aliceAddress, nodePubKey: alice.PubKey()})
+
+			valid, info := db.verifyAddressRegistration(signedRegistration(test.signer, test.address, 10), bob)
+			if valid != test.want {
+				t.Fatalf("verifyAddressRegistration wants %v and got %v", test.want, valid)
+			}
+			if valid && info.nodePubKey != test.signer.PubKey() {
+				t.Errorf("verifyAddressRegistration recovered the wrong node key")
+			}
+		})
+	}
+}
+
+func TestGetNodeNeighboursPubKeys(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	graph.OpenChannel(alice, bob, 100000, 50000)
+
+	//Each node is on a different end of the channel edge
+	var tests = []struct {
+		name      string
+		node      *lndfake.Node
+		neighbour *lndfake.Node
+	}{
+		{"alice", alice, bob},
+		{"bob", bob, alice},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			neighbours := GetNodeNeighboursPubKeys(alice, test.node.PubKey())
+			if len(neighbours) != 1 || neighbours[0] != test.neighbour.PubKey() {
+				t.Errorf("GetNodeNeighboursPubKeys wants %x and got %x", test.neighbour.PubKey(), neighbours)
+			}
+		})
+	}
+}
+
+func TestProcessTableResponse(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	carol := newTestNode(t, graph, "carol")
+	graph.OpenChannel(bob, alice, 100000, 30000)
+	graph.OpenChannel(alice, carol, 100000, 60000)
+
+	aliceAddress := [4]byte{0, 0, 0, 1}
+	bobAddress := [4]byte{0, 0, 0, 2}
+	carolAddress := [4]byte{0, 0, 0, 3}
+
+	newRegisteredDB := func() *DB {
+		db := createDB("")
+		db.addAddressToDB(&addressInfo{address: aliceAddress, nodePubKey: alice.PubKey()})
+		db.addAddressToDB(&addressInfo{address: bobAddress, nodePubKey: bob.PubKey()})
+		db.addAddressToDB(&addressInfo{address: carolAddress, nodePubKey: carol.PubKey()})
+		return db
+	}
+
+	//Alice knows how to reach carol through their channel
+	aliceDB := newRegisteredDB()
+	aliceDB.SaveLocalAddress(aliceAddress)
+	aliceDB.addRoutingEntryToDB(&routingEntry{destination: carolAddress, nextHop: carolAddress, capacity: 60000})
+
+	request, err := createTableRequest(genesisBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := processTableRequest(aliceDB, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Bob merges alice's table, the capacity must be capped by his balance towards alice
+	bobDB := newRegisteredDB()
+	bobDB.SaveLocalAddress(bobAddress)
+	err = processTableResponse(response, bobDB, alice.PubKey(), bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := bobDB.getRoutingEntry(carolAddress)
+	if entry == nil {
+		t.Fatal("processTableResponse didn't add a routing entry for carol")
+	}
+	if entry.nextHop != aliceAddress {
+		t.Errorf("processTableResponse wants next hop %v and got %v", aliceAddress, entry.nextHop)
+	}
+	if entry.capacity != 30000 {
+		t.Errorf("processTableResponse wants capacity %v and got %v", 30000, entry.capacity)
+	}
+}
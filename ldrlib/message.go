@@ -4,8 +4,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"log"
-
-	"github.com/jsmvalente/ldRouting/lndwrapper"
 )
 
 const (
@@ -50,8 +48,8 @@ func createForwardRouteMessage(route *Route) ([]byte, error) {
 
 func processForwardRouteMessage(message []byte) (*Route, error) {
 
-	//Check if the response has enough length for it to be valid
-	if len(message) < messageTypeSize+forwardRouteHeaderSize {
+	//Check if the response has the length of a route for it to be valid
+	if !validRouteSize(message[messageTypeSize:]) {
 		return nil, errors.New("Invalid forward message size")
 	}
 
@@ -127,7 +125,8 @@ func processTableRequest(db *DB, request []byte) ([]byte, error) {
 
 	//Get the routing entries to be sent and
 	//transform them into hops so they can be shared with the peer
-	routingEntries := db.getLastRoutingEntries(startingBlock)
+	//Destinations covered by a prefix we also share are left for the peer to match with it
+	routingEntries := db.aggregateRoutingEntries(db.getLastRoutingEntries(startingBlock))
 	entriesCount := len(routingEntries)
 
 	//Serialize routing message count and add it to the response
@@ -146,7 +145,7 @@ func processTableRequest(db *DB, request []byte) ([]byte, error) {
 }
 
 //Processes the response of a previously made table request
-func processTableResponse(response []byte, db *DB, peerPubKey [33]byte, lnClient *lndwrapper.Lnd) error {
+func processTableResponse(response []byte, db *DB, peerPubKey [33]byte, lnClient LightningBackend) error {
 
 	var dest *destination
 	var serializedDest []byte
@@ -168,6 +167,9 @@ func processTableResponse(response []byte, db *DB, peerPubKey [33]byte, lnClient
 	//Extract the number of entries
 	entriesCountBytes := response[2:4]
 	entriesCount := int(binary.BigEndian.Uint16(entriesCountBytes))
+	if len(response) != messageTypeSize+tableResponseHeaderSize+entriesCount*destinationSize {
+		return errors.New("Invalid table response message size")
+	}
 
 	//Extract the entries and add them to the database
 	for n := 0; n < entriesCount; n++ {
@@ -0,0 +1,316 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	//storeMagic identifies a bbolt file as an LDR store
+	storeMagic string = "LDRDB"
+	//latestStoreVersion is the format version written by this client
+	latestStoreVersion uint32 = 4
+)
+
+var (
+	magicKey   = []byte("magic")
+	versionKey = []byte("version")
+)
+
+//migration upgrades the store from the previous format version to version
+//Every migration runs in its own transaction together with the version update
+type migration struct {
+	version     uint32
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+//migrations lists every format upgrade in order, new formats are added at the end
+//Version 0: stores created before the format was versioned, without magic and version
+//Version 1: the magic and version are stored in the meta bucket
+//Version 2: the registrations broadcast by the client are tracked in their own bucket
+//Version 3: the addresses replaced by revocations and transfers are kept to undo them on reorgs
+//Version 4: prefix registrations are stored as longer address records ending with the prefix length
+var migrations = []migration{
+	{version: 1, description: "stamp the store with its magic and format version",
+		migrate: func(tx *bolt.Tx) error { return nil }},
+	{version: 2, description: "track the registrations broadcast by this client",
+		migrate: func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(trackedBucket)
+			return err
+		}},
+	{version: 3, description: "keep the addresses replaced by revocations and transfers",
+		migrate: func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(undoBucket)
+			return err
+		}},
+	{version: 4, description: "store prefix registrations",
+		migrate: func(tx *bolt.Tx) error { return nil }},
+}
+
+//storeVersion returns the format version of the store and if it holds any data
+func storeVersion(tx *bolt.Tx) (uint32, bool, error) {
+
+	meta := tx.Bucket(metaBucket)
+
+	magic := meta.Get(magicKey)
+	if magic == nil {
+		//Unversioned stores always hold a height
+		return 0, meta.Get(heightKey) != nil, nil
+	}
+	if string(magic) != storeMagic {
+		return 0, true, errors.New("Not an LDR DB store")
+	}
+
+	versionBytes := meta.Get(versionKey)
+	if len(versionBytes) != 4 {
+		return 0, true, errors.New("DB store has an invalid format version")
+	}
+
+	return binary.LittleEndian.Uint32(versionBytes), true, nil
+}
+
+//putStoreVersion stamps the store with the magic and version
+func putStoreVersion(tx *bolt.Tx, version uint32) error {
+
+	versionBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(versionBytes, version)
+
+	meta := tx.Bucket(metaBucket)
+	if err := meta.Put(magicKey, []byte(storeMagic)); err != nil {
+		return err
+	}
+	return meta.Put(versionKey, versionBytes)
+}
+
+//initStore runs every migration on a new store and stamps it with the latest format version
+func initStore(tx *bolt.Tx) error {
+
+	for _, m := range migrations {
+		if err := m.migrate(tx); err != nil {
+			return err
+		}
+	}
+
+	return putStoreVersion(tx, latestStoreVersion)
+}
+
+//migrateStore upgrades the store to the latest format version, new stores get every migration at once
+func (db *DB) migrateStore() error {
+
+	var version uint32
+	var initialized bool
+	err := db.store.View(func(tx *bolt.Tx) error {
+		var err error
+		version, initialized, err = storeVersion(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !initialized {
+		return db.store.Update(initStore)
+	}
+	if version > latestStoreVersion {
+		return errors.New("DB store format version " + strconv.FormatUint(uint64(version), 10) +
+			" was written by a newer client")
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		log.Println("Migrating DB store to format version", m.version, "to", m.description)
+		err = db.store.Update(func(tx *bolt.Tx) error {
+			if err := m.migrate(tx); err != nil {
+				return err
+			}
+			return putStoreVersion(tx, m.version)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//MigrateDB imports the flat files of older clients in dataPath and upgrades the store
+//to the latest format version
+func MigrateDB(dataPath string) error {
+
+	db := createDB(dataPath)
+
+	store, err := openStore(dataPath)
+	if err != nil {
+		return err
+	}
+	db.store = store
+	defer db.Close()
+
+	if err = db.importLegacyFiles(); err != nil {
+		return err
+	}
+
+	return db.migrateStore()
+}
+
+//VerifyDB checks the consistency of the store in dataPath and returns the problems found.
+//If repair is set the records causing them are removed
+func VerifyDB(dataPath string, repair bool) ([]string, error) {
+
+	var problems []string
+
+	store, err := openStore(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	verify := func(tx *bolt.Tx) error {
+
+		version, initialized, err := storeVersion(tx)
+		if err != nil {
+			return err
+		}
+		//An empty store has nothing to verify nor the buckets added by the migrations
+		if !initialized {
+			return nil
+		}
+		if version != latestStoreVersion {
+			return errors.New("DB store format version " + strconv.FormatUint(uint64(version), 10) +
+				" has to be migrated first")
+		}
+
+		meta := tx.Bucket(metaBucket)
+		var height uint64
+		if heightBytes := meta.Get(heightKey); len(heightBytes) == blockHeightSerializedSize {
+			height = deserializeBlockHeight(heightBytes)
+		} else {
+			problems = append(problems, "DB height is missing")
+			if repair {
+				if err := meta.Put(heightKey, serializeBlockHeight(genesisBlock)); err != nil {
+					return err
+				}
+			}
+		}
+		if meta.Get(networkKey) == nil {
+			problems = append(problems, "DB network is missing, it will be set by the next client to open it")
+		}
+
+		//Addresses have to be decodable, registered before the DB height and unique per node
+		registered := make(map[[4]byte]bool)
+		nodes := make(map[[33]byte][4]byte)
+		problems = append(problems, verifyBucket(tx.Bucket(addressBucket), repair, func(key, infoBytes []byte) string {
+			if !validAddressInfoSize(len(infoBytes)) || !bytes.Equal(key, infoBytes[0:4]) {
+				return "invalid address record " + fmt.Sprintf("%x", key)
+			}
+			info := deserializeAddressInfo(infoBytes)
+			address := formatAddress(info)
+			if info.prefixLen != 0 && checkPrefix(info.address, info.prefixLen) != nil {
+				return "invalid prefix " + address
+			}
+			if info.registrationHeight > height {
+				return "address " + address + " was registered after the DB height"
+			}
+			if otherAddress, ok := nodes[info.nodePubKey]; ok {
+				return "address " + address + " belongs to the node already registering " + net.IP(otherAddress[:]).String()
+			}
+			registered[info.address] = true
+			nodes[info.nodePubKey] = info.address
+			return ""
+		})...)
+
+		//Routing entries can only lead to registered addresses
+		problems = append(problems, verifyBucket(tx.Bucket(routingBucket), repair, func(key, entryBytes []byte) string {
+			if len(entryBytes) != routingEntrySerializedSize || !bytes.Equal(key, entryBytes[0:4]) {
+				return "invalid routing entry " + fmt.Sprintf("%x", key)
+			}
+			entry := deserializeRoutingEntry(entryBytes)
+			if !registered[entry.destination] || !registered[entry.nextHop] {
+				return "routing entry to " + net.IP(entry.destination[:]).String() + " through " +
+					net.IP(entry.nextHop[:]).String() + " uses an unregistered address"
+			}
+			return ""
+		})...)
+
+		//Only the hashes of the last scanned blocks are kept
+		problems = append(problems, verifyBucket(tx.Bucket(blockHashBucket), repair, func(key, hash []byte) string {
+			if len(key) != 8 || len(hash) != 32 {
+				return "invalid block hash record " + fmt.Sprintf("%x", key)
+			}
+			if blockHeight := binary.BigEndian.Uint64(key); blockHeight > height {
+				return "block " + strconv.FormatUint(blockHeight, 10) + " is above the DB height"
+			}
+			return ""
+		})...)
+
+		//Undo records are only kept for the last scanned blocks
+		problems = append(problems, verifyBucket(tx.Bucket(undoBucket), repair, func(key, infoBytes []byte) string {
+			if len(key) != 12 || !validAddressInfoSize(len(infoBytes)) {
+				return "invalid undo record " + fmt.Sprintf("%x", key)
+			}
+			if blockHeight := binary.BigEndian.Uint64(key[:8]); blockHeight > height {
+				return "undo record of block " + strconv.FormatUint(blockHeight, 10) + " is above the DB height"
+			}
+			return ""
+		})...)
+
+		//Tracked registrations have to be decodable
+		problems = append(problems, verifyBucket(tx.Bucket(trackedBucket), repair, func(key, registrationBytes []byte) string {
+			registration, err := deserializeRegistrationTx(registrationBytes)
+			if err != nil || !bytes.Equal(key, registration.Address[:]) {
+				return "invalid tracked registration " + fmt.Sprintf("%x", key)
+			}
+			return ""
+		})...)
+
+		return nil
+	}
+
+	if repair {
+		err = store.Update(verify)
+	} else {
+		err = store.View(verify)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
+
+//verifyBucket calls check with every record of bucket and returns the problems it reports,
+//removing the records with problems if repair is set
+func verifyBucket(bucket *bolt.Bucket, repair bool, check func(key, value []byte) string) []string {
+
+	var problems []string
+	var invalidKeys [][]byte
+
+	bucket.ForEach(func(key, value []byte) error {
+		if problem := check(key, value); problem != "" {
+			problems = append(problems, problem)
+			invalidKeys = append(invalidKeys, append([]byte{}, key...))
+		}
+		return nil
+	})
+
+	if repair {
+		for _, key := range invalidKeys {
+			if err := bucket.Delete(key); err != nil {
+				problems = append(problems, "couldn't remove "+fmt.Sprintf("%x", key)+": "+err.Error())
+			}
+		}
+	}
+
+	return problems
+}
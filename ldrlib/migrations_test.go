@@ -0,0 +1,146 @@
+package ldrlib
+
+import (
+	"net"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestAddressInfoSerialization(t *testing.T) {
+
+	tests := []addressInfo{
+		{address: [4]byte{10, 0, 0, 1}},
+		{address: [4]byte{255, 255, 255, 255}, nodePubKey: [33]byte{2, 1, 2, 3}, registrationHeight: 1 << 40,
+			registrationTxID: [32]byte{0xaa, 31: 0xbb}, version: 7},
+	}
+
+	for _, info := range tests {
+		t.Run(net.IP(info.address[:]).String(), func(t *testing.T) {
+			decoded := deserializeAddressInfo(serializeAddressInfo(&info))
+			if *decoded != info {
+				t.Errorf("deserializeAddressInfo wants %v and got %v", info, *decoded)
+			}
+		})
+	}
+}
+
+//newTestStore opens a store in a temporary directory and fills it with fill
+func newTestStore(t *testing.T, fill func(tx *bolt.Tx) error) string {
+
+	dataPath := newTestDataPath(t)
+	store, err := openStore(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err = store.Update(fill); err != nil {
+		t.Fatal(err)
+	}
+
+	return dataPath
+}
+
+func TestMigrateDB(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		fill    func(tx *bolt.Tx) error
+		version uint32
+		valid   bool
+	}{
+		{"new store", func(tx *bolt.Tx) error { return nil }, latestStoreVersion, true},
+		{"unversioned store", func(tx *bolt.Tx) error {
+			return tx.Bucket(metaBucket).Put(heightKey, serializeBlockHeight(10))
+		}, latestStoreVersion, true},
+		{"store without prefixes", func(tx *bolt.Tx) error {
+			for _, bucket := range [][]byte{trackedBucket, undoBucket} {
+				if _, err := tx.CreateBucket(bucket); err != nil {
+					return err
+				}
+			}
+			return putStoreVersion(tx, 3)
+		}, latestStoreVersion, true},
+		{"newer store", func(tx *bolt.Tx) error {
+			return putStoreVersion(tx, latestStoreVersion+1)
+		}, latestStoreVersion + 1, false},
+		{"foreign store", func(tx *bolt.Tx) error {
+			return tx.Bucket(metaBucket).Put(magicKey, []byte("BOLT"))
+		}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dataPath := newTestStore(t, test.fill)
+
+			err := MigrateDB(dataPath)
+			if (err == nil) != test.valid {
+				t.Fatalf("MigrateDB wants valid %v and got %v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+
+			store, err := openStore(dataPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			store.View(func(tx *bolt.Tx) error {
+				if version, _, err := storeVersion(tx); err != nil || version != test.version {
+					t.Errorf("migrated store wants version %v and got %v, %v", test.version, version, err)
+				}
+				for _, bucket := range [][]byte{trackedBucket, undoBucket} {
+					if tx.Bucket(bucket) == nil {
+						t.Errorf("migrated store is missing bucket %s", bucket)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestVerifyDB(t *testing.T) {
+
+	alice := &addressInfo{address: [4]byte{10, 0, 0, 1}, nodePubKey: [33]byte{2, 1}, registrationHeight: 5}
+	//Bob registered after the DB height and carol reuses alice's node
+	bob := &addressInfo{address: [4]byte{10, 0, 0, 2}, nodePubKey: [33]byte{2, 2}, registrationHeight: 20}
+	carol := &addressInfo{address: [4]byte{10, 0, 0, 3}, nodePubKey: [33]byte{2, 1}, registrationHeight: 6}
+	toAlice := &routingEntry{destination: alice.address, nextHop: alice.address, capacity: 100}
+	toBob := &routingEntry{destination: bob.address, nextHop: alice.address, capacity: 100}
+
+	dataPath := newTestStore(t, func(tx *bolt.Tx) error {
+		if err := initStore(tx); err != nil {
+			return err
+		}
+		meta := tx.Bucket(metaBucket)
+		meta.Put(heightKey, serializeBlockHeight(10))
+		meta.Put(networkKey, []byte(RegTest.Name))
+		for _, info := range []*addressInfo{alice, bob, carol} {
+			tx.Bucket(addressBucket).Put(info.address[:], serializeAddressInfo(info))
+		}
+		for _, entry := range []*routingEntry{toAlice, toBob} {
+			tx.Bucket(routingBucket).Put(entry.destination[:], serializeRoutingEntry(entry))
+		}
+		tx.Bucket(blockHashBucket).Put(heightToKey(10), make([]byte, 32))
+		return tx.Bucket(blockHashBucket).Put(heightToKey(11), make([]byte, 32))
+	})
+
+	//Bob's and carol's addresses, the entry to bob and block 11
+	problems, err := VerifyDB(dataPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 4 {
+		t.Fatalf("VerifyDB wants %v problems and got %v", 4, problems)
+	}
+
+	if _, err = VerifyDB(dataPath, true); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err = VerifyDB(dataPath, false); err != nil || len(problems) != 0 {
+		t.Errorf("repaired DB still has problems %v, %v", problems, err)
+	}
+}
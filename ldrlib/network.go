@@ -0,0 +1,128 @@
+package ldrlib
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	//DefaultNetwork is the network used when none is chosen
+	DefaultNetwork string = "testnet"
+)
+
+//Network is a bitcoin network LDR can run on
+//Name: the name used by lnd for the network, also used for the data directories
+//Params: the chain parameters used to encode and decode addresses
+//BitcoinRPCPort: the default RPC port of bitcoin core on this network
+//ActivationHeight: the height of the first block that can hold address registrations, 0 on every network
+//until the protocol is deployed at a known height
+type Network struct {
+	Name             string
+	Params           *chaincfg.Params
+	BitcoinRPCPort   int
+	ActivationHeight uint64
+}
+
+//sigNetParams are the parameters of the default signet, btcd doesn't ship them yet.
+//Addresses are encoded like in testnet3
+var sigNetParams = func() chaincfg.Params {
+	params := chaincfg.TestNet3Params
+	params.Name = "signet"
+	params.Net = wire.BitcoinNet(0x40cf030a)
+	params.DefaultPort = "38333"
+	params.DNSSeeds = nil
+	params.Checkpoints = nil
+	params.GenesisHash = newHashFromStr("00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6")
+	return params
+}()
+
+//The networks LDR can run on
+var (
+	MainNet = &Network{Name: "mainnet", Params: &chaincfg.MainNetParams, BitcoinRPCPort: 8332}
+	TestNet = &Network{Name: "testnet", Params: &chaincfg.TestNet3Params, BitcoinRPCPort: 18332}
+	SigNet  = &Network{Name: "signet", Params: &sigNetParams, BitcoinRPCPort: 38332}
+	RegTest = &Network{Name: "regtest", Params: &chaincfg.RegressionNetParams, BitcoinRPCPort: 18443}
+)
+
+var networks = []*Network{MainNet, TestNet, SigNet, RegTest}
+
+//newHashFromStr decodes a hard coded block hash
+func newHashFromStr(hash string) *chainhash.Hash {
+	h, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+//GetNetwork returns the network called name
+func GetNetwork(name string) (*Network, error) {
+
+	for _, network := range networks {
+		if network.Name == name {
+			return network, nil
+		}
+	}
+
+	return nil, errors.New("Unknown network '" + name + "', expected mainnet, testnet, signet or regtest")
+}
+
+//DataPath returns the default directory holding the application's data for the network.
+//Released clients only ran on mainnet and kept their DB straight in .ldRouting/data, mainnet
+//keeps using it unless a DB was already created in the directory of the network
+func (network *Network) DataPath(home string) string {
+
+	legacyPath := path.Join(home, ".ldRouting/data")
+	dataPath := path.Join(legacyPath, network.Name)
+	if network == MainNet && hasDB(legacyPath) && !hasDB(dataPath) {
+		return legacyPath
+	}
+
+	return dataPath
+}
+
+//hasDB returns true if dataPath holds a store or the flat files of older clients
+func hasDB(dataPath string) bool {
+
+	for _, fileName := range []string{storeFileName, addressDBFileName} {
+		if _, err := os.Stat(path.Join(dataPath, fileName)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+//MacaroonPath returns the default path of the lnd admin macaroon for the network
+func (network *Network) MacaroonPath(home string) string {
+	return path.Join(home, ".lnd/data/chain/bitcoin", network.Name, "admin.macaroon")
+}
+
+//VerifyNetwork makes sure the bitcoin and lightning clients run on network
+func VerifyNetwork(bitcoind ChainBackend, lnClient LightningBackend, network *Network) error {
+
+	genesisHash, err := bitcoind.GetBlockHash(genesisBlock)
+	if err != nil {
+		return err
+	}
+	if genesisHash != network.Params.GenesisHash.String() {
+		return errors.New("Bitcoin client isn't running on " + network.Name)
+	}
+
+	info, err := lnClient.GetInfo()
+	if err != nil {
+		return err
+	}
+	for _, chain := range info.Chains {
+		if chain.Chain == "bitcoin" && chain.Network != network.Name {
+			return errors.New("Lightning client is running on " + chain.Network + " instead of " + network.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package ldrlib
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+func TestCheckNetwork(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+
+	//The first network to open the DB stamps it
+	db := ReadDBFromDisk(newTestDataPath(t), TestNet, alice)
+	defer db.Close()
+
+	tests := []struct {
+		network *Network
+		valid   bool
+	}{
+		{TestNet, true},
+		{MainNet, false},
+		{SigNet, false},
+		{RegTest, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.network.Name, func(t *testing.T) {
+			err := db.checkNetwork(test.network)
+			if (err == nil) != test.valid {
+				t.Errorf("checkNetwork of a testnet DB on %v wants valid %v and got %v", test.network.Name, test.valid, err)
+			}
+		})
+	}
+}
+
+func TestGetNetwork(t *testing.T) {
+
+	for _, name := range []string{"mainnet", "testnet", "signet", "regtest"} {
+		network, err := GetNetwork(name)
+		if err != nil || network.Name != name {
+			t.Errorf("GetNetwork(%v) returned %v, %v", name, network, err)
+		}
+	}
+
+	if _, err := GetNetwork("simnet"); err == nil {
+		t.Errorf("GetNetwork accepted an unknown network")
+	}
+}
+
+func TestDataPath(t *testing.T) {
+
+	legacyFile := path.Join(".ldRouting/data", addressDBFileName)
+	mainnetFile := path.Join(".ldRouting/data/mainnet", storeFileName)
+
+	tests := []struct {
+		name    string
+		files   []string
+		network *Network
+		want    string
+	}{
+		{"new install", nil, MainNet, ".ldRouting/data/mainnet"},
+		{"mainnet DB of a released client", []string{legacyFile}, MainNet, ".ldRouting/data"},
+		{"other network", []string{legacyFile}, TestNet, ".ldRouting/data/testnet"},
+		{"DB in the network directory", []string{legacyFile, mainnetFile}, MainNet, ".ldRouting/data/mainnet"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			home := newTestDataPath(t)
+			for _, file := range test.files {
+				if err := os.MkdirAll(path.Join(home, path.Dir(file)), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path.Join(home, file), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if dataPath := test.network.DataPath(home); dataPath != path.Join(home, test.want) {
+				t.Errorf("DataPath wants %v and got %v", path.Join(home, test.want), dataPath)
+			}
+		})
+	}
+}
+
+func TestVerifyNetwork(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+
+	//The fake chain has its own genesis block
+	if err := VerifyNetwork(chainfake.New(), alice, RegTest); err == nil {
+		t.Errorf("VerifyNetwork accepted a bitcoin client on another network")
+	}
+}
@@ -1,14 +1,14 @@
 package ldrlib
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"log"
 	"net"
 	"sync"
 	"time"
 
-	"github.com/jsmvalente/ldRouting/lndwrapper"
+	"github.com/btcsuite/btcd/btcec"
 )
 
 const (
@@ -17,103 +17,183 @@ const (
 
 	//DefaultPort is the default tcp port
 	DefaultPort string = "8695"
+
+	//A host failing maxHandshakeFailures handshakes in a row isn't accepted until handshakeBanDuration after the last one
+	maxHandshakeFailures = 5
+	handshakeBanDuration = 10 * time.Minute
+
+	//maxDestConns is the number of destination connections that can wait for their routes at the same time,
+	//connections whose route doesn't arrive in routeTimeout are closed
+	maxDestConns = 1024
+)
+
+var (
+	//ErrNoSharedChannel is returned by the handshake when the peer doesn't share a channel with the local node
+	ErrNoSharedChannel = errors.New("Peer does not share a channel with the local node")
+	//ErrPeerNotRegistered is returned by the handshake when the peer isn't registered nor a member of a joined VPPN
+	ErrPeerNotRegistered = errors.New("Peer is not registered in the routing protocol")
+	//ErrTooManyHandshakeFailures is returned for connections from a host whose handshakes keep failing
+	ErrTooManyHandshakeFailures = errors.New("Too many failed handshakes from the host")
 )
 
+//HandshakeError is returned when a peer handshake fails, the connection is closed and the daemon keeps running
+//Step: the step of the handshake that failed, one of the acts, the verification of the peer or the init messages
+//PeerPubKey: the identity key of the peer, zero if the accepting side failed before act three
+//Err: why the step failed
+type HandshakeError struct {
+	Step       string
+	PeerPubKey [33]byte
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+
+	peer := "unknown peer"
+	if e.PeerPubKey != [33]byte{} {
+		peer = PubKeyArrayToString(e.PeerPubKey)
+	}
+
+	return "Peer handshake with " + peer + " failed in " + e.Step + ": " + e.Err.Error()
+}
+
+//Unwrap returns the reason of the failure, so it can be matched with errors.Is
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
 type connInfo struct {
 	mutex      sync.Mutex
-	conn       net.Conn
-	sessionKey []byte
-	baseIV     []byte
-	seqNumber  []byte
+	conn       *frameConn
+	sendCipher *cipherState
+	recvCipher *cipherState
+	//sendMutex keeps messages sealed in the order they're written, routes are forwarded outside of mutex
+	sendMutex sync.Mutex
+	//version: the version of the protocol spoken with the peer, agreed in the init messages
+	//features: the features advertised by the peer in its init message
+	version  uint16
+	features featureVector
 }
 
 //ForwardRoute forwards the route to the node identificated by the LDR address
-func ForwardRoute(client *lndwrapper.Lnd, db *DB, route *Route, address [4]byte) {
+func ForwardRoute(client LightningBackend, db *DB, route *Route, address [4]byte) {
 	log.Println("Forwarding route:")
 	PrintRoute(route)
 	connInfo := db.getPeerConn(address)
+	if connInfo == nil {
+		log.Println("No peer connection to", net.IP(address[:]))
+		return
+	}
 	serializedRoute, _ := createForwardRouteMessage(route)
-	nonce := getNonce(connInfo.baseIV, connInfo.seqNumber)
-	encryptedRoute := encryptAES(connInfo.sessionKey, nonce, serializedRoute)
-	encryptedRouteLength := uint16(len(encryptedRoute))
-	encryptedRouteLengthBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(encryptedRouteLengthBytes, encryptedRouteLength)
-	encryptedMessage := append(encryptedRouteLengthBytes, encryptedRoute...)
-	_, err := connInfo.conn.Write(encryptedMessage)
+	err := writePeerMessage(connInfo, serializedRoute)
 	if err != nil {
 		log.Println("Error writing:", err)
 	}
+}
+
+//writePeerMessage encrypts a message with the session cipher of the peer connection and sends it in a frame
+func writePeerMessage(connInfo *connInfo, message []byte) error {
 
-	//Increment seqNumber to be used on the next message
-	incrementSeqNumber(connInfo)
+	connInfo.sendMutex.Lock()
+	defer connInfo.sendMutex.Unlock()
+
+	return connInfo.conn.writeFrame(connInfo.sendCipher.seal(message))
+}
+
+//readPeerMessage reads the next frame of the peer connection and decrypts it. Frames that fail to authenticate,
+//replayed or out of order frames return an error and the connection has to be torn down
+func readPeerMessage(connInfo *connInfo) ([]byte, error) {
+
+	sealedMessage, err := connInfo.conn.readFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	return connInfo.recvCipher.open(sealedMessage)
+}
+
+//closePeerConnection tears down the peer connection and removes it from the DBs it was saved in,
+//which stops the periodic table requests sent over it
+func closePeerConnection(db *DB, connInfo *connInfo, peerPubKey [33]byte) {
+
+	connInfo.conn.Close()
+
+	if address, registered := db.GetNodeAddress(peerPubKey); registered {
+		db.removePeerConnFromDB(address, connInfo)
+	}
+	for _, vppn := range db.memberVPPNs(peerPubKey) {
+		privateAddress, _ := vppn.db.GetNodeAddress(peerPubKey)
+		vppn.db.removePeerConnFromDB(privateAddress, connInfo)
+	}
 }
 
 func sendRouteToSender(db *DB, route *Route) {
-	connInfo := db.getDestConn(route.token)
+	connInfo := db.removeDestConnFromDB(route.token, nil)
+	if connInfo == nil {
+		log.Println("No sender waiting for the route")
+		return
+	}
+	defer connInfo.conn.Close()
 
 	serializedRoute := serializeRoute(route)
 
-	_, err := connInfo.conn.Write(serializedRoute)
+	err := connInfo.conn.writeFrame(serializedRoute)
 	if err != nil {
 		log.Println("Error writing:", err)
 	}
-
-	closeDestConnection(db, route.token)
 }
 
 func closeDestConnection(db *DB, token string) {
-	db.getDestConn(token).conn.Close()
-	db.removeDestConnFromDB(token)
+	if connInfo := db.removeDestConnFromDB(token, nil); connInfo != nil {
+		connInfo.conn.Close()
+	}
 }
 
-//ReceiveRouteFromDestination waits on a connection
-func ReceiveRouteFromDestination(db *DB, token string) *Route {
+//ReceiveRouteFromDestination waits for the destination to send back the route identified by token
+func ReceiveRouteFromDestination(db *DB, token string) (*Route, error) {
 
-	//Read the first part of the header
-	headerBytes := make([]byte, 4+10+8)
-	_, err := db.getDestConn(token).conn.Read(headerBytes)
-	if err != nil {
-		log.Println(err)
+	connInfo := db.getDestConn(token)
+	if connInfo == nil {
+		return nil, errors.New("No connection to the destination")
 	}
+	conn := connInfo.conn
+	conn.readTimeout = routeTimeout
+	routeBytes, err := conn.readFrame()
 
-	//Read the number of hops
-	numberHopsBytes := make([]byte, 2)
-	numberHops := binary.LittleEndian.Uint16(numberHopsBytes)
+	closeDestConnection(db, token)
 
-	//Read the rest of the route
-	hopsBytes := make([]byte, numberHops*4)
-	_, err = db.getDestConn(token).conn.Read(hopsBytes)
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+	if !validRouteSize(routeBytes) {
+		return nil, errors.New("Invalid route size")
 	}
 
-	routeBytes := append(headerBytes, numberHopsBytes...)
-	routeBytes = append(routeBytes, hopsBytes...)
-
-	closeDestConnection(db, token)
-
-	return deserializeRoute(routeBytes)
+	return deserializeRoute(routeBytes), nil
 }
 
 //ConnectToPeersAuto - Connects to peers connects to peers automatically by trying to use
 //their lightning nodes ip addresses
-func ConnectToPeersAuto(client *lndwrapper.Lnd, db *DB) {
+func ConnectToPeersAuto(client LightningBackend, db *DB) {
 
 	var neighborIPs []string
 	var err error
 
-	neighbors := GetLocalNodeNeighboursPubKeys(client)
+	neighbors, err := GetLocalNodeNeighboursPubKeys(client)
+	if err != nil {
+		log.Println("Couldn't get the local channels:", err)
+		return
+	}
 
 	// Get IP for each neighbor
 	for _, neighbor := range neighbors {
 
-		// Check if node is registered in the protocol
-		if db.IsNodeRegistered(neighbor) {
+		// Check if node is registered in the protocol or shares a VPPN with us
+		if db.IsNodeRegistered(neighbor) || len(db.memberVPPNs(neighbor)) > 0 {
 			//If it is we get the IP's for this node and try and connect to it
 			neighborIPs = GetNodeIPs(client, neighbor)
 			for _, ipAddress := range neighborIPs {
 				log.Println("Trying to connect to", PubKeyArrayToString(neighbor), "@", neighborIPs[0]+DefaultPort)
-				err = ConnectToPeer(client, db, ipAddress+":"+DefaultPort)
+				err = ConnectToPeer(client, db, neighbor, ipAddress+":"+DefaultPort)
 				if err != nil {
 					log.Println(err)
 				} else {
@@ -124,32 +204,50 @@ func ConnectToPeersAuto(client *lndwrapper.Lnd, db *DB) {
 	}
 }
 
-//ConnectToPeer connects to a peer
-func ConnectToPeer(client *lndwrapper.Lnd, db *DB, ipAddress string) error {
-	conn, err := net.Dial("tcp", ipAddress)
+//ConnectToPeer connects to the peer identified by the lightning node key peerPubKey using the provided IP
+func ConnectToPeer(client LightningBackend, db *DB, peerPubKey [33]byte, ipAddress string) error {
+	netConn, err := net.Dial("tcp", ipAddress)
 	if err != nil {
 		return err
 	}
-	writeConnectionType(conn, peerConn)
+	conn := newFrameConn(netConn)
+	conn.deadline = time.Now().Add(handshakeTimeout)
+	if err = writeConnectionType(conn, peerConn); err != nil {
+		conn.Close()
+		return err
+	}
 	log.Println("Connected to:" + conn.RemoteAddr().String())
-	sessionKey, baseIV, startSeq, peerLightningKey := offerPeerHandshake(conn, client, db)
+	peerConnInfo, err := offerPeerHandshake(conn, client, db, peerPubKey)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.deadline = time.Time{}
 	log.Println("Peer Handshake successful")
 
-	go handlePeerConnection(conn, client, db, sessionKey, baseIV, startSeq, peerLightningKey)
+	go handlePeerConnection(peerConnInfo, client, db, peerPubKey)
 
 	return nil
 }
 
 //ConnectToDestinationAuto connects to a destination node using its IP
-func ConnectToDestinationAuto(client *lndwrapper.Lnd, db *DB, address [4]byte, routeToken string) {
+func ConnectToDestinationAuto(client LightningBackend, db *DB, address [4]byte, routeToken string) {
 
-	var err error
-
-	if !db.IsAddressRegistered(address) {
+	//Addresses inside a prefix are served by the node owning it
+	destinationInfo := db.resolveAddress(address)
+	if destinationInfo == nil {
 		log.Println("Trying to connect to unregistered address", address)
 		return
 	}
-	destinationPubKey := db.GetAddressNode(address)
+
+	connectToDestinationNode(client, db, destinationInfo.nodePubKey, address, routeToken)
+}
+
+//connectToDestinationNode connects to the node serving address using its lightning node IPs
+func connectToDestinationNode(client LightningBackend, db *DB, destinationPubKey [33]byte, address [4]byte, routeToken string) {
+
+	var err error
+
 	neighborIPs := GetNodeIPs(client, destinationPubKey)
 
 	for _, ipAddress := range neighborIPs {
@@ -164,237 +262,294 @@ func ConnectToDestinationAuto(client *lndwrapper.Lnd, db *DB, address [4]byte, r
 }
 
 //ConnectToDestination connects to a destination node using the provided IP
-func ConnectToDestination(client *lndwrapper.Lnd, db *DB, address [4]byte, ipAddress string, routeToken string) error {
-	conn, err := net.Dial("tcp", ipAddress)
+func ConnectToDestination(client LightningBackend, db *DB, address [4]byte, ipAddress string, routeToken string) error {
+	netConn, err := net.Dial("tcp", ipAddress)
 	if err != nil {
 		return err
 	}
-	writeConnectionType(conn, destinationConn)
+	conn := newFrameConn(netConn)
+	if err = writeConnectionType(conn, destinationConn); err != nil {
+		conn.Close()
+		return err
+	}
 	log.Println("Connected to:" + conn.RemoteAddr().String())
 
 	//Send code for route request
-	routeTokenBytes := []byte(routeToken)
-	_, err = conn.Write(routeTokenBytes)
+	err = conn.writeFrame([]byte(routeToken))
+	if err == nil {
+		err = db.addDestConnToDB(routeToken, &connInfo{conn: conn})
+	}
 	if err != nil {
+		conn.Close()
 		return err
 	}
-	db.addDestConnToDB(routeToken, &connInfo{conn: conn})
 
 	return nil
 }
 
 //ListenForConnections listens to new nodes that want to connect and accepts them
-func ListenForConnections(lnClient *lndwrapper.Lnd, port string, db *DB) {
+func ListenForConnections(lnClient LightningBackend, port string, db *DB) {
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Println(err)
+		return
 	}
 
 	log.Println("Listening on port", port)
 
 	for {
-		conn, err := ln.Accept()
+		netConn, err := ln.Accept()
 		if err != nil {
 			log.Println(err)
 		} else {
-			log.Println("Accepted new connection from:" + conn.RemoteAddr().String())
+			log.Println("Accepted new connection from:" + netConn.RemoteAddr().String())
 
-			connType := readConnectionType(conn)
+			//A slow or misbehaving connection doesn't hold the others back
+			go acceptConnection(lnClient, db, newFrameConn(netConn))
+		}
+	}
+}
 
-			if connType == peerConn {
+//acceptConnection reads the type of a new connection and sets it up, closing it on any failure
+func acceptConnection(lnClient LightningBackend, db *DB, conn *frameConn) {
 
-				log.Println("Peer Connection, accepting handshake...")
-				sessionKey, baseIV, startSeq, lightningPeerPubKey := acceptPeerHandshake(conn, lnClient, db)
-				log.Println("Peer Handshake successful")
+	host := remoteHost(conn)
+	if db.handshakeBanned(host) {
+		log.Println("Rejecting connection from", host+":", ErrTooManyHandshakeFailures)
+		conn.Close()
+		return
+	}
 
-				//Handle the connection
-				go handlePeerConnection(conn, lnClient, db, sessionKey, baseIV, startSeq, lightningPeerPubKey)
+	//The connection type and the whole handshake have to arrive in time
+	conn.deadline = time.Now().Add(handshakeTimeout)
+	connType, err := readConnectionType(conn)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
 
-			} else if connType == destinationConn {
-				//Read connecting token and save connection in the Database
-				routeTokenBytes := make([]byte, 10)
-				_, err = conn.Read(routeTokenBytes)
-				if err != nil {
-					log.Println(err)
-				}
-				routeToken := string(routeTokenBytes)
-				db.addDestConnToDB(routeToken, &connInfo{conn: conn})
-			} else {
-				log.Println("Unknown connection type")
-			}
+	if connType == peerConn {
 
+		log.Println("Peer Connection, accepting handshake...")
+		peerConnInfo, lightningPeerPubKey, err := acceptPeerHandshake(conn, lnClient, db)
+		if err != nil {
+			conn.Close()
+			db.recordHandshakeFailure(host, err)
+			return
+		}
+		db.clearHandshakeFailures(host)
+		conn.deadline = time.Time{}
+		log.Println("Peer Handshake successful")
+
+		//Handle the connection
+		handlePeerConnection(peerConnInfo, lnClient, db, lightningPeerPubKey)
+
+	} else if connType == destinationConn {
+		//Read connecting token and save connection in the Database
+		routeTokenBytes, err := conn.readFrame()
+		if err != nil || len(routeTokenBytes) != routeTokenSize {
+			log.Println("Invalid route token:", err)
+			conn.Close()
+			return
+		}
+		conn.deadline = time.Time{}
+		routeToken := string(routeTokenBytes)
+		destConnInfo := &connInfo{conn: conn}
+		if err = db.addDestConnToDB(routeToken, destConnInfo); err != nil {
+			log.Println(err)
+			conn.Close()
+			return
 		}
+
+		//Tokens whose route never arrives don't keep their connection open
+		time.AfterFunc(routeTimeout, func() {
+			if db.removeDestConnFromDB(routeToken, destConnInfo) != nil {
+				log.Println("No route arrived for a destination connection, closing it")
+				conn.Close()
+			}
+		})
+	} else {
+		log.Println("Unknown connection type")
+		conn.Close()
 	}
 }
 
-func readConnectionType(conn net.Conn) int8 {
+//remoteHost returns the IP of the other end of the connection, which failures of inbound handshakes are recorded by.
+//Failures of our own handshakes aren't, they'd get the peer refused when it connects to us
+func remoteHost(conn net.Conn) string {
 
-	var connType int8
-	err := binary.Read(conn, binary.LittleEndian, &connType)
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
-		log.Println(err)
+		return conn.RemoteAddr().String()
 	}
 
-	return connType
+	return host
 }
 
-func writeConnectionType(conn net.Conn, connType int8) {
-	err := binary.Write(conn, binary.LittleEndian, connType)
-	if err != nil {
-		log.Println(err)
-	}
-}
+func readConnectionType(conn *frameConn) (int8, error) {
 
-func offerDestinationHandshake(conn net.Conn, client *lndwrapper.Lnd, addressDB *DB) ([]byte, []byte) {
+	connTypeBytes := make([]byte, 1)
+	err := conn.readFull(connTypeBytes)
 
-	//Create new RSA public key that will be used to encrypt the eoute data
-	privKey, pubKey := generateRSAKeyPair()
+	return int8(connTypeBytes[0]), err
+}
 
-	return privKey, pubKey
+func writeConnectionType(conn *frameConn, connType int8) error {
+	return conn.writeAll([]byte{byte(connType)})
 }
 
-func acceptDestinationHandshake(conn net.Conn, client *lndwrapper.Lnd, addressDB *DB) {
+func acceptDestinationHandshake(conn net.Conn, client LightningBackend, addressDB *DB) {
 
 }
 
-func offerPeerHandshake(conn net.Conn, client *lndwrapper.Lnd, addressDB *DB) ([]byte, []byte, []byte, [33]byte) {
-
-	//Create new RSA public key that will be used to encrypt the
-	//simmetrical AES key
-	privKey, pubKey := generateRSAKeyPair()
+//offerPeerHandshake runs the initiator side of the handshake with the node identified by peerPubKey and returns
+//the ciphers of the session. Failures are returned as a *HandshakeError
+func offerPeerHandshake(conn *frameConn, client LightningBackend, addressDB *DB, peerPubKey [33]byte) (*connInfo, error) {
 
-	//The public key is signed by the lighting node
-	pubKeySignature := SignMessage(client, pubKey)
-	log.Println("pubKeySignature size: ", len(pubKeySignature))
+	remoteStatic, err := btcec.ParsePubKey(peerPubKey[:], btcec.S256())
+	if err != nil {
+		return nil, &HandshakeError{Step: "act one", PeerPubKey: peerPubKey, Err: err}
+	}
+	handshake, err := newHandshakeState(client, true, remoteStatic)
+	if err != nil {
+		return nil, &HandshakeError{Step: "act one", PeerPubKey: peerPubKey, Err: err}
+	}
 
-	//The public key and signature are sent to the peer
-	log.Println("Sending pubkey + pubKeySignature")
-	pubKeyAndSignature := append(pubKey, pubKeySignature...)
-	_, err := conn.Write(pubKeyAndSignature)
+	//Act one proves we know who we are talking to
+	log.Println("Sending handshake act one to", PubKeyArrayToString(peerPubKey))
+	actOne, err := handshake.actOne()
+	if err == nil {
+		err = conn.writeFrame(actOne)
+	}
 	if err != nil {
-		log.Println("Error writing:", err)
+		return nil, &HandshakeError{Step: "act one", PeerPubKey: peerPubKey, Err: err}
 	}
 
-	//Read the 65 byte signature sent by the peer
-	log.Println("Reading public key + signature")
-	peerPubKeyAndSignature := make([]byte, RSAKeySize+SignatureSize)
-	_, err = conn.Read(peerPubKeyAndSignature)
+	//Act two can only be answered by the owner of the identity key
+	log.Println("Reading handshake act two")
+	actTwo, err := conn.readFrame()
+	if err == nil {
+		err = handshake.receiveActTwo(actTwo)
+	}
 	if err != nil {
-		log.Println(err)
+		return nil, &HandshakeError{Step: "act two", PeerPubKey: peerPubKey, Err: err}
 	}
 
-	peerPubKey := peerPubKeyAndSignature[:RSAKeySize]
-	peerPubKeySignature := peerPubKeyAndSignature[RSAKeySize:]
+	//Act three reveals our identity key to the peer
+	actThree, err := handshake.actThree()
+	if err == nil {
+		err = conn.writeFrame(actThree)
+	}
+	if err != nil {
+		return nil, &HandshakeError{Step: "act three", PeerPubKey: peerPubKey, Err: err}
+	}
 
-	//Verify the signature
-	//Since this VerifyMessage implementation uses message verification by the lighting node
-	//it also ensures the active node in the resident node's channel database
-	verified, peerLightningPubKey := VerifyMessage(client, peerPubKey, peerPubKeySignature)
+	if err = verifyPeer(client, addressDB, peerPubKey); err != nil {
+		return nil, &HandshakeError{Step: "verification", PeerPubKey: peerPubKey, Err: err}
+	}
 
-	if !verified {
-		log.Fatalln("Failed when verifying peer's signature.")
+	sendCipher, recvCipher := handshake.split()
+	peerConnInfo := &connInfo{conn: conn, sendCipher: sendCipher, recvCipher: recvCipher}
+	if err = exchangeInitMessages(peerConnInfo, true); err != nil {
+		return nil, &HandshakeError{Step: "init", PeerPubKey: peerPubKey, Err: err}
 	}
 
-	log.Println("Verified signature with", PubKeyArrayToString(peerLightningPubKey))
+	return peerConnInfo, nil
+}
 
-	//Verify that the peer node shares a channel with the local node
-	neighbors := GetLocalNodeNeighboursPubKeys(client)
-	sharesChannelFlag := false
-	for _, neighbor := range neighbors {
-		if neighbor == peerLightningPubKey {
-			sharesChannelFlag = true
-			break
-		}
-	}
-	if !sharesChannelFlag {
-		log.Fatalln("Peer does not share a channel with the local node.")
-	}
+//acceptPeerHandshake runs the responder side of the handshake and returns the ciphers of the session and
+//the identity key of the peer. Failures are returned as a *HandshakeError
+func acceptPeerHandshake(conn *frameConn, client LightningBackend, db *DB) (*connInfo, [33]byte, error) {
 
-	//Verify that the peer node is also registered in the routing protocol
-	if !addressDB.IsNodeRegistered(peerLightningPubKey) {
-		log.Fatalln("Peer is not registered in the routing protocol.")
-	}
+	var peerPubKey [33]byte
 
-	//Create an AES session key, nonce base IV and start seq number.
-	//appending them and encrypting it using the peer's RSA pub key
-	log.Println("Creating AES session info.")
-	aesKey, err := createAESKey()
+	handshake, err := newHandshakeState(client, false, nil)
 	if err != nil {
-		log.Println(err)
+		return nil, peerPubKey, &HandshakeError{Step: "act one", Err: err}
 	}
-	baseIV, err := generateNRandomBytes(AESBaseIVSize)
-	if err != nil {
-		log.Println(err)
+
+	log.Println("Reading handshake act one")
+	actOne, err := conn.readFrame()
+	if err == nil {
+		err = handshake.receiveActOne(actOne)
 	}
-	startSeq, err := generateNRandomBytes(AESStartSeqSize)
 	if err != nil {
-		log.Println(err)
+		return nil, peerPubKey, &HandshakeError{Step: "act one", Err: err}
 	}
-	nonceInfo := append(baseIV, startSeq...)
-	aesInfo := append(aesKey, nonceInfo...)
-	log.Println("Key:", aesKey)
-	log.Println("baseIV:", baseIV)
-	log.Println("startSeq:", startSeq)
-	log.Println("Encrypting AES info with RSA key.")
-
-	encryptedAESInfo := encryptRSA(peerPubKey, aesInfo)
 
-	//Send the encryted AES session key to the peer
-	log.Println("Sharing session key, base IV and starting sequence number with " + PubKeyArrayToString(peerLightningPubKey))
-	_, err = conn.Write(encryptedAESInfo)
-	if err != nil {
-		log.Println("Error writing:", err)
+	actTwo, err := handshake.actTwo()
+	if err == nil {
+		err = conn.writeFrame(actTwo)
 	}
-
-	//The peer sends back the AES Key as an ACK
-	log.Println("Reading AES encrypted Info from peer")
-	encryptedAESInfoMessage := make([]byte, RSAEncryptionSize)
-	_, err = conn.Read(encryptedAESInfoMessage)
 	if err != nil {
-		log.Println(err)
+		return nil, peerPubKey, &HandshakeError{Step: "act two", Err: err}
 	}
 
-	log.Println("Decrypting AES key with RSA privkey.")
-	aesInfoMessage := decryptRSA(privKey, encryptedAESInfoMessage)
+	log.Println("Reading handshake act three")
+	actThree, err := conn.readFrame()
+	if err == nil {
+		err = handshake.receiveActThree(actThree)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, peerPubKey, &HandshakeError{Step: "act three", Err: err}
 	}
-	log.Println("Decrypted:", aesInfoMessage)
-	log.Println("Should be:", aesInfo)
-	if bytes.Compare(aesInfo, aesInfoMessage) != 0 {
-		log.Fatal("Error reading AES ACK from peer")
+	copy(peerPubKey[:], handshake.remoteStatic.SerializeCompressed())
+
+	if err = verifyPeer(client, db, peerPubKey); err != nil {
+		return nil, peerPubKey, &HandshakeError{Step: "verification", PeerPubKey: peerPubKey, Err: err}
 	}
 
-	return aesKey, baseIV, startSeq, peerLightningPubKey
+	sendCipher, recvCipher := handshake.split()
+	peerConnInfo := &connInfo{conn: conn, sendCipher: sendCipher, recvCipher: recvCipher}
+	if err = exchangeInitMessages(peerConnInfo, false); err != nil {
+		return nil, peerPubKey, &HandshakeError{Step: "init", PeerPubKey: peerPubKey, Err: err}
+	}
 
+	return peerConnInfo, peerPubKey, nil
 }
 
-func acceptPeerHandshake(conn net.Conn, client *lndwrapper.Lnd, db *DB) ([]byte, []byte, []byte, [33]byte) {
+//exchangeInitMessages sends the version and features of the local node to the peer and reads the peer's,
+//the initiator of the handshake sends its init message first
+func exchangeInitMessages(peerConnInfo *connInfo, initiator bool) error {
 
-	//Read the 65 byte signature sent by the peer
-	log.Println("Reading public key signature")
-	peerPubKeyAndSignature := make([]byte, RSAKeySize+SignatureSize)
-	_, err := conn.Read(peerPubKeyAndSignature)
+	var err error
+	var message []byte
+
+	if initiator {
+		err = writePeerMessage(peerConnInfo, createInitMessage(protocolVersion, localFeatures))
+		if err != nil {
+			return err
+		}
+	}
+
+	message, err = readPeerMessage(peerConnInfo)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
+	peerConnInfo.version, peerConnInfo.features, err = processInitMessage(message)
+	if err != nil {
+		return err
+	}
+	log.Println("Peer speaks version", peerConnInfo.version, "with features", peerConnInfo.features)
 
-	peerPubKey := peerPubKeyAndSignature[:RSAKeySize]
-	peerPubKeySignature := peerPubKeyAndSignature[RSAKeySize:]
+	if !initiator {
+		return writePeerMessage(peerConnInfo, createInitMessage(protocolVersion, localFeatures))
+	}
 
-	//Verify the signature
-	//Since this VerifyMessage implementation uses message verification by the lighting node
-	//it also ensures the active node in the resident node's channel database
-	verified, peerLightningPubKey := VerifyMessage(client, peerPubKey, peerPubKeySignature)
+	return nil
+}
 
-	if !verified {
-		log.Fatalln("Failed when verifying peer's signature.")
-	}
+//verifyPeer checks that the authenticated peer can take part in routing with the local node
+func verifyPeer(client LightningBackend, db *DB, peerLightningPubKey [33]byte) error {
 
-	log.Println("Verified signature with", PubKeyArrayToString(peerLightningPubKey))
+	log.Println("Authenticated", PubKeyArrayToString(peerLightningPubKey))
 
 	//Verify that the peer node shares a channel with the local node
-	neighbors := GetLocalNodeNeighboursPubKeys(client)
+	neighbors, err := GetLocalNodeNeighboursPubKeys(client)
+	if err != nil {
+		return err
+	}
 	sharesChannelFlag := false
 	for _, neighbor := range neighbors {
 		if neighbor == peerLightningPubKey {
@@ -403,112 +558,69 @@ func acceptPeerHandshake(conn net.Conn, client *lndwrapper.Lnd, db *DB) ([]byte,
 		}
 	}
 	if !sharesChannelFlag {
-		log.Fatalln("Peer does not share a channel with the local node.")
-	}
-	//Verify that the peer node is also registered in the routing protocol
-	if !db.IsNodeRegistered(peerLightningPubKey) {
-		log.Fatalln("Peer's is not registered in the routing protocol.")
-	}
-
-	//Create new RSA public key that will be used to encrypt the
-	//simmetrical AES key ACK
-	privKey, pubKey := generateRSAKeyPair()
-
-	//The public key is signed by the lighting node
-	pubKeySignature := SignMessage(client, pubKey)
-
-	//The public key is sent to the peer
-	log.Println("Sending pubkey + pubKeySignature")
-	pubKeyAndSignature := append(pubKey, pubKeySignature...)
-	_, err = conn.Write(pubKeyAndSignature)
-	if err != nil {
-		log.Println("Error writing:", err)
+		return ErrNoSharedChannel
 	}
 
-	//Read AES session key sent by the peer
-	encryptedAESInfoMessage := make([]byte, 256)
-	log.Println("Reading AES Info from peer")
-	_, err = conn.Read(encryptedAESInfoMessage)
-	if err != nil {
-		log.Println(err)
+	//Verify that the peer node is also registered in the routing protocol, or a member of a VPPN we joined
+	if !db.IsNodeRegistered(peerLightningPubKey) && len(db.memberVPPNs(peerLightningPubKey)) == 0 {
+		return ErrPeerNotRegistered
 	}
 
-	log.Println("Decrypting AES info with RSA privkey")
-	aesInfo := decryptRSA(privKey, encryptedAESInfoMessage)
-	aesKey := aesInfo[:AESKeySize]
-	baseIV := aesInfo[AESKeySize : AESKeySize+AESBaseIVSize]
-	startSeq := aesInfo[AESKeySize+AESBaseIVSize : AESKeySize+AESBaseIVSize+AESStartSeqSize]
-	log.Println("Key:", aesKey)
-	log.Println("baseIV:", baseIV)
-	log.Println("startSeq:", startSeq)
-
-	//Send the encryted AES session key to the peer
-	log.Println("Encrypting AES key with RSA pubkey")
-	encryptedAESKey := encryptRSA(peerPubKey, aesKey)
-	log.Println("Sending AES session key (ACK):", aesKey)
-	_, err = conn.Write(encryptedAESKey)
-	if err != nil {
-		log.Println("Error writing:", err)
-	}
-
-	return aesKey, baseIV, startSeq, peerLightningPubKey
+	return nil
 }
 
-func handlePeerConnection(conn net.Conn, lnClient *lndwrapper.Lnd, db *DB, sessionKey []byte, baseIV []byte, startSeq []byte, peerPubKey [33]byte) {
+func handlePeerConnection(peerConnInfo *connInfo, lnClient LightningBackend, db *DB, peerPubKey [33]byte) {
 
 	var err error
-	var encryptedMessageLength uint16
-	var encryptedMessageLengthBytes []byte
-	var encryptedMessage []byte
 	var message []byte
 	var messageTypeBytes []byte
 	var messageType uint16
-	var nonce []byte
 	var response []byte
-	var encryptedResponse []byte
-	var encryptedResponseLength uint16
-	var encryptedResponseLengthBytes []byte
-	var encryptedMessageResponse []byte
 	var route *Route
 
+	//Peers send table requests periodically, a connection without frames for longer is dead
+	defer closePeerConnection(db, peerConnInfo, peerPubKey)
+	peerConnInfo.conn.readTimeout = peerIdleTimeout
+
 	//Save the connection in memory
-	peerConnInfo := &connInfo{conn: conn, sessionKey: sessionKey, baseIV: baseIV, seqNumber: startSeq}
-	address, _ := db.GetNodeAddress(peerPubKey)
-	db.addPeerConnToDB(address, peerConnInfo)
+	address, registered := db.GetNodeAddress(peerPubKey)
+	if registered {
+		db.addPeerConnToDB(address, peerConnInfo)
 
-	//Start sending periodic table requests for this peer
-	log.Println("Setting up periodic table requests")
-	go sendTableRequestPeriodically(db, address)
+		//Start sending periodic table requests for this peer
+		log.Println("Setting up periodic table requests")
+		go sendTableRequestPeriodically(db, address)
+	}
+
+	//Members of the VPPNs we joined exchange their private tables over the same connection
+	for _, vppn := range db.memberVPPNs(peerPubKey) {
+		if !peerConnInfo.features.supports(vppnFeatureOptional) {
+			log.Println("Peer is a member of", vppn.Name, "but doesn't support VPPNs")
+			break
+		}
+		privateAddress, _ := vppn.db.GetNodeAddress(peerPubKey)
+		vppn.db.addPeerConnToDB(privateAddress, peerConnInfo)
+		log.Println("Setting up periodic", vppn.Name, "table requests")
+		go vppn.sendTableRequestPeriodically(privateAddress)
+	}
 
 	//Treat received messages for this connectin in a loop
 	for {
-		//Read the length of the encrypted message in the buffer
-		encryptedMessageLengthBytes = make([]byte, 2)
-		_, err = conn.Read(encryptedMessageLengthBytes)
+		//Read and decrypt the next frame, a single frame failing to authenticate ends the connection
+		message, err = readPeerMessage(peerConnInfo)
 		if err != nil {
-			log.Println(err)
+			log.Println("Closing connection with", PubKeyArrayToString(peerPubKey)+":", err)
 			return
 		}
-		encryptedMessageLength = binary.BigEndian.Uint16(encryptedMessageLengthBytes)
 
-		//Read the encryped data
-		encryptedMessage = make([]byte, encryptedMessageLength)
-		_, err = conn.Read(encryptedMessage)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		//Lock the thread so we use the right seq number
+		//Lock the connection so our response isn't interleaved with other messages
 		peerConnInfo.mutex.Lock()
 
-		log.Println("Got a new message, decrypting it with seq number", peerConnInfo.seqNumber)
-		//Get the decrypted message bytes
-		nonce = getNonce(baseIV, peerConnInfo.seqNumber)
-		message = decryptAES(sessionKey, nonce, encryptedMessage)
-		log.Println("Message decrypted")
-
-		//Increment seqNumber to be used on the next message
-		incrementSeqNumber(peerConnInfo)
+		if len(message) < messageTypeSize {
+			log.Println("Invalid message size")
+			peerConnInfo.mutex.Unlock()
+			return
+		}
 
 		//Extract the type of message
 		messageTypeBytes = message[:2]
@@ -516,11 +628,37 @@ func handlePeerConnection(conn net.Conn, lnClient *lndwrapper.Lnd, db *DB, sessi
 
 		//Act according to the type of message
 		//Requests will generate responses and responses will be processed
-		if messageType == tableRequestType {
+		//It's OK to be odd: messages of unknown odd types are ignored and unknown even types end the connection
+		if !isKnownMessageType(messageType) && messageType%2 == 1 {
+			log.Println("Ignoring message of unknown odd type", messageType)
+
+		} else if !isKnownMessageType(messageType) || messageType == initMessageType {
+			log.Println("Invalid message type", messageType)
+			peerConnInfo.mutex.Unlock()
+			return
+
+		} else if messageType == overlayMessageType {
+			//Messages for VPPNs we can't process are dropped, the public routing keeps going
+			//unless the peer requires an overlay message type we don't know
+			response, err = processOverlayMessage(db, message, peerPubKey, lnClient)
+			if err == errUnknownEvenOverlayType {
+				log.Println(err)
+				peerConnInfo.mutex.Unlock()
+				return
+			}
+			if err != nil {
+				log.Println(err)
+			}
+
+		} else if !registered {
+			log.Println("Dropping message from peer that is only a VPPN member")
+
+		} else if messageType == tableRequestType {
 			log.Println("New Table Request")
 			response, err = processTableRequest(db, message)
 			if err != nil {
 				log.Println(err)
+				peerConnInfo.mutex.Unlock()
 				return
 			}
 
@@ -529,6 +667,7 @@ func handlePeerConnection(conn net.Conn, lnClient *lndwrapper.Lnd, db *DB, sessi
 			err = processTableResponse(message, db, peerPubKey, lnClient)
 			if err != nil {
 				log.Println(err)
+				peerConnInfo.mutex.Unlock()
 				return
 			}
 
@@ -537,42 +676,30 @@ func handlePeerConnection(conn net.Conn, lnClient *lndwrapper.Lnd, db *DB, sessi
 			route, err = processForwardRouteMessage(message)
 			if err != nil {
 				log.Println(err)
-			}
-
-			if route.destination == db.getLocalAddress() {
+			} else if db.isLocalDestination(route.destination) {
 				log.Println("Destination is local node. Sending route to sender.")
 				sendRouteToSender(db, route)
 			} else {
 				//Add the first hop to the route and send forward the request through the network
+				//Don't forward a route the local node can't add itself to
 				localHop, err := addHopToRoute(lnClient, db, route)
 				if err != nil {
 					log.Println(err)
+				} else {
+					ForwardRoute(lnClient, db, route, localHop)
 				}
-				ForwardRoute(lnClient, db, route, localHop)
 			}
 
-		} else {
-			log.Println("Invalid message type")
-			return
 		}
 
 		//If there is a response to the message the peer sent we send it
 		if response != nil {
 			//Encrypt and send the response preceded by its length
-			nonce = getNonce(baseIV, peerConnInfo.seqNumber)
-			encryptedResponse = encryptAES(sessionKey, nonce, response)
-			encryptedResponseLength = uint16(len(encryptedResponse))
-			encryptedResponseLengthBytes = make([]byte, 2)
-			binary.BigEndian.PutUint16(encryptedResponseLengthBytes, encryptedResponseLength)
-			encryptedMessageResponse = append(encryptedResponseLengthBytes, encryptedResponse...)
-			_, err = conn.Write(encryptedMessageResponse)
+			log.Println("Sending response")
+			err = writePeerMessage(peerConnInfo, response)
 			if err != nil {
 				log.Println("Error writing:", err)
 			}
-			log.Println("Sent response using seq number", peerConnInfo.seqNumber)
-
-			//Increment seqNumber to be used on the next message
-			incrementSeqNumber(peerConnInfo)
 			//Reset the response variable
 			response = nil
 		}
@@ -586,11 +713,6 @@ func sendTableRequestPeriodically(db *DB, address [4]byte) {
 
 	var request []byte
 	var err error
-	var nonce []byte
-	var encryptedRequest []byte
-	var encryptedRequestLength uint16
-	var encryptedRequestLengthBytes []byte
-	var encryptedMessage []byte
 	connInfo := db.getPeerConn(address)
 
 	for {
@@ -603,24 +725,19 @@ func sendTableRequestPeriodically(db *DB, address [4]byte) {
 		//Lock the thread using the corresponding mutex
 		connInfo.mutex.Lock()
 		log.Println("Sending new table request...")
-		//Encrypt and send the response preceded by its length
-		nonce = getNonce(connInfo.baseIV, connInfo.seqNumber)
-		encryptedRequest = encryptAES(connInfo.sessionKey, nonce, request)
-		encryptedRequestLength = uint16(len(encryptedRequest))
-		encryptedRequestLengthBytes = make([]byte, 2)
-		binary.BigEndian.PutUint16(encryptedRequestLengthBytes, encryptedRequestLength)
-		encryptedMessage = append(encryptedRequestLengthBytes, encryptedRequest...)
-		_, err = connInfo.conn.Write(encryptedMessage)
-		if err != nil {
-			log.Println("Error writing:", err)
-		}
-		log.Println("Sent create table request", address, "using seq number", connInfo.seqNumber)
-		//Increment seqNumber to be used on the next message
-		incrementSeqNumber(connInfo)
+		//Encrypt and send the request preceded by its length
+		log.Println("Sending create table request", address)
+		err = writePeerMessage(connInfo, request)
 
 		//Unlock the thread using the corresponding mutex
 		connInfo.mutex.Unlock()
 
+		//The connection was torn down
+		if err != nil {
+			log.Println("Error writing:", err)
+			return
+		}
+
 		//WAit 10 minutes before sending the next table request
 		time.Sleep(5 * time.Minute)
 	}
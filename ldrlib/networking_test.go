@@ -0,0 +1,303 @@
+package ldrlib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jsmvalente/ldRouting/lndfake"
+	"github.com/jsmvalente/ldRouting/lndwrapper"
+)
+
+var errChannelsUnavailable = errors.New("channels unavailable")
+
+//unavailableChannelsNode is a node whose lnd fails to list its channels
+type unavailableChannelsNode struct {
+	*lndfake.Node
+}
+
+func (n unavailableChannelsNode) ListChannels() (*lndwrapper.ListChannelsResponse, error) {
+	return nil, errChannelsUnavailable
+}
+
+func TestPeerHandshake(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	carol := newTestNode(t, graph, "carol")
+	dave := newTestNode(t, graph, "dave")
+	graph.OpenChannel(alice, bob, 100000, 50000)
+	graph.OpenChannel(alice, dave, 100000, 50000)
+
+	//dave isn't registered
+	newRegisteredDB := func() *DB {
+		db := createDB("")
+		db.addAddressToDB(&addressInfo{address: [4]byte{0, 0, 0, 1}, nodePubKey: alice.PubKey()})
+		db.addAddressToDB(&addressInfo{address: [4]byte{0, 0, 0, 2}, nodePubKey: bob.PubKey()})
+		db.addAddressToDB(&addressInfo{address: [4]byte{0, 0, 0, 3}, nodePubKey: carol.PubKey()})
+		return db
+	}
+
+	type handshakeResult struct {
+		connInfo   *connInfo
+		peerPubKey [33]byte
+		err        error
+	}
+
+	tests := []struct {
+		name        string
+		responder   LightningBackend
+		peerPubKey  [33]byte
+		offerValid  bool
+		acceptValid bool
+		//reason and acceptReason are why the offering and accepting sides failed
+		reason       error
+		acceptReason error
+	}{
+		{"registered peer", bob, bob.PubKey(), true, true, nil, nil},
+		//Only the owner of the identity key alice expects can answer her
+		{"wrong identity key", bob, carol.PubKey(), false, false, nil, nil},
+		{"no shared channel", carol, carol.PubKey(), false, false, ErrNoSharedChannel, nil},
+		//dave accepts alice but she hangs up before the init messages
+		{"unregistered peer", dave, dave.PubKey(), false, false, ErrPeerNotRegistered, nil},
+		//bob's lnd failing doesn't take the client down with it
+		{"responder lnd failure", unavailableChannelsNode{bob}, bob.PubKey(), false, false, nil, errChannelsUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aliceConn, responderConn := net.Pipe()
+			defer aliceConn.Close()
+			defer responderConn.Close()
+
+			accepted := make(chan handshakeResult)
+			go func() {
+				var result handshakeResult
+				result.connInfo, result.peerPubKey, result.err = acceptPeerHandshake(newFrameConn(responderConn), test.responder,
+					newRegisteredDB())
+				if result.err != nil {
+					responderConn.Close()
+				}
+				accepted <- result
+			}()
+
+			offered, err := offerPeerHandshake(newFrameConn(aliceConn), alice, newRegisteredDB(), test.peerPubKey)
+			if err != nil {
+				aliceConn.Close()
+			}
+			result := <-accepted
+			if (err == nil) != test.offerValid || (result.err == nil) != test.acceptValid {
+				t.Fatalf("handshake wants valid %v, %v and got %v, %v", test.offerValid, test.acceptValid, err, result.err)
+			}
+			for _, err := range []error{err, result.err} {
+				var handshakeErr *HandshakeError
+				if err != nil && !errors.As(err, &handshakeErr) {
+					t.Errorf("handshake returned %v, which isn't a HandshakeError", err)
+				}
+			}
+			if test.reason != nil && !errors.Is(err, test.reason) {
+				t.Errorf("handshake wants %v and got %v", test.reason, err)
+			}
+			if test.acceptReason != nil && !errors.Is(result.err, test.acceptReason) {
+				t.Errorf("accepting side wants %v and got %v", test.acceptReason, result.err)
+			}
+			if !test.offerValid || !test.acceptValid {
+				return
+			}
+
+			if result.peerPubKey != alice.PubKey() {
+				t.Errorf("accepting side authenticated the wrong peer")
+			}
+			for _, peerConnInfo := range []*connInfo{offered, result.connInfo} {
+				if peerConnInfo.version != protocolVersion || !peerConnInfo.features.supports(vppnFeatureOptional) {
+					t.Errorf("init messages weren't exchanged")
+				}
+			}
+			for _, ciphers := range [][2]*cipherState{{offered.sendCipher, result.connInfo.recvCipher},
+				{result.connInfo.sendCipher, offered.recvCipher}} {
+				message, err := ciphers[1].decrypt(nil, ciphers[0].encrypt(nil, []byte("table request")))
+				if err != nil || !bytes.Equal(message, []byte("table request")) {
+					t.Errorf("peers didn't agree on the session keys")
+				}
+			}
+		})
+	}
+}
+
+func TestAcceptConnection(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	db := createDB("")
+
+	//net.Pipe connections don't have an IP, they're all recorded as the same host
+	pipeConn, _ := net.Pipe()
+	host := remoteHost(pipeConn)
+
+	for i := 0; i < maxHandshakeFailures; i++ {
+		serverConn, strangerConn := net.Pipe()
+		go acceptConnection(alice, db, newFrameConn(serverConn))
+
+		//A stranger sends garbage instead of act one, only its connection is closed
+		stranger := newFrameConn(strangerConn)
+		stranger.readTimeout = time.Second
+		if err := writeConnectionType(stranger, peerConn); err != nil {
+			t.Fatal(err)
+		}
+		if err := stranger.writeFrame(make([]byte, actOneSize)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stranger.readFrame(); err == nil {
+			t.Fatalf("handshake answered garbage")
+		}
+		strangerConn.Close()
+	}
+
+	//Wait for the last failure to be recorded
+	for start := time.Now(); !db.handshakeBanned(host); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("%d failed handshakes weren't recorded", maxHandshakeFailures)
+		}
+	}
+
+	//The host isn't accepted anymore until the failures expire
+	serverConn, strangerConn := net.Pipe()
+	defer strangerConn.Close()
+	go acceptConnection(alice, db, newFrameConn(serverConn))
+	strangerConn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := strangerConn.Write([]byte{byte(peerConn)}); err == nil {
+		t.Errorf("accepted a connection from a banned host")
+	}
+
+	db.handshakeFailures[host].last = time.Now().Add(-handshakeBanDuration)
+	if db.handshakeBanned(host) {
+		t.Errorf("host is still banned after the ban expired")
+	}
+	db.clearHandshakeFailures(host)
+	if db.handshakeBanned(host) || len(db.handshakeFailures) != 0 {
+		t.Errorf("failures weren't cleared")
+	}
+
+	//Expired failures of hosts that never succeed are forgotten
+	db.recordHandshakeFailure("192.0.2.1", ErrNoSharedChannel)
+	db.handshakeFailures["192.0.2.1"].last = time.Now().Add(-handshakeBanDuration)
+	db.recordHandshakeFailure("192.0.2.2", ErrNoSharedChannel)
+	if _, exists := db.handshakeFailures["192.0.2.1"]; exists || len(db.handshakeFailures) != 1 {
+		t.Errorf("expired failures weren't dropped")
+	}
+}
+
+func TestDestinationConnections(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	db := createDB("")
+
+	//Strangers open destination connections at the same time
+	var strangerConns []net.Conn
+	for i := 0; i < 20; i++ {
+		serverConn, strangerConn := net.Pipe()
+		defer strangerConn.Close()
+		strangerConns = append(strangerConns, strangerConn)
+		go acceptConnection(alice, db, newFrameConn(serverConn))
+	}
+	done := make(chan bool)
+	for i, strangerConn := range strangerConns {
+		go func(i int, strangerConn net.Conn) {
+			stranger := newFrameConn(strangerConn)
+			writeConnectionType(stranger, destinationConn)
+			stranger.writeFrame([]byte(fmt.Sprintf("token%05d", i)))
+			done <- true
+		}(i, strangerConn)
+	}
+	for range strangerConns {
+		<-done
+	}
+	for start := time.Now(); db.getDestConn("token00019") == nil || db.getDestConn("token00000") == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("destination connections weren't saved")
+		}
+	}
+
+	//A token can't be taken over
+	if err := db.addDestConnToDB("token00000", &connInfo{}); err == nil {
+		t.Errorf("replaced the connection of a token in use")
+	}
+
+	//Routes with a token nobody waits for are dropped
+	sendRouteToSender(db, createRoute([4]byte{0, 0, 0, 1}))
+
+	//The number of connections waiting for routes is capped
+	for i := len(db.destConns); i < maxDestConns; i++ {
+		if err := db.addDestConnToDB(fmt.Sprintf("filler%04d", i), &connInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.addDestConnToDB("oneTooMany", &connInfo{}); err == nil {
+		t.Errorf("more than %d connections wait for routes", maxDestConns)
+	}
+	if db.removeDestConnFromDB("token00001", &connInfo{}) != nil || db.removeDestConnFromDB("token00001", nil) == nil {
+		t.Errorf("removed the wrong destination connection")
+	}
+}
+
+func TestPeerMessageTypes(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	db := createDB("")
+	db.addAddressToDB(&addressInfo{address: [4]byte{0, 0, 0, 1}, nodePubKey: alice.PubKey()})
+	db.addAddressToDB(&addressInfo{address: [4]byte{0, 0, 0, 2}, nodePubKey: bob.PubKey()})
+
+	//bob's side of an established connection with alice
+	var aliceKey, bobKey [32]byte
+	aliceKey[0], bobKey[0] = 1, 2
+	aliceConn, bobConn := net.Pipe()
+	defer bobConn.Close()
+	go handlePeerConnection(&connInfo{conn: newFrameConn(aliceConn), sendCipher: newSessionCipher(aliceKey, aliceKey),
+		recvCipher: newSessionCipher(bobKey, bobKey)}, alice, db, bob.PubKey())
+	bobConnInfo := &connInfo{conn: newFrameConn(bobConn), sendCipher: newSessionCipher(bobKey, bobKey),
+		recvCipher: newSessionCipher(aliceKey, aliceKey)}
+	bobConnInfo.conn.readTimeout = time.Second
+
+	readMessageType := func() (uint16, error) {
+		message, err := readPeerMessage(bobConnInfo)
+		if err != nil {
+			return 0, err
+		}
+		return uint16(message[0])<<8 | uint16(message[1]), nil
+	}
+
+	//alice asks for bob's table as soon as the connection is up
+	if messageType, err := readMessageType(); err != nil || messageType != tableRequestType {
+		t.Fatalf("alice sent %d: %v", messageType, err)
+	}
+
+	//A message of an unknown odd type is ignored and the connection goes on
+	if err := writePeerMessage(bobConnInfo, []byte{0, 101, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	tableRequest, err := createTableRequest(genesisBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writePeerMessage(bobConnInfo, tableRequest); err != nil {
+		t.Fatal(err)
+	}
+	if messageType, err := readMessageType(); err != nil || messageType != tableResponseType {
+		t.Fatalf("alice answered %d: %v", messageType, err)
+	}
+
+	//A message of an unknown even type ends it
+	if err = writePeerMessage(bobConnInfo, []byte{0, 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readMessageType(); err == nil {
+		t.Errorf("alice kept the connection after an unknown even message")
+	}
+}
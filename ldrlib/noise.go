@@ -0,0 +1,421 @@
+package ldrlib
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/jsmvalente/ldRouting/lndwrapper"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+//The peer handshake is the Noise_XK handshake Lightning uses in BOLT 8, with the static keys being the identity keys
+//of the lightning nodes. The ECDH operations with the local identity key are done by lnd, so the key never leaves it
+const (
+	noiseProtocolName = "Noise_XK_secp256k1_ChaChaPoly_SHA256"
+	//The only handshake version
+	handshakeVersion = 0
+	//The size of the poly1305 tag authenticating every encrypted message (in bytes)
+	macSize = 16
+
+	//The sizes of the acts of the handshake (in bytes)
+	//<version> (1 byte) + <ephemeral key> (33 bytes) + <mac> (16 bytes)
+	actOneSize = 1 + 33 + macSize
+	actTwoSize = actOneSize
+	//<version> (1 byte) + <encrypted static key> (33 + 16 bytes) + <mac> (16 bytes)
+	actThreeSize = 1 + 33 + 2*macSize
+
+	//keyRotationInterval is the number of messages encrypted with a session key before it is rotated, like BOLT 8 does
+	keyRotationInterval = 1000
+	//The size of the sequence number preceding every encrypted peer message (in bytes)
+	sequenceNumberSize = 8
+)
+
+//noisePrologue keeps LDR handshakes apart from the lightning handshakes made with the same keys
+var noisePrologue = []byte("ldrouting")
+
+//lightningSigner is implemented by lightning backends able to do ECDH with the identity key of the node
+type lightningSigner interface {
+	DeriveSharedKey(ephemeralPubKey []byte) (*lndwrapper.SharedKeyResponse, error)
+}
+
+//Make sure lnd can do the ECDH operations of the handshake
+var _ lightningSigner = (*lndwrapper.Lnd)(nil)
+
+//ErrNoSigner is returned when the lightning backend can't do ECDH with its identity key
+var ErrNoSigner = errors.New("The lightning backend can't derive shared keys, lnd needs the signrpc sub-server")
+
+var (
+	//errReplayedMessage is returned for a peer message with a sequence number that was already received
+	errReplayedMessage = errors.New("Replayed peer message")
+	//errOutOfOrderMessage is returned for a peer message received before the ones preceding it
+	errOutOfOrderMessage = errors.New("Out of order peer message")
+)
+
+//ecdh returns the sha256 of the compressed point shared by pub and priv, like lnd does
+func ecdh(pub *btcec.PublicKey, priv *btcec.PrivateKey) [32]byte {
+
+	var shared btcec.PublicKey
+	shared.Curve = btcec.S256()
+	shared.X, shared.Y = btcec.S256().ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+
+	return sha256.Sum256(shared.SerializeCompressed())
+}
+
+//identityECDH returns the key shared by pub and the identity key of the lightning node
+func identityECDH(client LightningBackend, pub *btcec.PublicKey) ([32]byte, error) {
+
+	var sharedKey [32]byte
+
+	signer, ok := client.(lightningSigner)
+	if !ok {
+		return sharedKey, ErrNoSigner
+	}
+	resp, err := signer.DeriveSharedKey(pub.SerializeCompressed())
+	if err != nil {
+		return sharedKey, err
+	}
+	if len(resp.SharedKey) != len(sharedKey) {
+		return sharedKey, errors.New("Invalid shared key size")
+	}
+	copy(sharedKey[:], resp.SharedKey)
+
+	return sharedKey, nil
+}
+
+//cipherState encrypts or decrypts the messages going one way with ChaCha20-Poly1305, using a counter as nonce
+//key: the current key, rotated every keyRotationInterval messages in sessions
+//salt: the salt of the next rotation, starting as the chaining key of the handshake
+//nonce: the number of messages encrypted with the current key
+//sequence: the number of messages encrypted since the session started, sent with every peer message
+//rotate: whether the key is rotated, the ciphers of the handshake acts aren't
+type cipherState struct {
+	aead     cipher.AEAD
+	key      [32]byte
+	salt     [32]byte
+	nonce    uint64
+	sequence uint64
+	rotate   bool
+}
+
+func newCipherState(key [32]byte) *cipherState {
+
+	c := &cipherState{}
+	c.setKey(key)
+
+	return c
+}
+
+//newSessionCipher returns the cipher of one direction of a session, rotating its key with salt
+func newSessionCipher(key [32]byte, salt [32]byte) *cipherState {
+
+	c := newCipherState(key)
+	c.salt = salt
+	c.rotate = true
+
+	return c
+}
+
+func (c *cipherState) setKey(key [32]byte) {
+
+	//Only fails for keys of the wrong size
+	c.aead, _ = chacha20poly1305.New(key[:])
+	c.key = key
+	c.nonce = 0
+}
+
+//nextNonce returns the nonce for the next message, 4 zero bytes followed by the little endian counter
+func (c *cipherState) nextNonce() []byte {
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+
+	return nonce
+}
+
+//advance moves to the nonce of the next message, deriving a new key from the current one once it has
+//been used keyRotationInterval times, so a key compromise doesn't expose the whole session
+func (c *cipherState) advance() {
+
+	c.nonce++
+	c.sequence++
+	if !c.rotate || c.nonce < keyRotationInterval {
+		return
+	}
+
+	var key [32]byte
+	keys := hkdf.New(sha256.New, c.key[:], c.salt[:], nil)
+	io.ReadFull(keys, c.salt[:])
+	io.ReadFull(keys, key[:])
+	c.setKey(key)
+}
+
+func (c *cipherState) encrypt(associatedData []byte, plaintext []byte) []byte {
+
+	ciphertext := c.aead.Seal(nil, c.nextNonce(), plaintext, associatedData)
+	c.advance()
+
+	return ciphertext
+}
+
+//decrypt returns an error if the ciphertext wasn't encrypted with the next nonce, without advancing
+func (c *cipherState) decrypt(associatedData []byte, ciphertext []byte) ([]byte, error) {
+
+	plaintext, err := c.aead.Open(nil, c.nextNonce(), ciphertext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	c.advance()
+
+	return plaintext, nil
+}
+
+//seal encrypts a peer message preceded by its sequence number, which is authenticated with it
+//<sequence number> (8 bytes) + <encrypted message> + <mac> (16 bytes)
+func (c *cipherState) seal(message []byte) []byte {
+
+	sequenceNumber := make([]byte, sequenceNumberSize, sequenceNumberSize+len(message)+macSize)
+	binary.BigEndian.PutUint64(sequenceNumber, c.sequence)
+
+	return append(sequenceNumber, c.encrypt(sequenceNumber, message)...)
+}
+
+//open decrypts a peer message sealed by the other side, rejecting messages replayed or received out of order
+func (c *cipherState) open(sealedMessage []byte) ([]byte, error) {
+
+	if len(sealedMessage) < sequenceNumberSize+macSize {
+		return nil, errors.New("Invalid peer message size")
+	}
+
+	sequenceNumber := binary.BigEndian.Uint64(sealedMessage[:sequenceNumberSize])
+	if sequenceNumber < c.sequence {
+		return nil, errReplayedMessage
+	}
+	if sequenceNumber > c.sequence {
+		return nil, errOutOfOrderMessage
+	}
+
+	return c.decrypt(sealedMessage[:sequenceNumberSize], sealedMessage[sequenceNumberSize:])
+}
+
+//handshakeState holds the state of one side of the handshake
+//chainingKey: the key the session keys are derived from, mixed with every shared secret
+//handshakeHash: the hash of everything sent so far, authenticated by every act
+//tempCipher: the cipher of the act being sent or received
+//remoteStatic: the identity key of the responder, known by the initiator beforehand, or of the initiator, learnt in act three
+type handshakeState struct {
+	client          LightningBackend
+	initiator       bool
+	chainingKey     [32]byte
+	handshakeHash   [32]byte
+	tempCipher      *cipherState
+	localStatic     *btcec.PublicKey
+	localEphemeral  *btcec.PrivateKey
+	remoteStatic    *btcec.PublicKey
+	remoteEphemeral *btcec.PublicKey
+	//generateEphemeral is replaced in tests to get known handshakes
+	generateEphemeral func() (*btcec.PrivateKey, error)
+}
+
+//newHandshakeState starts the handshake of the local node. The initiator knows remoteStatic, the identity key of
+//the responder, while the responder passes nil and learns the key of the initiator in act three
+func newHandshakeState(client LightningBackend, initiator bool, remoteStatic *btcec.PublicKey) (*handshakeState, error) {
+
+	localPubKey := GetLocalNodePubKey(client)
+	localStatic, err := btcec.ParsePubKey(localPubKey[:], btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	h := &handshakeState{client: client, initiator: initiator, localStatic: localStatic, remoteStatic: remoteStatic,
+		generateEphemeral: func() (*btcec.PrivateKey, error) { return btcec.NewPrivateKey(btcec.S256()) }}
+	responderStatic := localStatic
+	if initiator {
+		responderStatic = remoteStatic
+	}
+
+	h.handshakeHash = sha256.Sum256([]byte(noiseProtocolName))
+	h.chainingKey = h.handshakeHash
+	h.mixHash(noisePrologue)
+	h.mixHash(responderStatic.SerializeCompressed())
+
+	return h, nil
+}
+
+func (h *handshakeState) mixHash(data []byte) {
+	h.handshakeHash = sha256.Sum256(append(h.handshakeHash[:], data...))
+}
+
+//mixKey derives a new chaining key and the key of the next act from a shared secret
+func (h *handshakeState) mixKey(sharedSecret [32]byte) {
+
+	var tempKey [32]byte
+	keys := hkdf.New(sha256.New, sharedSecret[:], h.chainingKey[:], nil)
+	io.ReadFull(keys, h.chainingKey[:])
+	io.ReadFull(keys, tempKey[:])
+
+	h.tempCipher = newCipherState(tempKey)
+}
+
+func (h *handshakeState) encryptAndHash(plaintext []byte) []byte {
+
+	ciphertext := h.tempCipher.encrypt(h.handshakeHash[:], plaintext)
+	h.mixHash(ciphertext)
+
+	return ciphertext
+}
+
+func (h *handshakeState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+
+	plaintext, err := h.tempCipher.decrypt(h.handshakeHash[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	h.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+//sendEphemeral generates the ephemeral key of this side and returns the start of its act
+func (h *handshakeState) sendEphemeral() ([]byte, error) {
+
+	var err error
+	h.localEphemeral, err = h.generateEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral := h.localEphemeral.PubKey().SerializeCompressed()
+	h.mixHash(ephemeral)
+
+	return append([]byte{handshakeVersion}, ephemeral...), nil
+}
+
+//receiveEphemeral reads the version and ephemeral key at the start of an act of the other side
+func (h *handshakeState) receiveEphemeral(act []byte) error {
+
+	if act[0] != handshakeVersion {
+		return errors.New("Unknown handshake version")
+	}
+
+	var err error
+	h.remoteEphemeral, err = btcec.ParsePubKey(act[1:34], btcec.S256())
+	if err != nil {
+		return err
+	}
+	h.mixHash(act[1:34])
+
+	return nil
+}
+
+//actOne is sent by the initiator, proving it knows the identity key of the responder
+//e, es
+func (h *handshakeState) actOne() ([]byte, error) {
+
+	act, err := h.sendEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	h.mixKey(ecdh(h.remoteStatic, h.localEphemeral))
+
+	return append(act, h.encryptAndHash(nil)...), nil
+}
+
+func (h *handshakeState) receiveActOne(act []byte) error {
+
+	if len(act) != actOneSize {
+		return errors.New("Invalid act one size")
+	}
+	if err := h.receiveEphemeral(act); err != nil {
+		return err
+	}
+	sharedSecret, err := identityECDH(h.client, h.remoteEphemeral)
+	if err != nil {
+		return err
+	}
+	h.mixKey(sharedSecret)
+
+	_, err = h.decryptAndHash(act[34:])
+	return err
+}
+
+//actTwo is sent by the responder
+//e, ee
+func (h *handshakeState) actTwo() ([]byte, error) {
+
+	act, err := h.sendEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	h.mixKey(ecdh(h.remoteEphemeral, h.localEphemeral))
+
+	return append(act, h.encryptAndHash(nil)...), nil
+}
+
+func (h *handshakeState) receiveActTwo(act []byte) error {
+
+	if len(act) != actTwoSize {
+		return errors.New("Invalid act two size")
+	}
+	if err := h.receiveEphemeral(act); err != nil {
+		return err
+	}
+	h.mixKey(ecdh(h.remoteEphemeral, h.localEphemeral))
+
+	_, err := h.decryptAndHash(act[34:])
+	return err
+}
+
+//actThree is sent by the initiator, revealing its identity key to the responder only
+//s, se
+func (h *handshakeState) actThree() ([]byte, error) {
+
+	act := append([]byte{handshakeVersion}, h.encryptAndHash(h.localStatic.SerializeCompressed())...)
+	sharedSecret, err := identityECDH(h.client, h.remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	h.mixKey(sharedSecret)
+
+	return append(act, h.encryptAndHash(nil)...), nil
+}
+
+func (h *handshakeState) receiveActThree(act []byte) error {
+
+	if len(act) != actThreeSize {
+		return errors.New("Invalid act three size")
+	}
+	if act[0] != handshakeVersion {
+		return errors.New("Unknown handshake version")
+	}
+
+	remoteStatic, err := h.decryptAndHash(act[1 : 1+33+macSize])
+	if err != nil {
+		return err
+	}
+	h.remoteStatic, err = btcec.ParsePubKey(remoteStatic, btcec.S256())
+	if err != nil {
+		return err
+	}
+	h.mixKey(ecdh(h.remoteStatic, h.localEphemeral))
+
+	_, err = h.decryptAndHash(act[1+33+macSize:])
+	return err
+}
+
+//split returns the ciphers for the messages sent and received once the handshake is done
+func (h *handshakeState) split() (*cipherState, *cipherState) {
+
+	var initiatorKey, responderKey [32]byte
+	keys := hkdf.New(sha256.New, nil, h.chainingKey[:], nil)
+	io.ReadFull(keys, initiatorKey[:])
+	io.ReadFull(keys, responderKey[:])
+
+	if h.initiator {
+		return newSessionCipher(initiatorKey, h.chainingKey), newSessionCipher(responderKey, h.chainingKey)
+	}
+	return newSessionCipher(responderKey, h.chainingKey), newSessionCipher(initiatorKey, h.chainingKey)
+}
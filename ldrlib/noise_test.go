@@ -0,0 +1,181 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+//testKey returns the private key with every byte set to b, like the keys of the BOLT 8 test vectors
+func testKey(b byte) *btcec.PrivateKey {
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{b}, 32))
+	return privKey
+}
+
+//TestNoiseHandshake checks the handshake against the test vectors of BOLT 8, which use the lightning prologue
+func TestNoiseHandshake(t *testing.T) {
+
+	hexDecode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	prologue := noisePrologue
+	noisePrologue = []byte("lightning")
+	defer func() { noisePrologue = prologue }()
+
+	graph := lndfake.NewGraph()
+	initiator := graph.AddNodeWithKey(testKey(0x11), "initiator")
+	responder := graph.AddNodeWithKey(testKey(0x21), "responder")
+
+	initiatorState, err := newHandshakeState(initiator, true, responder.PrivKey().PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiatorState.generateEphemeral = func() (*btcec.PrivateKey, error) { return testKey(0x12), nil }
+	responderState, err := newHandshakeState(responder, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderState.generateEphemeral = func() (*btcec.PrivateKey, error) { return testKey(0x22), nil }
+
+	actOne, err := initiatorState.actOne()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actOne, hexDecode("00036360e856310ce5d294e8be33fc807077dc56ac80d95d9cd4ddbd21325eff73f70df6086551151f58b8afe6c195782c6a")) {
+		t.Fatalf("act one is %x", actOne)
+	}
+	if err = responderState.receiveActOne(actOne); err != nil {
+		t.Fatal(err)
+	}
+
+	actTwo, err := responderState.actTwo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actTwo, hexDecode("0002466d7fcae563e5cb09a0d1870bb580344804617879a14949cf22285f1bae3f276e2470b93aac583c9ef6eafca3f730ae")) {
+		t.Fatalf("act two is %x", actTwo)
+	}
+	if err = initiatorState.receiveActTwo(actTwo); err != nil {
+		t.Fatal(err)
+	}
+
+	actThree, err := initiatorState.actThree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actThree, hexDecode("00b9e3a702e93e3a9948c2ed6e5fd7590a6e1c3a0344cfc9d5b57357049aa22355361aa02e55a8fc28fef5bd6d71ad0c38228dc68b1c466263b47fdf31e560e139ba")) {
+		t.Fatalf("act three is %x", actThree)
+	}
+	if err = responderState.receiveActThree(actThree); err != nil {
+		t.Fatal(err)
+	}
+	if !responderState.remoteStatic.IsEqual(initiator.PrivKey().PubKey()) {
+		t.Errorf("responder learnt the wrong identity key")
+	}
+
+	//The first message sent with the session keys of BOLT 8
+	var sk, rk [32]byte
+	copy(sk[:], hexDecode("969ab31b4d288cedf6218839b27a3e2140827047f2c0f01bf5c04435d43511a9"))
+	copy(rk[:], hexDecode("bb9020b8965f4df047e07f955f3c4b88418984aadc5cdb35096b9ea8fa5c3442"))
+	initiatorSend, initiatorRecv := initiatorState.split()
+	responderSend, responderRecv := responderState.split()
+	tests := []struct {
+		name     string
+		send     *cipherState
+		expected *cipherState
+		recv     *cipherState
+	}{
+		{"initiator to responder", initiatorSend, newCipherState(sk), responderRecv},
+		{"responder to initiator", responderSend, newCipherState(rk), initiatorRecv},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ciphertext := test.send.encrypt(nil, []byte("hello"))
+			if !bytes.Equal(ciphertext, test.expected.encrypt(nil, []byte("hello"))) {
+				t.Errorf("session key doesn't match BOLT 8")
+			}
+			if message, err := test.recv.decrypt(nil, ciphertext); err != nil || string(message) != "hello" {
+				t.Errorf("couldn't decrypt the message: %v", err)
+			}
+		})
+	}
+
+	//A tampered act is rejected
+	tamperedState, err := newHandshakeState(responder, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actOne[len(actOne)-1] ^= 1
+	if err = tamperedState.receiveActOne(actOne); err == nil {
+		t.Errorf("accepted a tampered act one")
+	}
+}
+
+func TestPeerMessages(t *testing.T) {
+
+	var key, salt [32]byte
+	key[0], salt[0] = 1, 2
+
+	sealed := make([][]byte, 3)
+	sender := newSessionCipher(key, salt)
+	for i := range sealed {
+		sealed[i] = sender.seal([]byte("table request"))
+	}
+	tampered := append([]byte{}, sealed[1]...)
+	tampered[len(tampered)-1] ^= 1
+	//A frame moved to another position can't have its sequence number changed without breaking the mac
+	renumbered := append([]byte{}, sealed[2]...)
+	renumbered[sequenceNumberSize-1] = 1
+
+	tests := []struct {
+		name     string
+		messages [][]byte
+		valid    bool
+		err      error
+	}{
+		{"in order", sealed, true, nil},
+		{"replayed", [][]byte{sealed[0], sealed[1], sealed[1]}, false, errReplayedMessage},
+		{"out of order", [][]byte{sealed[0], sealed[2]}, false, errOutOfOrderMessage},
+		{"tampered", [][]byte{sealed[0], tampered}, false, nil},
+		{"renumbered", [][]byte{sealed[0], renumbered}, false, nil},
+		{"too short", [][]byte{sealed[0][:sequenceNumberSize]}, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := newSessionCipher(key, salt)
+			var err error
+			for _, message := range test.messages {
+				if _, err = receiver.open(message); err != nil {
+					break
+				}
+			}
+			if (err == nil) != test.valid {
+				t.Fatalf("open wants valid %v and got %v", test.valid, err)
+			}
+			if test.err != nil && err != test.err {
+				t.Errorf("open wants %v and got %v", test.err, err)
+			}
+		})
+	}
+
+	//Both sides rotate the key every keyRotationInterval messages
+	sender, receiver := newSessionCipher(key, salt), newSessionCipher(key, salt)
+	for i := 0; i < 2*keyRotationInterval+1; i++ {
+		if _, err := receiver.open(sender.seal([]byte("table request"))); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if sender.key == key || sender.nonce != 1 || sender.sequence != 2*keyRotationInterval+1 {
+		t.Errorf("key wasn't rotated")
+	}
+}
@@ -0,0 +1,267 @@
+package ldrlib
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+)
+
+//addressChange is a change made to the DB by a message found in a block
+//height: the height of the block holding the message
+//previous: the address info replaced by a revocation or transfer, nil for registrations
+//info: the new address info, nil for revocations
+type addressChange struct {
+	height   uint64
+	previous *addressInfo
+	info     *addressInfo
+}
+
+//ownershipMessage returns the message signed by the owner of an address to revoke or transfer it.
+//It commits to the registration being replaced so it can't be replayed against a later owner of the address,
+//and to the whole key of the new node of a transfer, which only carries its key hint
+//<type> (1 byte) + <address> (4 bytes) + <registration tx id> (32 bytes) + <new node pubkey> (33 bytes, transfers only)
+func ownershipMessage(msgType messageType, address [4]byte, registrationTxID [32]byte, newNodePubKey [33]byte) []byte {
+
+	message := append([]byte{byte(msgType)}, address[:]...)
+	message = append(message, registrationTxID[:]...)
+	if msgType == transferMessage {
+		message = append(message, newNodePubKey[:]...)
+	}
+
+	return message
+}
+
+//nodeKeyHint returns the key hint identifying pubKey in transfers
+func nodeKeyHint(pubKey [33]byte) [nodeKeyHintSize]byte {
+
+	var hint [nodeKeyHintSize]byte
+	copy(hint[:], pubKey[1:])
+
+	return hint
+}
+
+//localAddressInfo returns the info of the address registered by the local node
+func (db *DB) localAddressInfo(lnClient LightningBackend) (*addressInfo, error) {
+
+	addressNode, registered := db.keyToAddressMap[GetLocalNodePubKey(lnClient)]
+	if !registered {
+		return nil, errors.New("The local node has no registered address")
+	}
+
+	return addressNode.getData().(*addressInfo), nil
+}
+
+//newOwnershipOutput returns the OP_RETURN output revoking or transferring the address of info, signed by the lightning node
+func newOwnershipOutput(lnClient LightningBackend, msgType messageType, info *addressInfo, newNodePubKey [33]byte) (*wire.TxOut, error) {
+
+	payload := registrationPayload{version: messageVersion, msgType: msgType, address: info.address, newNodeKeyHint: nodeKeyHint(newNodePubKey)}
+	copy(payload.sig[:], SignMessage(lnClient, ownershipMessage(msgType, info.address, info.registrationTxID, newNodePubKey)))
+	opReturnScript, err := encodeRegistrationScript(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return wire.NewTxOut(registerOpRetOutAmount, opReturnScript), nil
+}
+
+//BroadcastRevocationTx broadcasts a transaction releasing the address of the local node and returns its id
+//The address is free for anyone to register once the revocation is accepted into the DB
+//Note: Requires bitcoin wallet to be unlocked
+func (db *DB) BroadcastRevocationTx(bitcoind ChainBackend, lnClient LightningBackend, changeAddressType string) (string, error) {
+
+	info, err := db.localAddressInfo(lnClient)
+	if err != nil {
+		return "", err
+	}
+
+	return broadcastOwnershipTx(lnClient, revokeMessage, info, [33]byte{}, func(output *wire.TxOut) (*wire.MsgTx, error) {
+		return sendOutputWithBitcoind(bitcoind, changeAddressType, output)
+	})
+}
+
+//BroadcastRevocationTxWithLnd broadcasts a revocation of the address of the local node funded and signed by
+//the on-chain wallet of the lightning node and returns its id
+func (db *DB) BroadcastRevocationTxWithLnd(lnClient LightningBackend) (string, error) {
+
+	info, err := db.localAddressInfo(lnClient)
+	if err != nil {
+		return "", err
+	}
+
+	return broadcastOwnershipTx(lnClient, revokeMessage, info, [33]byte{}, func(output *wire.TxOut) (*wire.MsgTx, error) {
+		return sendOutputWithLnd(lnClient, output)
+	})
+}
+
+//BroadcastTransferTx broadcasts a transaction moving the address of the local node to the node identified
+//by newNodePubKey and returns its id. The new node must not have an address of its own
+//Note: Requires bitcoin wallet to be unlocked
+func (db *DB) BroadcastTransferTx(bitcoind ChainBackend, lnClient LightningBackend, changeAddressType string, newNodePubKey [33]byte) (string, error) {
+
+	info, err := db.localAddressInfo(lnClient)
+	if err != nil {
+		return "", err
+	}
+	if err = db.checkTransferTarget(lnClient, info, newNodePubKey); err != nil {
+		return "", err
+	}
+
+	return broadcastOwnershipTx(lnClient, transferMessage, info, newNodePubKey, func(output *wire.TxOut) (*wire.MsgTx, error) {
+		return sendOutputWithBitcoind(bitcoind, changeAddressType, output)
+	})
+}
+
+//BroadcastTransferTxWithLnd broadcasts a transfer of the address of the local node to newNodePubKey funded
+//and signed by the on-chain wallet of the lightning node and returns its id
+func (db *DB) BroadcastTransferTxWithLnd(lnClient LightningBackend, newNodePubKey [33]byte) (string, error) {
+
+	info, err := db.localAddressInfo(lnClient)
+	if err != nil {
+		return "", err
+	}
+	if err = db.checkTransferTarget(lnClient, info, newNodePubKey); err != nil {
+		return "", err
+	}
+
+	return broadcastOwnershipTx(lnClient, transferMessage, info, newNodePubKey, func(output *wire.TxOut) (*wire.MsgTx, error) {
+		return sendOutputWithLnd(lnClient, output)
+	})
+}
+
+//broadcastOwnershipTx broadcasts a revocation or transfer of the address of info with send, which funds and signs it
+func broadcastOwnershipTx(lnClient LightningBackend, msgType messageType, info *addressInfo, newNodePubKey [33]byte,
+	send func(output *wire.TxOut) (*wire.MsgTx, error)) (string, error) {
+
+	messageOutput, err := newOwnershipOutput(lnClient, msgType, info, newNodePubKey)
+	if err != nil {
+		return "", err
+	}
+
+	signedTx, err := send(messageOutput)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Broadcasted %v of %v in %v\n", msgType, formatAddress(info), signedTx.TxHash())
+
+	return signedTx.TxHash().String(), nil
+}
+
+//checkTransferTarget checks that the address of info can be transferred to newNodePubKey
+func (db *DB) checkTransferTarget(lnClient LightningBackend, info *addressInfo, newNodePubKey [33]byte) error {
+
+	if newNodePubKey == info.nodePubKey {
+		return errors.New("The address already belongs to the new node")
+	}
+	if _, err := btcec.ParsePubKey(newNodePubKey[:], btcec.S256()); err != nil {
+		return errors.New("Invalid new node public key: " + err.Error())
+	}
+	if db.IsNodeRegistered(newNodePubKey) {
+		return errors.New("The new node already has a registered address")
+	}
+	//Transfers are matched to their new node in the graph
+	if _, err := lnClient.GetNodeInfo(PubKeyArrayToString(newNodePubKey), false); err != nil {
+		return errors.New("The new node isn't in the lightning graph: " + err.Error())
+	}
+
+	return nil
+}
+
+//verifyOwnershipMessage checks that a revocation or transfer is signed by the current owner of its address
+//and returns the address info it replaces and the node receiving the address of a transfer.
+//The new node is the node of the graph matching the key hint of the transfer that the owner signed it for
+func (db *DB) verifyOwnershipMessage(registration *addressRegistration, lnClient LightningBackend) (*addressInfo, [33]byte, error) {
+
+	previous := db.getAddressInfo(registration.address)
+	if previous == nil {
+		return nil, [33]byte{}, errors.New("Address isn't registered")
+	}
+
+	newNodes := [][33]byte{{}}
+	if registration.msgType == transferMessage {
+		var err error
+		newNodes, err = getNodesByKeyHint(lnClient, registration.newNodeKeyHint)
+		if err != nil {
+			return nil, [33]byte{}, err
+		}
+	}
+
+	for _, newNodePubKey := range newNodes {
+		message := ownershipMessage(registration.msgType, registration.address, previous.registrationTxID, newNodePubKey)
+		validSig, nodePubKey := VerifyMessage(lnClient, message, registration.sig[:])
+		if validSig && nodePubKey == previous.nodePubKey {
+			return previous, newNodePubKey, nil
+		}
+	}
+
+	return nil, [33]byte{}, errors.New("Not signed by the owner of the address")
+}
+
+//verifyAddressMessage verifies the address or prefix registration, revocation or transfer found in a block and returns the change
+//it makes to the DB, nil if it is invalid
+func (db *DB) verifyAddressMessage(registration *addressRegistration, lnClient LightningBackend) *addressChange {
+
+	change := addressChange{height: registration.blockHeight}
+
+	switch registration.msgType {
+	case registerMessage:
+		validAddress, info := db.verifyAddressRegistration(registration, lnClient)
+		if !validAddress {
+			return nil
+		}
+		change.info = info
+		return &change
+	case prefixMessage:
+		validPrefix, info := db.verifyPrefixRegistration(registration, lnClient)
+		if !validPrefix {
+			return nil
+		}
+		change.info = info
+		return &change
+	}
+
+	previous, newNodePubKey, err := db.verifyOwnershipMessage(registration, lnClient)
+	if err == nil && registration.msgType == transferMessage {
+		err = db.checkTransferTarget(lnClient, previous, newNodePubKey)
+	}
+	if err != nil {
+		log.Println("Verification failed for " + net.IP(registration.address[:]).String() + " " +
+			registration.msgType.String() + ": " + err.Error())
+		return nil
+	}
+	change.previous = previous
+
+	//Transferred prefixes keep their length
+	if registration.msgType == transferMessage {
+		change.info = &addressInfo{address: registration.address, nodePubKey: newNodePubKey,
+			registrationHeight: registration.blockHeight, registrationTxID: registration.txID, version: registration.version,
+			prefixLen: previous.prefixLen}
+	}
+	log.Println("Validated", registration.msgType, "of", formatAddress(previous))
+
+	return &change
+}
+
+//applyAddressChange loads an address change into memory
+func (db *DB) applyAddressChange(change *addressChange) {
+
+	if change.previous != nil {
+		db.removeAddressFromDB(change.previous)
+	}
+	if change.info != nil {
+		db.addAddressToDB(change.info)
+	}
+}
+
+//revertAddressChange takes an address change loaded into memory back out of it
+func (db *DB) revertAddressChange(change *addressChange) {
+
+	if change.info != nil {
+		db.removeAddressFromDB(change.info)
+	}
+	if change.previous != nil {
+		db.addAddressToDB(change.previous)
+	}
+}
@@ -0,0 +1,140 @@
+package ldrlib
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+//ownershipTx builds the revocation or transfer of the address of info a node would broadcast
+func ownershipTx(t *testing.T, node *lndfake.Node, msgType messageType, info *addressInfo, newNodePubKey [33]byte) *wire.MsgTx {
+
+	messageOutput, err := newOwnershipOutput(node, msgType, info, newNodePubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	tx.AddTxOut(messageOutput)
+	return tx
+}
+
+func TestOwnershipMessages(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	carol := newTestNode(t, graph, "carol")
+	stranger, err := lndfake.NewGraph().AddNode("stranger")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	bobAddress := [4]byte{10, 1, 0, 1}
+	aliceTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobTx, err := chainfake.RegistrationTx(0, bobAddress, SignMessage(bob, bobAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		broadcast func(db *DB, chain *chainfake.Chain) error
+		owner     *lndfake.Node
+	}{
+		{"revocation", func(db *DB, chain *chainfake.Chain) error {
+			_, err := db.BroadcastRevocationTx(chain, alice, DefaultChangeAddressType)
+			return err
+		}, nil},
+		{"transfer", func(db *DB, chain *chainfake.Chain) error {
+			_, err := db.BroadcastTransferTx(chain, alice, DefaultChangeAddressType, carol.PubKey())
+			return err
+		}, carol},
+		{"revocation funded by lnd", func(db *DB, chain *chainfake.Chain) error {
+			alice.SetWallet(100000, chain)
+			_, err := db.BroadcastRevocationTxWithLnd(alice)
+			return err
+		}, nil},
+		{"transfer funded by lnd", func(db *DB, chain *chainfake.Chain) error {
+			alice.SetWallet(100000, chain)
+			_, err := db.BroadcastTransferTxWithLnd(alice, carol.PubKey())
+			return err
+		}, carol},
+		{"revocation by another node", func(db *DB, chain *chainfake.Chain) error {
+			chain.Mine(ownershipTx(t, bob, revokeMessage, db.getAddressInfo(aliceAddress), [33]byte{}))
+			return nil
+		}, alice},
+		{"replayed revocation", func(db *DB, chain *chainfake.Chain) error {
+			oldRegistration := *db.getAddressInfo(aliceAddress)
+			oldRegistration.registrationTxID = [32]byte{1}
+			chain.Mine(ownershipTx(t, alice, revokeMessage, &oldRegistration, [33]byte{}))
+			return nil
+		}, alice},
+		{"transfer to a registered node", func(db *DB, chain *chainfake.Chain) error {
+			chain.Mine(ownershipTx(t, alice, transferMessage, db.getAddressInfo(aliceAddress), bob.PubKey()))
+			return nil
+		}, alice},
+		{"transfer to a node outside the graph", func(db *DB, chain *chainfake.Chain) error {
+			chain.Mine(ownershipTx(t, alice, transferMessage, db.getAddressInfo(aliceAddress), stranger.PubKey()))
+			return nil
+		}, alice},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			chain := chainfake.New()
+			fundTestWallet(t, chain, 0.001)
+			chain.Mine(aliceTx, bobTx)
+			db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+			defer db.Close()
+			db.SetConfirmationDepth(1)
+			if err := db.UpdateAddressDB(chain, alice); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := test.broadcast(db, chain); err != nil {
+				t.Fatal(err)
+			}
+			chain.Mine()
+			if err := db.UpdateAddressDB(chain, alice); err != nil {
+				t.Fatal(err)
+			}
+
+			owner := db.getAddressInfo(aliceAddress)
+			switch {
+			case test.owner == nil && owner != nil:
+				t.Fatalf("revoked address still belongs to %x", owner.nodePubKey)
+			case test.owner != nil && (owner == nil || owner.nodePubKey != test.owner.PubKey()):
+				t.Fatalf("address doesn't belong to %v", test.owner)
+			}
+			if test.owner != alice && db.IsNodeRegistered(alice.PubKey()) {
+				t.Errorf("alice still has an address")
+			}
+			if address, registered := db.GetNodeAddress(bob.PubKey()); !registered || address != bobAddress {
+				t.Errorf("bob lost his address")
+			}
+
+			//The replaced registration comes back when the message is reorged out, also after a restart
+			chain.Reorg(1)
+			chain.MineEmpty(2)
+			if err := db.UpdateAddressDB(chain, alice); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+			db = ReadDBFromDisk(db.filePath, RegTest, alice)
+			if address, registered := db.GetNodeAddress(alice.PubKey()); !registered || address != aliceAddress {
+				t.Errorf("alice's address wasn't restored after the reorg")
+			}
+			if db.IsNodeRegistered(carol.PubKey()) {
+				t.Errorf("carol kept the address after the reorg")
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package ldrlib
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+//registrationFunding identifies the wallet that funded and signed a registration
+type registrationFunding uint8
+
+const (
+	//fundedByBitcoind registrations are signed by the bitcoind wallet, which can bump their fee
+	fundedByBitcoind registrationFunding = iota
+	//fundedByLnd registrations are signed by the on-chain wallet of the lightning node
+	fundedByLnd
+	//fundedOffline registrations were signed as a PSBT by a wallet whose keys are kept offline
+	fundedOffline
+)
+
+//RegistrationTx is an address registration transaction broadcast by this client
+//Address: the registered address
+//funding: the wallet that funded and signed the transaction
+//tx: the last broadcast version of the transaction, replaced when its fee is bumped
+//fee: the fee paid by tx, only known when it is funded by bitcoind
+//child: the transaction spending the change of tx to bump its fee, nil if there is none
+//childFee: the fee paid by child
+type RegistrationTx struct {
+	Address  [4]byte
+	funding  registrationFunding
+	tx       *wire.MsgTx
+	fee      btcutil.Amount
+	child    *wire.MsgTx
+	childFee btcutil.Amount
+}
+
+//TxHash returns the id of the last broadcast version of the registration transaction
+func (registration *RegistrationTx) TxHash() string {
+	return registration.tx.TxHash().String()
+}
+
+//RegistrationStatus is the progress of a registration broadcast by this client
+//Address: the registered address
+//TxID: the id of the registration transaction
+//Confirmations: the depth of the block holding the registration, 0 while it waits in the mempool
+type RegistrationStatus struct {
+	Address       [4]byte
+	TxID          string
+	Confirmations uint64
+}
+
+//TrackRegistration keeps track of registration until it is accepted into the DB
+func (db *DB) TrackRegistration(registration *RegistrationTx) error {
+	return db.saveTrackedRegistration(registration)
+}
+
+//TrackedRegistrations returns the status of the registrations broadcast by this client that weren't
+//accepted into the DB yet. Registrations are forgotten once the local node has an address, which becomes the
+//local address, when their address is taken by another node or when they left the mempool without being mined
+func (db *DB) TrackedRegistrations(bitcoinCLient ChainBackend, lnClient LightningBackend) ([]*RegistrationStatus, error) {
+
+	var statuses []*RegistrationStatus
+
+	registrations, err := db.loadTrackedRegistrations()
+	if err != nil || len(registrations) == 0 {
+		return nil, err
+	}
+
+	localPubKey := GetLocalNodePubKey(lnClient)
+	pendingRegistrations, err := db.PendingRegistrations(bitcoinCLient, lnClient)
+	if err != nil {
+		return nil, err
+	}
+
+	//Backends that can't list their mempool keep every unmined registration
+	var mempool map[string]bool
+	if reader, ok := bitcoinCLient.(mempoolReader); ok {
+		txIDs, err := reader.GetRawMempool()
+		if err != nil {
+			return nil, err
+		}
+		mempool = make(map[string]bool, len(txIDs))
+		for _, txID := range txIDs {
+			mempool[txID] = true
+		}
+	}
+
+	for _, registration := range registrations {
+
+		address := net.IP(registration.Address[:]).String()
+		if localAddress, registered := db.GetNodeAddress(localPubKey); registered {
+			db.SaveLocalAddress(localAddress)
+			if localAddress == registration.Address {
+				log.Println("Registration of", address, "was accepted")
+			} else {
+				log.Println("Forgetting registration of", address, "since the node registered", net.IP(localAddress[:]))
+			}
+			if err = db.deleteTrackedRegistration(registration.Address); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if db.IsAddressRegistered(registration.Address) {
+			log.Println("Address", address, "was registered by another node first")
+			if err = db.deleteTrackedRegistration(registration.Address); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		//The registration is matched by its address since replacing it changes its id
+		status := &RegistrationStatus{Address: registration.Address, TxID: registration.TxHash()}
+		mined := false
+		for _, pendingRegistration := range pendingRegistrations {
+			if pendingRegistration.Address == registration.Address && pendingRegistration.NodePubKey == localPubKey {
+				status.TxID = hex.EncodeToString(pendingRegistration.TxID[:])
+				status.Confirmations = pendingRegistration.Confirmations
+				mined = true
+			}
+		}
+
+		//An unmined registration that isn't in the mempool was evicted or conflicted by a double spend
+		if !mined && mempool != nil && !mempool[status.TxID] {
+			log.Println("Registration of", address, "was dropped from the mempool, forgetting it")
+			if err = db.deleteTrackedRegistration(registration.Address); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+//logTrackedRegistrations logs the status of the registrations broadcast by this client
+func (db *DB) logTrackedRegistrations(bitcoinCLient ChainBackend, lnClient LightningBackend) {
+
+	statuses, err := db.TrackedRegistrations(bitcoinCLient, lnClient)
+	if err != nil {
+		log.Println("Error checking the pending registrations:", err)
+		return
+	}
+
+	for _, status := range statuses {
+		log.Printf("Registration of %v pending, %d confirmations\n", net.IP(status.Address[:]), status.Confirmations)
+	}
+}
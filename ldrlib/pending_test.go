@@ -0,0 +1,123 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+func TestTrackedRegistrations(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	chain := chainfake.New()
+	fundTestWallet(t, chain, 0.001)
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	registration, err := BroadcastNewAddressTx(chain, alice, DefaultChangeAddressType, aliceAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Tracked registrations survive restarts
+	dataPath := newTestDataPath(t)
+	db := ReadDBFromDisk(dataPath, RegTest, alice)
+	if err = db.TrackRegistration(registration); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db = ReadDBFromDisk(dataPath, RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(3)
+
+	tests := []struct {
+		name          string
+		blocks        int
+		pending       bool
+		confirmations uint64
+	}{
+		{"mempool", 0, true, 0},
+		{"first confirmation", 1, true, 1},
+		{"second confirmation", 1, true, 2},
+		{"accepted", 1, false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			for i := 0; i < test.blocks; i++ {
+				chain.Mine()
+			}
+			if err := db.UpdateAddressDB(chain, alice); err != nil {
+				t.Fatal(err)
+			}
+
+			statuses, err := db.TrackedRegistrations(chain, alice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.pending {
+				if len(statuses) != 0 {
+					t.Fatalf("TrackedRegistrations wants no pending registrations and got %v", statuses)
+				}
+				if registrations, _ := db.loadTrackedRegistrations(); len(registrations) != 0 {
+					t.Errorf("accepted registration is still tracked")
+				}
+				if db.getLocalAddress() != aliceAddress {
+					t.Errorf("accepted registration wants local address %v and got %v", aliceAddress, db.getLocalAddress())
+				}
+				return
+			}
+			if db.getLocalAddress() != [4]byte{} {
+				t.Errorf("pending registration was made the local address")
+			}
+			if len(statuses) != 1 || statuses[0].Address != aliceAddress || statuses[0].TxID != registration.TxHash() ||
+				statuses[0].Confirmations != test.confirmations {
+				t.Fatalf("TrackedRegistrations wants %v confirmations and got %v", test.confirmations, statuses)
+			}
+		})
+	}
+	//A registration double spent in the mempool is forgotten
+	t.Run("double spent", func(t *testing.T) {
+
+		bob := newTestNode(t, graph, "bob")
+		fundTestWallet(t, chain, 0.001)
+		bobRegistration, err := BroadcastNewAddressTx(chain, bob, DefaultChangeAddressType, [4]byte{10, 0, 0, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bobDB := ReadDBFromDisk(newTestDataPath(t), RegTest, bob)
+		defer bobDB.Close()
+		if err = bobDB.TrackRegistration(bobRegistration); err != nil {
+			t.Fatal(err)
+		}
+		if statuses, err := bobDB.TrackedRegistrations(chain, bob); err != nil || len(statuses) != 1 {
+			t.Fatalf("TrackedRegistrations wants the mempool registration and got %v, %v", statuses, err)
+		}
+
+		doubleSpend := wire.NewMsgTx(wire.TxVersion)
+		doubleSpend.AddTxIn(wire.NewTxIn(&bobRegistration.tx.TxIn[0].PreviousOutPoint, nil, nil))
+		var rawTx bytes.Buffer
+		if err = doubleSpend.Serialize(&rawTx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = chain.SendRawTransaction(hex.EncodeToString(rawTx.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+
+		statuses, err := bobDB.TrackedRegistrations(chain, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 0 {
+			t.Errorf("TrackedRegistrations wants no pending registrations and got %v", statuses)
+		}
+		if registrations, _ := bobDB.loadTrackedRegistrations(); len(registrations) != 0 {
+			t.Errorf("double spent registration is still tracked")
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package ldrlib
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+//Shortest prefix that can be registered, so no node can claim a large part of the address space
+const minPrefixLength = 8
+
+//formatAddress returns the address of info in dotted notation, followed by the prefix length for prefixes
+func formatAddress(info *addressInfo) string {
+
+	address := net.IP(info.address[:]).String()
+	if info.prefixLen != 0 {
+		address += "/" + strconv.Itoa(int(info.prefixLen))
+	}
+
+	return address
+}
+
+//ParsePrefix parses a prefix in CIDR notation, like 10.2.0.0/16, into its network address and length
+func ParsePrefix(cidr string) ([4]byte, uint8, error) {
+
+	var address [4]byte
+
+	ip, network, err := net.ParseCIDR(cidr)
+	prefixLen, bits := 0, 0
+	if err == nil {
+		prefixLen, bits = network.Mask.Size()
+	}
+	if err != nil || ip.To4() == nil || bits != 32 {
+		return address, 0, errors.New("Invalid prefix " + cidr)
+	}
+	copy(address[:], ip.To4())
+
+	if err = checkPrefix(address, uint8(prefixLen)); err != nil {
+		return [4]byte{}, 0, err
+	}
+
+	return address, uint8(prefixLen), nil
+}
+
+//checkPrefix checks that prefixLen can be registered and that address is the network address of the prefix
+func checkPrefix(address [4]byte, prefixLen uint8) error {
+
+	if prefixLen < minPrefixLength || prefixLen >= 32 {
+		return errors.New("Prefixes must be between " + strconv.Itoa(minPrefixLength) + " and 31 bits long")
+	}
+
+	mask := net.CIDRMask(int(prefixLen), 32)
+	if !net.IP(address[:]).Mask(mask).Equal(net.IP(address[:])) {
+		return errors.New(net.IP(address[:]).String() + " isn't the network address of a /" + strconv.Itoa(int(prefixLen)) + " prefix")
+	}
+
+	return nil
+}
+
+//prefixRegistrationMessage returns the message signed by a node registering a prefix
+//<type> (1 byte) + <address> (4 bytes) + <prefix length> (1 byte)
+func prefixRegistrationMessage(address [4]byte, prefixLen uint8) []byte {
+	return append(append([]byte{byte(prefixMessage)}, address[:]...), prefixLen)
+}
+
+//newPrefixOutput returns the OP_RETURN output registering the prefix, signed by the lightning node
+func newPrefixOutput(lnClient LightningBackend, address [4]byte, prefixLen uint8) (*wire.TxOut, error) {
+
+	payload := registrationPayload{version: messageVersion, msgType: prefixMessage, address: address, prefixLen: prefixLen}
+	copy(payload.sig[:], SignMessage(lnClient, prefixRegistrationMessage(address, prefixLen)))
+	opReturnScript, err := encodeRegistrationScript(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return wire.NewTxOut(registerOpRetOutAmount, opReturnScript), nil
+}
+
+//BroadcastNewPrefixTx broadcasts a transaction registering the prefix of prefixLen bits starting at address
+//and returns its id. The node owning a prefix is the gateway to every address in it that isn't registered
+//by itself or as part of a longer prefix
+//Note: Requires bitcoin wallet to be unlocked
+func BroadcastNewPrefixTx(bitcoind ChainBackend, lnClient LightningBackend, changeAddressType string, address [4]byte, prefixLen uint8) (string, error) {
+
+	return broadcastPrefixTx(lnClient, address, prefixLen, func(output *wire.TxOut) (*wire.MsgTx, error) {
+		return sendOutputWithBitcoind(bitcoind, changeAddressType, output)
+	})
+}
+
+//BroadcastNewPrefixTxWithLnd broadcasts a transaction registering the prefix funded and signed by the
+//on-chain wallet of the lightning node and returns its id
+func BroadcastNewPrefixTxWithLnd(lnClient LightningBackend, address [4]byte, prefixLen uint8) (string, error) {
+
+	return broadcastPrefixTx(lnClient, address, prefixLen, func(output *wire.TxOut) (*wire.MsgTx, error) {
+		return sendOutputWithLnd(lnClient, output)
+	})
+}
+
+//broadcastPrefixTx checks the prefix and broadcasts its registration with send
+func broadcastPrefixTx(lnClient LightningBackend, address [4]byte, prefixLen uint8,
+	send func(output *wire.TxOut) (*wire.MsgTx, error)) (string, error) {
+
+	if err := checkPrefix(address, prefixLen); err != nil {
+		return "", err
+	}
+
+	prefixOutput, err := newPrefixOutput(lnClient, address, prefixLen)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := send(prefixOutput)
+	if err != nil {
+		return "", err
+	}
+
+	return tx.TxHash().String(), nil
+}
+
+//verifyPrefixRegistration checks a prefix registration found in a block. Prefixes can hold addresses and
+//longer prefixes registered by other nodes but can't share their network address with another registration
+func (db *DB) verifyPrefixRegistration(registration *addressRegistration, lnClient LightningBackend) (bool, *addressInfo) {
+
+	info := &addressInfo{address: registration.address, prefixLen: registration.prefixLen,
+		registrationHeight: registration.blockHeight, registrationTxID: registration.txID, version: registration.version}
+	prefix := formatAddress(info)
+
+	if err := checkPrefix(registration.address, registration.prefixLen); err != nil {
+		log.Println("Verification failed for " + prefix + " registration: " + err.Error())
+		return false, nil
+	}
+
+	validSig, nodePubKey := VerifyMessage(lnClient, prefixRegistrationMessage(registration.address, registration.prefixLen),
+		registration.sig[:])
+	if !validSig {
+		log.Println("Verification failed for " + prefix + " registration: Invalid signature.")
+		return false, nil
+	}
+
+	if db.IsAddressRegistered(registration.address) {
+		log.Println("Verification failed for " + prefix + " registration: Network address already registered.")
+		return false, nil
+	}
+
+	//Nodes are found by their single registration
+	if db.IsNodeRegistered(nodePubKey) {
+		log.Println("Verification failed for " + prefix + " registration: Node already registered.")
+		return false, nil
+	}
+
+	info.nodePubKey = nodePubKey
+	log.Println("Validated", prefix)
+
+	return true, info
+}
+
+//isLocalDestination checks if destination is the local address or belongs to a prefix whose gateway
+//is the local node
+func (db *DB) isLocalDestination(destination [4]byte) bool {
+
+	if destination == db.getLocalAddress() {
+		return true
+	}
+
+	info := db.resolveAddress(destination)
+	return info != nil && info.address == db.getLocalAddress()
+}
+
+//aggregateRoutingEntries drops the entries covered by the entry of a prefix holding their destination, when the
+//prefix entry is also in entries and doesn't promise more capacity. Peers reach those destinations through
+//the prefix entry with longest prefix matching and we forward them with our more specific entry
+func (db *DB) aggregateRoutingEntries(entries []*routingEntry) []*routingEntry {
+
+	var aggregated []*routingEntry
+	var shared = make(map[*routingEntry]bool)
+
+	for _, entry := range entries {
+		shared[entry] = true
+	}
+
+	for _, entry := range entries {
+
+		//Look for the longest prefix holding the destination, other than the destination itself
+		infos := db.pathInfos(entry.destination)
+		covered := false
+		for i := len(infos) - 1; i >= 0; i-- {
+			if infos[i].address == entry.destination {
+				continue
+			}
+			if prefixEntry := infos[i].routingEntry; prefixEntry != nil && shared[prefixEntry] {
+				covered = prefixEntry.capacity <= entry.capacity
+				break
+			}
+		}
+
+		if !covered {
+			aggregated = append(aggregated, entry)
+		}
+	}
+
+	return aggregated
+}
@@ -0,0 +1,205 @@
+package ldrlib
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+func TestParsePrefix(t *testing.T) {
+
+	tests := []struct {
+		cidr      string
+		address   [4]byte
+		prefixLen uint8
+		valid     bool
+	}{
+		{"10.2.0.0/16", [4]byte{10, 2, 0, 0}, 16, true},
+		{"10.2.3.128/25", [4]byte{10, 2, 3, 128}, 25, true},
+		{"10.2.0.1/16", [4]byte{}, 0, false},
+		{"10.0.0.0/7", [4]byte{}, 0, false},
+		{"10.2.0.1/32", [4]byte{}, 0, false},
+		{"10.2.0.0", [4]byte{}, 0, false},
+		{"2001:db8::/32", [4]byte{}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.cidr, func(t *testing.T) {
+			address, prefixLen, err := ParsePrefix(test.cidr)
+			if (err == nil) != test.valid {
+				t.Fatalf("ParsePrefix wants valid %v and got %v", test.valid, err)
+			}
+			if address != test.address || prefixLen != test.prefixLen {
+				t.Errorf("ParsePrefix wants %v/%v and got %v/%v", test.address, test.prefixLen, address, prefixLen)
+			}
+		})
+	}
+}
+
+func TestLongestPrefixMatch(t *testing.T) {
+
+	//carol is the gateway of 10.2.0.0/16, which holds bob's address and dave's 10.2.1.0/24
+	carolPrefix := &addressInfo{address: [4]byte{10, 2, 0, 0}, prefixLen: 16, nodePubKey: [33]byte{1}}
+	davePrefix := &addressInfo{address: [4]byte{10, 2, 1, 0}, prefixLen: 24, nodePubKey: [33]byte{2}}
+	bobAddress := &addressInfo{address: [4]byte{10, 2, 0, 5}, nodePubKey: [33]byte{3}}
+	db := createDB("")
+	for _, info := range []*addressInfo{carolPrefix, davePrefix, bobAddress} {
+		db.addAddressToDB(info)
+	}
+	carolEntry := &routingEntry{destination: carolPrefix.address, nextHop: carolPrefix.address, capacity: 5000}
+	bobEntry := &routingEntry{destination: bobAddress.address, nextHop: carolPrefix.address, capacity: 8000}
+	db.addRoutingEntryToDB(carolEntry)
+	db.addRoutingEntryToDB(bobEntry)
+
+	tests := []struct {
+		name        string
+		destination [4]byte
+		owner       *addressInfo
+		entry       *routingEntry
+	}{
+		{"registered address", [4]byte{10, 2, 0, 5}, bobAddress, bobEntry},
+		{"address in prefix", [4]byte{10, 2, 7, 7}, carolPrefix, carolEntry},
+		{"address in longer prefix", [4]byte{10, 2, 1, 9}, davePrefix, carolEntry},
+		{"network address", [4]byte{10, 2, 0, 0}, carolPrefix, carolEntry},
+		{"outside every prefix", [4]byte{10, 3, 0, 1}, nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if owner := db.resolveAddress(test.destination); owner != test.owner {
+				t.Errorf("resolveAddress wants %v and got %v", test.owner, owner)
+			}
+			if entry := db.lookupRoutingEntry(test.destination); entry != test.entry {
+				t.Errorf("lookupRoutingEntry wants %v and got %v", test.entry, entry)
+			}
+		})
+	}
+
+	//bob's entry is reached through carol's prefix, unless the prefix promises more capacity
+	if aggregated := db.aggregateRoutingEntries([]*routingEntry{carolEntry, bobEntry}); len(aggregated) != 1 || aggregated[0] != carolEntry {
+		t.Errorf("aggregateRoutingEntries wants only the prefix entry and got %v", aggregated)
+	}
+	carolEntry.capacity = 9000
+	if aggregated := db.aggregateRoutingEntries([]*routingEntry{carolEntry, bobEntry}); len(aggregated) != 2 {
+		t.Errorf("aggregateRoutingEntries dropped an entry with less capacity than its prefix: %v", aggregated)
+	}
+	if aggregated := db.aggregateRoutingEntries([]*routingEntry{bobEntry}); len(aggregated) != 1 {
+		t.Errorf("aggregateRoutingEntries dropped an entry whose prefix isn't shared: %v", aggregated)
+	}
+
+	//Removing a prefix keeps the registrations inside it
+	db.removeAddressFromDB(carolPrefix)
+	if db.IsAddressRegistered(carolPrefix.address) || !db.IsAddressRegistered(bobAddress.address) ||
+		db.resolveAddress([4]byte{10, 2, 1, 9}) != davePrefix {
+		t.Errorf("removing %v changed the registrations inside it", formatAddress(carolPrefix))
+	}
+}
+
+func TestPrefixRegistration(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+
+	//prefixTx builds a prefix registration signed by node without checking the prefix
+	prefixTx := func(node *lndfake.Node, address [4]byte, prefixLen uint8) *wire.MsgTx {
+		prefixOutput, err := newPrefixOutput(node, address, prefixLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+		tx.AddTxOut(prefixOutput)
+		return tx
+	}
+	bobAddress := [4]byte{10, 2, 0, 0}
+	bobTx, err := chainfake.RegistrationTx(0, bobAddress, SignMessage(bob, bobAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		broadcast func(chain *chainfake.Chain) error
+		valid     bool
+	}{
+		{"prefix", func(chain *chainfake.Chain) error {
+			_, err := BroadcastNewPrefixTx(chain, alice, DefaultChangeAddressType, [4]byte{10, 1, 0, 0}, 16)
+			return err
+		}, true},
+		{"prefix funded by lnd", func(chain *chainfake.Chain) error {
+			alice.SetWallet(100000, chain)
+			_, err := BroadcastNewPrefixTxWithLnd(alice, [4]byte{10, 1, 0, 0}, 16)
+			return err
+		}, true},
+		{"address after prefix", func(chain *chainfake.Chain) error {
+			if _, err := BroadcastNewPrefixTx(chain, alice, DefaultChangeAddressType, [4]byte{10, 1, 0, 0}, 16); err != nil {
+				return err
+			}
+			chain.Mine()
+			aliceAddress := [4]byte{10, 3, 0, 1}
+			aliceTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+			if err != nil {
+				return err
+			}
+			chain.Mine(aliceTx)
+			return nil
+		}, true},
+		{"host bits set", func(chain *chainfake.Chain) error {
+			chain.Mine(prefixTx(alice, [4]byte{10, 1, 0, 1}, 16))
+			return nil
+		}, false},
+		{"too short", func(chain *chainfake.Chain) error {
+			chain.Mine(prefixTx(alice, [4]byte{10, 0, 0, 0}, 7))
+			return nil
+		}, false},
+		{"network address taken", func(chain *chainfake.Chain) error {
+			chain.Mine(prefixTx(alice, bobAddress, 16))
+			return nil
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			chain := chainfake.New()
+			fundTestWallet(t, chain, 0.001)
+			chain.Mine(bobTx)
+			if err := test.broadcast(chain); err != nil {
+				t.Fatal(err)
+			}
+			chain.Mine()
+
+			db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+			db.SetConfirmationDepth(1)
+			if err := db.UpdateAddressDB(chain, alice); err != nil {
+				t.Fatal(err)
+			}
+			if db.IsNodeRegistered(alice.PubKey()) != test.valid {
+				t.Fatalf("UpdateAddressDB wants alice registered %v", test.valid)
+			}
+			if !db.IsAddressRegistered(bobAddress) {
+				t.Errorf("bob lost his address")
+			}
+			if !test.valid {
+				db.Close()
+				return
+			}
+
+			if address, _ := db.GetNodeAddress(alice.PubKey()); address != [4]byte{10, 1, 0, 0} {
+				t.Errorf("alice's node address wants %v and got %v", [4]byte{10, 1, 0, 0}, address)
+			}
+
+			//Prefixes keep their length across restarts
+			db.Close()
+			db = ReadDBFromDisk(db.filePath, RegTest, alice)
+			defer db.Close()
+			if owner := db.resolveAddress([4]byte{10, 1, 200, 3}); owner == nil || owner.nodePubKey != alice.PubKey() ||
+				owner.prefixLen != 16 {
+				t.Errorf("addresses in alice's prefix don't resolve to her, got %v", owner)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package ldrlib
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcutil/psbt"
+)
+
+//CreateRegistrationPSBT returns the base64 encoded unsigned PSBT registering address, for wallets
+//whose keys are kept offline. The registration output already carries the signature of the lightning node
+//and the inputs and change come from the bitcoind wallet, which can be watch-only.
+//Inputs carry what the signer needs to sign them, see addPSBTInput
+func CreateRegistrationPSBT(bitcoind ChainBackend, lnClient LightningBackend, changeAddressType string, address [4]byte) (string, error) {
+
+	tx, selection, err := newRegistrationTx(bitcoind, lnClient, changeAddressType, address, true)
+	if err != nil {
+		return "", err
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return "", err
+	}
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return "", err
+	}
+	for i, coin := range selection.coins {
+		if err = addPSBTInput(bitcoind, updater, i, coin); err != nil {
+			return "", err
+		}
+	}
+
+	return packet.B64Encode()
+}
+
+//addPSBTInput adds to input i what signers need to know about the coin it spends: the output, or the whole
+//transaction holding it for legacy inputs, the redeem script of P2SH outputs and the BIP32 derivation of the key
+//when the wallet knows it
+func addPSBTInput(bitcoind ChainBackend, updater *psbt.Updater, i int, coin *coin) error {
+
+	witnessProgram := coin.pkScript
+	if len(coin.redeemScript) > 0 {
+		if err := updater.AddInRedeemScript(coin.redeemScript, i); err != nil {
+			return err
+		}
+		witnessProgram = coin.redeemScript
+	}
+
+	//Segwit signatures commit to the value spent, legacy ones need the previous transaction to prove it
+	if txscript.IsWitnessProgram(witnessProgram) {
+		if err := updater.AddInWitnessUtxo(wire.NewTxOut(int64(coin.amount), coin.pkScript), i); err != nil {
+			return err
+		}
+	} else {
+		reader, ok := bitcoind.(walletTxReader)
+		if !ok {
+			return errors.New("Can't look up the transaction spent by legacy input " + coin.outPoint.String())
+		}
+		result, err := reader.GetTransaction(coin.outPoint.Hash.String())
+		if err != nil {
+			return err
+		}
+		prevTx, err := decodeRawTx(result.Hex)
+		if err != nil {
+			return err
+		}
+		if err = updater.AddInNonWitnessUtxo(prevTx, i); err != nil {
+			return err
+		}
+	}
+
+	//Wallets that don't know how the key was derived leave the signer to find it
+	info, err := bitcoind.GetAddressInfo(coin.address)
+	if err != nil {
+		return err
+	}
+	if info.PubKey == "" || info.HDKeyPath == "" || info.HDMasterFingerprint == "" {
+		return nil
+	}
+	pubKey, err := hex.DecodeString(info.PubKey)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := hex.DecodeString(info.HDMasterFingerprint)
+	if err != nil {
+		return err
+	}
+	if len(fingerprint) != 4 {
+		return errors.New("Invalid master key fingerprint " + info.HDMasterFingerprint)
+	}
+	path, err := parseBIP32Path(info.HDKeyPath)
+	if err != nil {
+		return err
+	}
+
+	//The fingerprint is serialized as a little endian number
+	return updater.AddInBip32Derivation(binary.LittleEndian.Uint32(fingerprint), path, pubKey, i)
+}
+
+//parseBIP32Path parses a key path like m/84'/1'/0'/0/5, hardened indexes are marked with ' or h
+func parseBIP32Path(keyPath string) ([]uint32, error) {
+
+	elements := strings.Split(keyPath, "/")
+	if elements[0] != "m" {
+		return nil, errors.New("Invalid BIP32 path " + keyPath)
+	}
+
+	var path []uint32
+	for _, element := range elements[1:] {
+		var offset uint32
+		if strings.HasSuffix(element, "'") || strings.HasSuffix(element, "h") {
+			element = element[:len(element)-1]
+			offset = hdkeychain.HardenedKeyStart
+		}
+		index, err := strconv.ParseUint(element, 10, 31)
+		if err != nil {
+			return nil, errors.New("Invalid BIP32 path " + keyPath)
+		}
+		path = append(path, uint32(index)+offset)
+	}
+
+	return path, nil
+}
+
+//BroadcastSignedPSBT finalizes the base64 encoded PSBT and broadcasts the transaction it holds
+//Only PSBTs carrying a valid address registration are accepted
+func BroadcastSignedPSBT(bitcoind ChainBackend, signedPSBT string) (*RegistrationTx, error) {
+
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(signedPSBT)), true)
+	if err != nil {
+		return nil, err
+	}
+
+	//The transaction could have been changed by the signer
+	registration, err := decodeRegistrationTx(packet.UnsignedTx, 0)
+	if err == errNotRegistration {
+		return nil, errors.New("The PSBT doesn't register an address")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//Signers like bitcoind usually finalize the inputs they sign themselves
+	err = psbt.MaybeFinalizeAll(packet)
+	if err == psbt.ErrNotFinalizable {
+		return nil, errors.New("The PSBT is missing signatures")
+	}
+	if err != nil {
+		return nil, err
+	}
+	tx, err := psbt.Extract(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	serializedTx, err := encodeRawTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = bitcoind.SendRawTransaction(serializedTx); err != nil {
+		return nil, err
+	}
+
+	return &RegistrationTx{Address: registration.address, funding: fundedOffline, tx: tx}, nil
+}
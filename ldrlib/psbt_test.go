@@ -0,0 +1,230 @@
+package ldrlib
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+//signPSBT signs every input of the base64 encoded PSBT with key, like an offline wallet would
+func signPSBT(t *testing.T, unsignedPSBT string, key *btcec.PrivateKey) string {
+
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(unsignedPSBT), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigHashes := txscript.NewTxSigHashes(packet.UnsignedTx)
+	for i, input := range packet.Inputs {
+		var sig []byte
+		switch {
+		case input.WitnessUtxo == nil:
+			prevOut := input.NonWitnessUtxo.TxOut[packet.UnsignedTx.TxIn[i].PreviousOutPoint.Index]
+			sig, err = txscript.RawTxInSignature(packet.UnsignedTx, i, prevOut.PkScript, txscript.SigHashAll, key)
+		case input.RedeemScript != nil:
+			sig, err = txscript.RawTxInWitnessSignature(packet.UnsignedTx, sigHashes, i, input.WitnessUtxo.Value,
+				input.RedeemScript, txscript.SigHashAll, key)
+		default:
+			sig, err = txscript.RawTxInWitnessSignature(packet.UnsignedTx, sigHashes, i, input.WitnessUtxo.Value,
+				input.WitnessUtxo.PkScript, txscript.SigHashAll, key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = updater.Sign(i, sig, key.PubKey().SerializeCompressed(), input.RedeemScript, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signedPSBT, err := packet.B64Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signedPSBT
+}
+
+func TestRegistrationPSBT(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletAddress, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()),
+		RegTest.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//otherPSBT is a signed PSBT that doesn't register anything
+	otherTx := wire.NewMsgTx(wire.TxVersion)
+	otherTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	otherTx.AddTxOut(wire.NewTxOut(1000, []byte{txscript.OP_TRUE}))
+	otherPacket, err := psbt.NewFromUnsignedTx(otherTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPacket.Inputs[0].FinalScriptSig = []byte{txscript.OP_TRUE}
+	otherPSBT, err := otherPacket.B64Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		watchOnly bool
+		sign      func(unsignedPSBT string) string
+		valid     bool
+	}{
+		{"watch-only wallet", true, func(unsignedPSBT string) string { return signPSBT(t, unsignedPSBT, key) }, true},
+		{"wallet with keys", false, func(unsignedPSBT string) string { return signPSBT(t, unsignedPSBT, key) }, true},
+		{"unsigned", true, func(unsignedPSBT string) string { return unsignedPSBT }, false},
+		{"not a registration", true, func(string) string { return otherPSBT }, false},
+		{"not a PSBT", true, func(string) string { return "cHNidP8=" }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			chain := chainfake.New()
+			addUTXO := chain.AddUTXO
+			if test.watchOnly {
+				addUTXO = chain.AddWatchOnlyUTXO
+			}
+			if err := addUTXO(walletAddress, 0.001); err != nil {
+				t.Fatal(err)
+			}
+
+			unsignedPSBT, err := CreateRegistrationPSBT(chain, alice, DefaultChangeAddressType, [4]byte{10, 0, 0, 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chain.Mempool()) != 0 {
+				t.Fatal("CreateRegistrationPSBT broadcasted a transaction")
+			}
+
+			registration, err := BroadcastSignedPSBT(chain, test.sign(unsignedPSBT))
+			if (err == nil) != test.valid {
+				t.Fatalf("BroadcastSignedPSBT wants valid %v and got %v", test.valid, err)
+			}
+			mempool := chain.Mempool()
+			if !test.valid {
+				if len(mempool) != 0 {
+					t.Error("BroadcastSignedPSBT broadcasted an invalid PSBT")
+				}
+				return
+			}
+
+			if len(mempool) != 1 || mempool[0].TxHash().String() != registration.TxHash() {
+				t.Fatalf("BroadcastSignedPSBT didn't broadcast %v", registration.TxHash())
+			}
+			if len(mempool[0].TxIn) != 1 || len(mempool[0].TxIn[0].Witness) != 2 {
+				t.Errorf("BroadcastSignedPSBT broadcasted an unsigned transaction")
+			}
+			decoded, err := decodeRegistrationTx(mempool[0], 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid, pubKey := VerifyMessage(alice, decoded.address[:], decoded.sig[:]); !valid ||
+				pubKey != GetLocalNodePubKey(alice) {
+				t.Errorf("the registration isn't signed by the lightning node")
+			}
+		})
+	}
+}
+
+func TestRegistrationPSBTInputs(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := key.PubKey().SerializeCompressed()
+	keyHash := btcutil.Hash160(pubKey)
+	legacyAddress, err := btcutil.NewAddressPubKeyHash(keyHash, RegTest.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segwitAddress, err := btcutil.NewAddressWitnessPubKeyHash(keyHash, RegTest.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	witnessProgram, err := txscript.PayToAddrScript(segwitAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nestedAddress, err := btcutil.NewAddressScriptHash(witnessProgram, RegTest.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		address      btcutil.Address
+		witness      bool
+		redeemScript []byte
+	}{
+		{"native segwit", segwitAddress, true, nil},
+		{"nested segwit", nestedAddress, true, witnessProgram},
+		{"legacy", legacyAddress, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			//The key was derived at m/84'/1'/0'/0/5 from a master key with fingerprint d34db33f
+			chain := chainfake.New()
+			if err := chain.ImportKey(pubKey, "d34db33f", "m/84'/1'/0'/0/5"); err != nil {
+				t.Fatal(err)
+			}
+			if err := chain.AddWatchOnlyUTXO(test.address, 0.001); err != nil {
+				t.Fatal(err)
+			}
+
+			unsignedPSBT, err := CreateRegistrationPSBT(chain, alice, DefaultChangeAddressType, [4]byte{10, 0, 0, 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet, err := psbt.NewFromRawBytes(strings.NewReader(unsignedPSBT), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			input := packet.Inputs[0]
+			if (input.WitnessUtxo != nil) != test.witness || (input.NonWitnessUtxo != nil) == test.witness {
+				t.Errorf("the input wants witness utxo %v and got %v, %v", test.witness, input.WitnessUtxo,
+					input.NonWitnessUtxo)
+			}
+			if !bytes.Equal(input.RedeemScript, test.redeemScript) {
+				t.Errorf("the input wants redeem script %x and got %x", test.redeemScript, input.RedeemScript)
+			}
+			wantPath := []uint32{84 + hdkeychain.HardenedKeyStart, 1 + hdkeychain.HardenedKeyStart,
+				hdkeychain.HardenedKeyStart, 0, 5}
+			if len(input.Bip32Derivation) != 1 || !bytes.Equal(input.Bip32Derivation[0].PubKey, pubKey) ||
+				input.Bip32Derivation[0].MasterKeyFingerprint != 0x3fb34dd3 ||
+				!reflect.DeepEqual(input.Bip32Derivation[0].Bip32Path, wantPath) {
+				t.Errorf("the input wants the derivation of the key and got %v", input.Bip32Derivation)
+			}
+
+			if _, err = BroadcastSignedPSBT(chain, signPSBT(t, unsignedPSBT, key)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	//ASCII protocol identifier opening every registration payload
+	registrationProtocolID = "lar"
+	//Version of the registration payload we create
+	registrationVersion uint32 = 0
+	//Version of the payloads carrying a message type, used by revocations and transfers
+	messageVersion uint32 = 1
+	//Size of a version 0 payload: protocol id (3 bytes) + version (4 bytes) + address (4 bytes) + signature (65 bytes)
+	registrationPayloadSize = 76
+	//Size of a version 1 payload: protocol id (3 bytes) + version (4 bytes) + type (1 byte) + address (4 bytes) +
+	//signature (65 bytes), transfers add the key hint of the new node (3 bytes) and prefixes their length (1 byte)
+	messagePayloadSize = 77
+	//nodeKeyHintSize is the size of the key hint identifying the new node of a transfer, the bytes following the
+	//parity byte of its public key. It keeps transfers within the 80 bytes relayed in OP_RETURN outputs
+	nodeKeyHintSize = 3
+)
+
+//messageType identifies what an on-chain message does to its address. Version 0 payloads are always registrations
+type messageType uint8
+
+const (
+	//registerMessage binds a free address to the node signing it
+	registerMessage messageType = iota
+	//revokeMessage releases an address, signed by the node owning it
+	revokeMessage
+	//transferMessage moves an address to a new node key, signed by the node owning it
+	transferMessage
+	//prefixMessage binds a free prefix to the node signing it
+	prefixMessage
+)
+
+func (t messageType) String() string {
+	switch t {
+	case registerMessage:
+		return "registration"
+	case revokeMessage:
+		return "revocation"
+	case transferMessage:
+		return "transfer"
+	case prefixMessage:
+		return "prefix registration"
+	}
+	return "message type " + strconv.Itoa(int(t))
+}
+
+//payloadSize returns the size of the version 1 payloads of a message type
+func (t messageType) payloadSize() int {
+	switch t {
+	case transferMessage:
+		return messagePayloadSize + nodeKeyHintSize
+	case prefixMessage:
+		return messagePayloadSize + 1
+	}
+	return messagePayloadSize
+}
+
+//RegistrationErrorCode identifies the reason an output carrying the protocol id isn't a valid registration
+type RegistrationErrorCode int
+
+const (
+	//ErrMalformedScript is returned for OP_RETURN scripts that can't be parsed or push more than data
+	ErrMalformedScript RegistrationErrorCode = iota
+	//ErrUnknownVersion is returned for payloads of a protocol version we don't understand
+	ErrUnknownVersion
+	//ErrInvalidPayloadSize is returned for payloads that don't have the size of their version
+	ErrInvalidPayloadSize
+	//ErrMultipleRegistrations is returned for transactions with more than one registration output
+	ErrMultipleRegistrations
+	//ErrUnknownMessageType is returned for version 1 payloads of a message type we don't understand
+	ErrUnknownMessageType
+)
+
+//RegistrationError describes a malformed registration
+type RegistrationError struct {
+	Code    RegistrationErrorCode
+	Message string
+}
+
+func (e RegistrationError) Error() string {
+	return "Invalid registration: " + e.Message
+}
+
+//errNotRegistration is returned for scripts and transactions that don't carry the protocol id at all
+var errNotRegistration = errors.New("Not an address registration")
+
+//registrationPayload is the data carried by the OP_RETURN output of a registration, revocation or transfer
+//version: version of the protocol in which the message was made
+//msgType: what the message does, always registerMessage in version 0
+//address: the lightning address the message is about
+//newNodeKeyHint: the key hint of the node receiving the address of a transfer, the signature commits to its whole key
+//prefixLen: the length of the prefix of a prefix registration
+//sig: signature of the message by the registering or owning node
+type registrationPayload struct {
+	version        uint32
+	msgType        messageType
+	address        [4]byte
+	newNodeKeyHint [nodeKeyHintSize]byte
+	prefixLen      uint8
+	sig            [65]byte
+}
+
+//encodeRegistrationScript returns the OP_RETURN script carrying payload
+//Version 0: OP_RETURN + OP_PUSHDATA1 76 + "lar" + <version> (4 bytes) + <address> (4 bytes) + <sig> (65 bytes)
+//Version 1: OP_RETURN + OP_PUSHDATA1 <size> + "lar" + <version> (4 bytes) + <type> (1 byte) + <address> (4 bytes) +
+//<new node key hint> (3 bytes, transfers only) + <prefix length> (1 byte, prefixes only) + <sig> (65 bytes)
+func encodeRegistrationScript(payload *registrationPayload) ([]byte, error) {
+
+	if payload.version == registrationVersion && payload.msgType != registerMessage {
+		return nil, errors.New("Version 0 payloads can only register addresses")
+	}
+
+	var data bytes.Buffer
+	data.WriteString(registrationProtocolID)
+	versionBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(versionBytes, payload.version)
+	data.Write(versionBytes)
+	if payload.version == messageVersion {
+		data.WriteByte(byte(payload.msgType))
+	}
+	data.Write(payload.address[:])
+	if payload.msgType == transferMessage {
+		data.Write(payload.newNodeKeyHint[:])
+	}
+	if payload.msgType == prefixMessage {
+		data.WriteByte(payload.prefixLen)
+	}
+	data.Write(payload.sig[:])
+
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData(data.Bytes()).Script()
+}
+
+//decodeRegistrationScript decodes the registration payload of an output script. Any push opcode is
+//accepted and the payload can be split over several pushes, as long as the script only pushes data.
+//errNotRegistration is returned for scripts that aren't OP_RETURN outputs carrying the protocol id
+//and a RegistrationError for registrations that are malformed
+func decodeRegistrationScript(pkScript []byte) (*registrationPayload, error) {
+
+	if len(pkScript) == 0 || pkScript[0] != txscript.OP_RETURN {
+		return nil, errNotRegistration
+	}
+
+	pushes, err := txscript.PushedData(pkScript[1:])
+	if err != nil {
+		//Only a malformed script carrying the protocol id is worth reporting
+		if bytes.Contains(pkScript, []byte(registrationProtocolID)) {
+			return nil, RegistrationError{ErrMalformedScript, err.Error()}
+		}
+		return nil, errNotRegistration
+	}
+	data := bytes.Join(pushes, nil)
+	if !bytes.HasPrefix(data, []byte(registrationProtocolID)) {
+		return nil, errNotRegistration
+	}
+	if !txscript.IsPushOnlyScript(pkScript[1:]) {
+		return nil, RegistrationError{ErrMalformedScript, "script does more than push the payload"}
+	}
+
+	var payload registrationPayload
+	payloadSize := len(data)
+	data = data[len(registrationProtocolID):]
+	if len(data) < 4 {
+		return nil, RegistrationError{ErrInvalidPayloadSize, "payload is too short to hold a version"}
+	}
+	payload.version = binary.BigEndian.Uint32(data[:4])
+	data = data[4:]
+
+	wantSize := registrationPayloadSize
+	switch payload.version {
+	case registrationVersion:
+		payload.msgType = registerMessage
+	case messageVersion:
+		if len(data) < 1 {
+			return nil, RegistrationError{ErrInvalidPayloadSize, "payload is too short to hold a message type"}
+		}
+		payload.msgType = messageType(data[0])
+		if payload.msgType > prefixMessage {
+			return nil, RegistrationError{ErrUnknownMessageType, "unknown " + payload.msgType.String()}
+		}
+		wantSize = payload.msgType.payloadSize()
+		data = data[1:]
+	default:
+		return nil, RegistrationError{ErrUnknownVersion, "unknown version " + strconv.FormatUint(uint64(payload.version), 10)}
+	}
+	if payloadSize != wantSize {
+		return nil, RegistrationError{ErrInvalidPayloadSize, "payload has " +
+			strconv.Itoa(payloadSize) + " bytes instead of " + strconv.Itoa(wantSize)}
+	}
+
+	copy(payload.address[:], data[0:4])
+	data = data[4:]
+	if payload.msgType == transferMessage {
+		copy(payload.newNodeKeyHint[:], data[:nodeKeyHintSize])
+		data = data[nodeKeyHintSize:]
+	}
+	if payload.msgType == prefixMessage {
+		payload.prefixLen = data[0]
+		data = data[1:]
+	}
+	copy(payload.sig[:], data)
+
+	return &payload, nil
+}
+
+//decodeRegistrationTx decodes the address registration, revocation or transfer carried by tx. The message output can
+//be at any index and the transaction can have any number of other outputs, but only one message.
+//errNotRegistration is returned for transactions without registration outputs
+func decodeRegistrationTx(tx *wire.MsgTx, blockHeight uint64) (*addressRegistration, error) {
+
+	var payload *registrationPayload
+
+	for _, txOut := range tx.TxOut {
+		outputPayload, err := decodeRegistrationScript(txOut.PkScript)
+		if err == errNotRegistration {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if payload != nil {
+			return nil, RegistrationError{ErrMultipleRegistrations, "transaction has more than one registration output"}
+		}
+		payload = outputPayload
+	}
+	if payload == nil {
+		return nil, errNotRegistration
+	}
+
+	var registration = addressRegistration{address: payload.address, blockHeight: blockHeight,
+		sig: payload.sig, version: payload.version, msgType: payload.msgType, newNodeKeyHint: payload.newNodeKeyHint,
+		prefixLen: payload.prefixLen}
+
+	//Get the tx hash of the registering tx, stored in the byte order it is displayed in
+	txHash := tx.TxHash()
+	for i := range txHash {
+		registration.txID[i] = txHash[len(txHash)-1-i]
+	}
+
+	return &registration, nil
+}
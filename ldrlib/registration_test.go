@@ -0,0 +1,170 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+//registrationData returns a registration payload of the given version padded or cut to size bytes
+func registrationData(version uint32, size int) []byte {
+
+	var data bytes.Buffer
+	data.WriteString(registrationProtocolID)
+	versionBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(versionBytes, version)
+	data.Write(versionBytes)
+	data.Write([]byte{10, 0, 0, 1})
+	data.Write(bytes.Repeat([]byte{0xaa}, 65))
+
+	payload := data.Bytes()
+	if size <= len(payload) {
+		return payload[:size]
+	}
+	return append(payload, make([]byte, size-len(payload))...)
+}
+
+func TestDecodeRegistrationTx(t *testing.T) {
+
+	canonical, err := encodeRegistrationScript(&registrationPayload{address: [4]byte{10, 0, 0, 1},
+		sig: [65]byte{0: 0xaa, 64: 0xaa}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(canonical[:6], []byte{txscript.OP_RETURN, txscript.OP_PUSHDATA1, 76, 'l', 'a', 'r'}) {
+		t.Fatalf("encodeRegistrationScript changed the registration format: %x", canonical)
+	}
+
+	payload := registrationData(registrationVersion, registrationPayloadSize)
+	pushData2 := append([]byte{txscript.OP_RETURN, txscript.OP_PUSHDATA2, registrationPayloadSize, 0}, payload...)
+	split, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData(payload[:7]).AddData(payload[7:]).Script()
+	unknownVersion, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData(registrationData(2, registrationPayloadSize)).Script()
+	short, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData(payload[:40]).Script()
+	long, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData(registrationData(registrationVersion, 80)).Script()
+	truncated := canonical[:40]
+	notPushOnly := append(append([]byte{}, canonical...), txscript.OP_DROP)
+	otherProtocol, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData([]byte("omni")).Script()
+	change := []byte{txscript.OP_0, 20, 21: 0}
+	revocation, err := encodeRegistrationScript(&registrationPayload{version: messageVersion, msgType: revokeMessage,
+		address: [4]byte{10, 0, 0, 1}, sig: [65]byte{0: 0xaa, 64: 0xaa}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer, err := encodeRegistrationScript(&registrationPayload{version: messageVersion, msgType: transferMessage,
+		address: [4]byte{10, 0, 0, 1}, newNodeKeyHint: [nodeKeyHintSize]byte{0xbb, 2: 0xcc}, sig: [65]byte{0: 0xaa, 64: 0xaa}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, err := encodeRegistrationScript(&registrationPayload{version: messageVersion, msgType: prefixMessage,
+		address: [4]byte{10, 0, 0, 1}, prefixLen: 16, sig: [65]byte{0: 0xaa, 64: 0xaa}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownType := append([]byte{}, revocation...)
+	unknownType[10] = 9
+	shortTransfer := append([]byte{}, revocation...)
+	shortTransfer[10] = byte(transferMessage)
+	if _, err = encodeRegistrationScript(&registrationPayload{msgType: revokeMessage}); err == nil {
+		t.Error("encodeRegistrationScript made a version 0 revocation")
+	}
+
+	tests := []struct {
+		name    string
+		scripts [][]byte
+		msgType messageType
+		code    RegistrationErrorCode
+		valid   bool
+	}{
+		{"canonical", [][]byte{canonical, change}, registerMessage, 0, true},
+		{"no change", [][]byte{canonical}, registerMessage, 0, true},
+		{"registration after change", [][]byte{change, change, canonical}, registerMessage, 0, true},
+		{"non canonical push", [][]byte{pushData2, change}, registerMessage, 0, true},
+		{"split payload", [][]byte{split, change}, registerMessage, 0, true},
+		{"unknown version", [][]byte{unknownVersion, change}, registerMessage, ErrUnknownVersion, false},
+		{"short payload", [][]byte{short, change}, registerMessage, ErrInvalidPayloadSize, false},
+		{"long payload", [][]byte{long, change}, registerMessage, ErrInvalidPayloadSize, false},
+		{"truncated script", [][]byte{truncated, change}, registerMessage, ErrMalformedScript, false},
+		{"not push only", [][]byte{notPushOnly, change}, registerMessage, ErrMalformedScript, false},
+		{"two registrations", [][]byte{canonical, canonical}, registerMessage, ErrMultipleRegistrations, false},
+		{"revocation", [][]byte{revocation, change}, revokeMessage, 0, true},
+		{"transfer", [][]byte{transfer, change}, transferMessage, 0, true},
+		{"prefix", [][]byte{prefix, change}, prefixMessage, 0, true},
+		{"unknown message type", [][]byte{unknownType, change}, 0, ErrUnknownMessageType, false},
+		{"transfer without new node", [][]byte{shortTransfer, change}, 0, ErrInvalidPayloadSize, false},
+		{"registration and revocation", [][]byte{canonical, revocation}, 0, ErrMultipleRegistrations, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			tx := wire.NewMsgTx(wire.TxVersion)
+			for _, script := range test.scripts {
+				tx.AddTxOut(wire.NewTxOut(0, script))
+			}
+
+			registration, err := decodeRegistrationTx(tx, 7)
+			if !test.valid {
+				registrationErr, ok := err.(RegistrationError)
+				if !ok || registrationErr.Code != test.code {
+					t.Fatalf("decodeRegistrationTx wants error code %v and got %v", test.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if registration.address != [4]byte{10, 0, 0, 1} || registration.blockHeight != 7 ||
+				registration.sig[0] != 0xaa || registration.sig[64] != 0xaa || registration.msgType != test.msgType {
+				t.Errorf("decodeRegistrationTx decoded %v", registration)
+			}
+			if test.msgType == transferMessage && registration.newNodeKeyHint != [nodeKeyHintSize]byte{0xbb, 2: 0xcc} {
+				t.Errorf("decodeRegistrationTx decoded new node key hint %x", registration.newNodeKeyHint)
+			}
+			if test.msgType == prefixMessage && registration.prefixLen != 16 {
+				t.Errorf("decodeRegistrationTx decoded prefix length %v", registration.prefixLen)
+			}
+		})
+	}
+
+	//Transactions without the protocol id aren't registrations at all
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxOut(wire.NewTxOut(0, otherProtocol))
+	tx.AddTxOut(wire.NewTxOut(0, change))
+	if _, err = decodeRegistrationTx(tx, 7); err != errNotRegistration {
+		t.Errorf("decodeRegistrationTx wants %v and got %v", errNotRegistration, err)
+	}
+}
+
+func TestRegistrationScriptStandardness(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		payload registrationPayload
+	}{
+		{"registration", registrationPayload{}},
+		{"revocation", registrationPayload{version: messageVersion, msgType: revokeMessage}},
+		{"transfer", registrationPayload{version: messageVersion, msgType: transferMessage}},
+		{"prefix", registrationPayload{version: messageVersion, msgType: prefixMessage, prefixLen: 16}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			script, err := encodeRegistrationScript(&test.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//Wallets and nodes only relay OP_RETURN outputs pushing up to 80 bytes
+			if class := txscript.GetScriptClass(script); class != txscript.NullDataTy {
+				t.Errorf("encodeRegistrationScript wants a %v script and got %v", txscript.NullDataTy, class)
+			}
+			if len(script) > 83 {
+				t.Errorf("encodeRegistrationScript made a %v byte script, more than the %v relayed", len(script), 83)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package ldrlib
+
+import (
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+const (
+	//maxReorgDepth is the number of scanned block hashes kept to detect reorgs.
+	//Reorgs deeper than this force a rescan from the genesis block
+	maxReorgDepth uint64 = 144
+)
+
+//getBlockHash returns the hash we scanned at height, if we still remember it
+func (db *DB) getBlockHash(height uint64) (chainhash.Hash, bool) {
+	hash, ok := db.blockHashes[height]
+	return hash, ok
+}
+
+//handleReorg checks the scanned blocks against the best chain and if they diverge
+//rolls the DB back to the last common block so the new branch is scanned
+func (db *DB) handleReorg(bitcoind ChainBackend, blockCount uint64) error {
+
+	forkHeight, err := db.findForkHeight(bitcoind, blockCount)
+	if err != nil {
+		return err
+	}
+
+	if forkHeight < db.height {
+		log.Println("Chain reorganization detected, rolling address DB back from block",
+			db.height, "to block", forkHeight)
+		return db.rollbackToHeight(forkHeight)
+	}
+
+	return nil
+}
+
+//findForkHeight returns the height of the last scanned block that is still in the best chain
+func (db *DB) findForkHeight(bitcoind ChainBackend, blockCount uint64) (uint64, error) {
+
+	//DBs written before block hashes were recorded can't be checked
+	if len(db.blockHashes) == 0 {
+		return db.height, nil
+	}
+
+	for height := db.height; height > genesisBlock; height-- {
+
+		storedHash, ok := db.getBlockHash(height)
+		if !ok {
+			break
+		}
+
+		//The best chain can be shorter than the one we scanned
+		if height > blockCount {
+			continue
+		}
+
+		chainHash, err := bitcoind.GetBlockHash(height)
+		if err != nil {
+			return 0, err
+		}
+
+		if chainHash == storedHash.String() {
+			return height, nil
+		}
+	}
+
+	log.Println("Reorg is deeper than " + strconv.FormatUint(maxReorgDepth, 10) + " blocks, rescanning from the genesis block")
+	return genesisBlock, nil
+}
+
+//rollbackToHeight removes every address registered after height, puts back the addresses revoked or
+//transferred after it and rewinds the DB to it
+func (db *DB) rollbackToHeight(height uint64) error {
+
+	var orphaned []*addressInfo
+	var restored []*addressInfo
+
+	//Undo the revocations and transfers latest first, the address infos they replaced come back unless
+	//they were registered in a disconnected block too
+	previous, err := db.loadUndoRecords(height)
+	if err != nil {
+		return err
+	}
+	var restoredAddresses = make(map[[4]byte]*addressInfo)
+	for _, info := range previous {
+		restoredAddresses[info.address] = info
+	}
+
+	for _, addressNode := range db.keyToAddressMap {
+		info := addressNode.getData().(*addressInfo)
+		if _, ok := restoredAddresses[info.address]; ok || info.registrationHeight > height {
+			log.Println("Address " + net.IP(info.address[:]).String() + " was changed in a disconnected block")
+			orphaned = append(orphaned, info)
+		}
+	}
+	for _, info := range restoredAddresses {
+		if info.registrationHeight <= height {
+			restored = append(restored, info)
+		}
+	}
+
+	//Update the disk first, the memory follows once the rollback is committed
+	err = db.commitRollback(height, orphaned, restored)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range orphaned {
+		db.removeAddressFromDB(info)
+	}
+	for _, info := range restored {
+		db.addAddressToDB(info)
+	}
+	for blockHeight := range db.blockHashes {
+		if blockHeight > height {
+			delete(db.blockHashes, blockHeight)
+		}
+	}
+	db.height = height
+
+	return nil
+}
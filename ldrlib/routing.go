@@ -6,10 +6,11 @@ import (
 	"log"
 	"math/rand"
 	"net"
-
-	"github.com/jsmvalente/ldRouting/lndwrapper"
 )
 
+//The size of the token identifying a route request (in bytes)
+const routeTokenSize = 10
+
 //Route represents a payment route
 type Route struct {
 	destination [4]byte
@@ -19,24 +20,26 @@ type Route struct {
 }
 
 func createRoute(destination [4]byte) *Route {
-	routeTokenBytes := make([]byte, 10)
+	routeTokenBytes := make([]byte, routeTokenSize)
 	rand.Read(routeTokenBytes)
 	route := &Route{destination: destination, hops: [][4]byte{}, capacity: 0}
 	route.token = string(routeTokenBytes)
 	return route
 }
 
-//GetRouteAuto gets a route to a destination
-func GetRouteAuto(client *lndwrapper.Lnd, db *DB, destination [4]byte) (*Route, error) {
+//GetRouteAuto gets a route to a destination, which can be any address of a registered prefix
+func GetRouteAuto(client LightningBackend, db *DB, destination [4]byte) (*Route, error) {
 
 	route := createRoute(destination)
 
-	if !db.IsAddressRegistered(destination) {
+	//Addresses inside a prefix are reached through the node owning the longest prefix holding them
+	destinationInfo := db.resolveAddress(destination)
+	if destinationInfo == nil {
 		return nil, errors.New("Destination is not a registered address")
 	}
 
 	//Get an node pubkey associated with destination
-	nodePubKey := db.GetAddressNode(destination)
+	nodePubKey := destinationInfo.nodePubKey
 	//Get IP address associated with node
 	ipAddresses := GetNodeIPs(client, nodePubKey)
 
@@ -54,17 +57,15 @@ func GetRouteAuto(client *lndwrapper.Lnd, db *DB, destination [4]byte) (*Route,
 
 	//Wait for the proble to reach the destination
 	//and receive the route from the destination onode
-	routeResponse := ReceiveRouteFromDestination(db, route.token)
-
-	return routeResponse, nil
+	return ReceiveRouteFromDestination(db, route.token)
 }
 
 //GetRouteManual gets a route to a destination that is a public node
-func GetRouteManual(client *lndwrapper.Lnd, db *DB, destination [4]byte, ipAddress string) (*Route, error) {
+func GetRouteManual(client LightningBackend, db *DB, destination [4]byte, ipAddress string) (*Route, error) {
 
 	route := createRoute(destination)
 
-	if !db.IsAddressRegistered(destination) {
+	if db.resolveAddress(destination) == nil {
 		return nil, errors.New("Destination is not a registered address")
 	}
 
@@ -80,14 +81,13 @@ func GetRouteManual(client *lndwrapper.Lnd, db *DB, destination [4]byte, ipAddre
 
 	//Wait for the proble to reach the destination
 	//and receive the route from the destination onode
-	routeResponse := ReceiveRouteFromDestination(db, route.token)
-
-	return routeResponse, nil
+	return ReceiveRouteFromDestination(db, route.token)
 }
 
-func addHopToRoute(client *lndwrapper.Lnd, db *DB, route *Route) ([4]byte, error) {
+func addHopToRoute(client LightningBackend, db *DB, route *Route) ([4]byte, error) {
 
-	routingEntry := db.getRoutingEntry(route.destination)
+	//The most specific entry we know wins
+	routingEntry := db.lookupRoutingEntry(route.destination)
 
 	if routingEntry == nil {
 		return [4]byte{}, errors.New("No routing information for " + net.IP(route.destination[:]).String())
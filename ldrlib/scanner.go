@@ -0,0 +1,276 @@
+package ldrlib
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jsmvalente/ldRouting/bitcoindwrapper"
+)
+
+const (
+	//Number of blocks fetched by every batch request
+	scanBatchSize = 50
+	//Number of batches fetched at the same time
+	scanWorkers = 4
+	//Number of times a batch is fetched again after a transient failure
+	scanMaxRetries = 5
+
+	//bitcoind's error code while it is still loading the block index
+	rpcInWarmup bitcoindwrapper.RPCErrorCode = -28
+)
+
+//scanRetryDelay is the wait before the first retry of a batch, doubled on every following retry
+var scanRetryDelay = time.Second
+
+//batchChainBackend is implemented by chain backends able to fetch many blocks in a single request
+type batchChainBackend interface {
+	GetBlockHashes(indexes []uint64) ([]string, error)
+	GetRawBlocks(blockHashes []string) ([]string, error)
+}
+
+//Make sure bitcoind can be scanned in batches
+var _ batchChainBackend = (*bitcoindwrapper.Bitcoind)(nil)
+
+//scannedBatch holds the consecutive blocks scanned by a single batch
+//fromBlock: height of the first block in the batch
+//hashes: hashes of the blocks in the batch, in height order
+//registrations: address registrations found in the batch, in chain order
+type scannedBatch struct {
+	fromBlock     uint64
+	hashes        []chainhash.Hash
+	registrations []*addressRegistration
+}
+
+//batchResult is the outcome of fetching the batch starting at fromBlock
+type batchResult struct {
+	fromBlock uint64
+	blocks    []*wire.MsgBlock
+	err       error
+}
+
+//scanBlocks scans the blocks from fromBlock to toBlock for address registrations and hands them to
+//handleBatch one batch at a time, in chain order. Batches are fetched by a bounded pool of workers ahead
+//of the one being handled, so every handled batch can be stored as a checkpoint to resume the scan from.
+//prevHash is the hash of the block before fromBlock, if known, and the scan stops at the first block that
+//doesn't extend the previous one (the chain reorganized under us)
+func scanBlocks(bitcoind ChainBackend, fromBlock uint64, toBlock uint64, prevHash chainhash.Hash, handleBatch func(batch *scannedBatch) error) error {
+
+	if fromBlock > toBlock {
+		return nil
+	}
+
+	//Closed when we stop handling batches so the fetching goroutines give up, none of them outlives the scan
+	var fetchers sync.WaitGroup
+	done := make(chan struct{})
+	defer fetchers.Wait()
+	defer close(done)
+
+	//Every batch gets its own result channel, queued in chain order
+	results := make(chan chan batchResult, scanWorkers)
+
+	fetchers.Add(1)
+	go func() {
+		defer fetchers.Done()
+		defer close(results)
+
+		workers := make(chan struct{}, scanWorkers)
+		for start := fromBlock; start <= toBlock; start += scanBatchSize {
+
+			end := start + scanBatchSize - 1
+			if end > toBlock || end < start {
+				end = toBlock
+			}
+
+			result := make(chan batchResult, 1)
+			select {
+			case results <- result:
+			case <-done:
+				return
+			}
+			select {
+			case workers <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			fetchers.Add(1)
+			go func(start uint64, end uint64) {
+				defer fetchers.Done()
+				defer func() { <-workers }()
+				blocks, err := fetchBlocksWithRetries(bitcoind, start, end, done)
+				result <- batchResult{fromBlock: start, blocks: blocks, err: err}
+			}(start, end)
+
+			if end == toBlock {
+				return
+			}
+		}
+	}()
+
+	for result := range results {
+
+		fetched := <-result
+		if fetched.err != nil {
+			return fetched.err
+		}
+
+		batch := &scannedBatch{fromBlock: fetched.fromBlock}
+		reorganized := false
+		for i, block := range fetched.blocks {
+
+			height := fetched.fromBlock + uint64(i)
+
+			//Stop if this block doesn't build on the last one we scanned
+			if prevHash != (chainhash.Hash{}) && block.Header.PrevBlock != prevHash {
+				log.Println("Block", height, "doesn't extend the scanned chain, stopping scan.")
+				reorganized = true
+				break
+			}
+			prevHash = block.BlockHash()
+			batch.hashes = append(batch.hashes, prevHash)
+
+			//Search every transaction on this block
+			for _, tx := range block.Transactions {
+
+				registration, err := decodeRegistrationTx(tx, height)
+				if err == errNotRegistration {
+					continue
+				}
+				if err != nil {
+					log.Println("Ignoring transaction", tx.TxHash(), "in block", height, ":", err)
+					continue
+				}
+				batch.registrations = append(batch.registrations, registration)
+
+				log.Printf("Found %v for address '%s' in block %d\n", registration.msgType, net.IP(registration.address[:]).String(), height)
+			}
+		}
+
+		if len(batch.hashes) != 0 {
+			if err := handleBatch(batch); err != nil {
+				return err
+			}
+			log.Println("Height:", batch.fromBlock+uint64(len(batch.hashes))-1)
+		}
+		if reorganized {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+//getNewAddressRegistrations scans the blockchain for new Lighting addresses starting from a certain block and
+//returns them along with the hashes of the scanned blocks, see scanBlocks
+func getNewAddressRegistrations(bitcoind ChainBackend, fromBlock uint64, toBlock uint64, prevHash chainhash.Hash) ([]*addressRegistration, []chainhash.Hash, error) {
+
+	var registrations []*addressRegistration
+	var scannedBlockHashes []chainhash.Hash
+
+	err := scanBlocks(bitcoind, fromBlock, toBlock, prevHash, func(batch *scannedBatch) error {
+		registrations = append(registrations, batch.registrations...)
+		scannedBlockHashes = append(scannedBlockHashes, batch.hashes...)
+		return nil
+	})
+
+	return registrations, scannedBlockHashes, err
+}
+
+//fetchBlocksWithRetries fetches the blocks from fromBlock to toBlock, retrying with an increasing delay
+//while the failures are transient
+func fetchBlocksWithRetries(bitcoind ChainBackend, fromBlock uint64, toBlock uint64, done <-chan struct{}) ([]*wire.MsgBlock, error) {
+
+	delay := scanRetryDelay
+	for retry := 0; ; retry++ {
+
+		blocks, err := fetchBlocks(bitcoind, fromBlock, toBlock)
+		if err == nil || !isTransientError(err) || retry == scanMaxRetries {
+			return blocks, err
+		}
+
+		log.Println("Error fetching blocks", fromBlock, "to", toBlock, "retrying in", delay, ":", err)
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return nil, errors.New("Scan cancelled")
+		}
+		delay *= 2
+	}
+}
+
+//fetchBlocks fetches the raw blocks from fromBlock to toBlock and deserializes them, in a single batch
+//per RPC call when the backend supports it and one block at a time otherwise
+func fetchBlocks(bitcoind ChainBackend, fromBlock uint64, toBlock uint64) ([]*wire.MsgBlock, error) {
+
+	var indexes []uint64
+	for index := fromBlock; index <= toBlock && index >= fromBlock; index++ {
+		indexes = append(indexes, index)
+	}
+
+	var blockHashes []string
+	var rawBlocks []string
+	var err error
+
+	if batchBackend, ok := bitcoind.(batchChainBackend); ok {
+		blockHashes, err = batchBackend.GetBlockHashes(indexes)
+		if err != nil {
+			return nil, err
+		}
+		rawBlocks, err = batchBackend.GetRawBlocks(blockHashes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, index := range indexes {
+			blockHash, err := bitcoind.GetBlockHash(index)
+			if err != nil {
+				return nil, err
+			}
+			rawBlock, err := bitcoind.GetRawBlock(blockHash)
+			if err != nil {
+				return nil, err
+			}
+			blockHashes = append(blockHashes, blockHash)
+			rawBlocks = append(rawBlocks, rawBlock)
+		}
+	}
+
+	if len(blockHashes) != len(indexes) || len(rawBlocks) != len(indexes) {
+		return nil, errors.New("Expected " + strconv.Itoa(len(indexes)) + " blocks and got " + strconv.Itoa(len(rawBlocks)))
+	}
+
+	//Every block must be the one we asked for, the order of the blocks is checked by the scan itself
+	var blocks []*wire.MsgBlock
+	for i, rawBlock := range rawBlocks {
+		block, err := decodeRawBlock(rawBlock)
+		if err != nil {
+			return nil, err
+		}
+		if block.BlockHash().String() != blockHashes[i] {
+			return nil, errors.New("Expected block " + blockHashes[i] + " and got " + block.BlockHash().String())
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+//isTransientError tells whether a failed RPC call might succeed if retried. Errors returned by bitcoind
+//itself are final unless it is still warming up, anything else (timeouts, dropped connections) is transient
+func isTransientError(err error) bool {
+
+	switch rpcErr := err.(type) {
+	case bitcoindwrapper.RPCError:
+		return rpcErr.Code == rpcInWarmup
+	case *bitcoindwrapper.RPCError:
+		return rpcErr.Code == rpcInWarmup
+	}
+
+	return true
+}
@@ -0,0 +1,158 @@
+package ldrlib
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/jsmvalente/ldRouting/bitcoindwrapper"
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+//singleBlockChain hides the batch calls of the chain it wraps
+type singleBlockChain struct {
+	ChainBackend
+}
+
+//flakyChain fails the first failures batch block hash requests including block failAt with err
+type flakyChain struct {
+	*chainfake.Chain
+	mutex    sync.Mutex
+	failAt   uint64
+	failures int
+	err      error
+}
+
+func (c *flakyChain) GetBlockHashes(indexes []uint64) ([]string, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.failures > 0 && indexes[0] <= c.failAt && c.failAt <= indexes[len(indexes)-1] {
+		c.failures--
+		return nil, c.err
+	}
+
+	return c.Chain.GetBlockHashes(indexes)
+}
+
+//newScanTestChain returns a chain spanning several batches with a registration by each node
+func newScanTestChain(t *testing.T, nodes ...*lndfake.Node) (*chainfake.Chain, []uint64) {
+
+	chain := chainfake.New()
+	var registrationHeights []uint64
+
+	for i, node := range nodes {
+		address := [4]byte{10, 0, 0, byte(i + 1)}
+		tx, err := chainfake.RegistrationTx(0, address, SignMessage(node, address[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.MineEmpty(scanBatchSize*i + 10)
+		chain.Mine(tx)
+		blockCount, _ := chain.GetBlockCount()
+		registrationHeights = append(registrationHeights, blockCount)
+	}
+	chain.MineEmpty(scanBatchSize)
+
+	return chain, registrationHeights
+}
+
+func TestScanBlocks(t *testing.T) {
+
+	scanRetryDelay = time.Millisecond
+
+	graph := lndfake.NewGraph()
+	nodes := []*lndfake.Node{newTestNode(t, graph, "alice"), newTestNode(t, graph, "bob"), newTestNode(t, graph, "carol")}
+	chain, registrationHeights := newScanTestChain(t, nodes...)
+	blockCount, _ := chain.GetBlockCount()
+
+	tests := []struct {
+		name    string
+		backend ChainBackend
+		valid   bool
+	}{
+		{"batched", chain, true},
+		{"one block at a time", singleBlockChain{chain}, true},
+		{"transient failures", &flakyChain{Chain: chain, failAt: 1, failures: 2, err: errors.New("connection reset")}, true},
+		{"warming up", &flakyChain{Chain: chain, failAt: 1, failures: 1, err: bitcoindwrapper.RPCError{Code: rpcInWarmup}}, true},
+		{"too many failures", &flakyChain{Chain: chain, failAt: 1, failures: scanMaxRetries + 1, err: errors.New("connection reset")}, false},
+		{"rpc error", &flakyChain{Chain: chain, failAt: 1, failures: 1, err: &bitcoindwrapper.RPCError{Code: -5}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var nextBlock uint64 = 1
+			var heights []uint64
+			err := scanBlocks(test.backend, 1, blockCount, chainhash.Hash{}, func(batch *scannedBatch) error {
+				if batch.fromBlock != nextBlock {
+					t.Fatalf("scanBlocks wants batch from %v and got %v", nextBlock, batch.fromBlock)
+				}
+				nextBlock += uint64(len(batch.hashes))
+				for _, registration := range batch.registrations {
+					heights = append(heights, registration.blockHeight)
+				}
+				return nil
+			})
+			if (err == nil) != test.valid {
+				t.Fatalf("scanBlocks wants valid %v and got %v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+
+			if nextBlock != blockCount+1 {
+				t.Errorf("scanBlocks wants to scan until %v and got %v", blockCount, nextBlock-1)
+			}
+			if len(heights) != len(registrationHeights) {
+				t.Fatalf("scanBlocks wants registrations at %v and got %v", registrationHeights, heights)
+			}
+			for i := range heights {
+				if heights[i] != registrationHeights[i] {
+					t.Errorf("scanBlocks wants registrations at %v and got %v", registrationHeights, heights)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateAddressDBCheckpoints(t *testing.T) {
+
+	scanRetryDelay = time.Millisecond
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	chain, _ := newScanTestChain(t, alice, bob)
+	blockCount, _ := chain.GetBlockCount()
+
+	//The second batch can't be fetched
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(1)
+	err := db.UpdateAddressDB(&flakyChain{Chain: chain, failAt: scanBatchSize + 1, failures: 1,
+		err: &bitcoindwrapper.RPCError{Code: -5}}, alice)
+	if err == nil {
+		t.Fatal("UpdateAddressDB didn't report the failed batch")
+	}
+	if db.getBlockHeight() != scanBatchSize || !db.IsAddressRegistered([4]byte{10, 0, 0, 1}) {
+		t.Fatalf("UpdateAddressDB didn't keep the first batch, height %v", db.getBlockHeight())
+	}
+
+	//The checkpoint survives a restart and the scan resumes from it
+	db.Close()
+	db = ReadDBFromDisk(db.filePath, RegTest, alice)
+	db.SetConfirmationDepth(1)
+	if db.getBlockHeight() != scanBatchSize {
+		t.Fatalf("checkpoint wants height %v and got %v", scanBatchSize, db.getBlockHeight())
+	}
+	if err = db.UpdateAddressDB(chain, alice); err != nil {
+		t.Fatal(err)
+	}
+	if db.getBlockHeight() != blockCount || !db.IsAddressRegistered([4]byte{10, 0, 0, 2}) {
+		t.Errorf("scan didn't resume from the checkpoint, height %v", db.getBlockHeight())
+	}
+}
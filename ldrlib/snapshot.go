@@ -0,0 +1,172 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/tv42/zbase32"
+)
+
+//lnSignedMsgPrefix is prepended by lnd to every message it signs
+var lnSignedMsgPrefix = []byte("Lightning Signed Message:")
+
+//Snapshot holds every address registered up to height, signed by the lightning node that made it.
+//A new node trusting the signer can load it instead of scanning the chain up to height
+//network: the network the addresses were registered in
+//height: the height of the last block included in the snapshot
+//block_hash: the hash of the block at height, checked against the chain when loading the snapshot
+//addresses: every registered address, ordered by address
+//signature: the zbase32 lnd signature of the snapshot digest by the signer node
+type Snapshot struct {
+	Network   string            `json:"network"`
+	Height    uint64            `json:"height"`
+	BlockHash string            `json:"block_hash"`
+	Addresses []ExportedAddress `json:"addresses"`
+	Signature string            `json:"signature"`
+}
+
+//digest returns the hash signed by the snapshot signer:
+//sha256(<network name length> (1 byte) + <network name> + <height> (8 bytes) + <block hash> (32 bytes) +
+//<number of addresses> (4 bytes) + n * <addressInfo> (81 bytes))
+func (snapshot *Snapshot) digest() ([]byte, error) {
+
+	var buf bytes.Buffer
+
+	if len(snapshot.Network) > 255 {
+		return nil, errors.New("Invalid snapshot network")
+	}
+	buf.WriteByte(byte(len(snapshot.Network)))
+	buf.WriteString(snapshot.Network)
+	buf.Write(serializeBlockHeight(snapshot.Height))
+
+	blockHash, err := chainhash.NewHashFromStr(snapshot.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(blockHash[:])
+
+	countBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(countBytes, uint32(len(snapshot.Addresses)))
+	buf.Write(countBytes)
+	for _, exported := range snapshot.Addresses {
+		info, err := decodeExportedAddress(&exported)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(serializeAddressInfo(info))
+	}
+
+	return chainhash.HashB(buf.Bytes()), nil
+}
+
+//CreateSnapshot returns a snapshot of every address in the DB signed by the lightning node
+func (db *DB) CreateSnapshot(lnClient LightningBackend) (*Snapshot, error) {
+
+	export := db.Export()
+	if export.BlockHash == "" {
+		return nil, errors.New("The DB doesn't know the hash of its last scanned block, update it first")
+	}
+
+	snapshot := &Snapshot{Network: export.Network, Height: export.Height, BlockHash: export.BlockHash,
+		Addresses: export.Addresses}
+	digest, err := snapshot.digest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := lnClient.SignMessage(digest)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Signature = resp.Signature
+
+	return snapshot, nil
+}
+
+//WriteSnapshot writes a snapshot of the DB signed by the lightning node to w
+func (db *DB) WriteSnapshot(w io.Writer, lnClient LightningBackend) error {
+
+	snapshot, err := db.CreateSnapshot(lnClient)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+//LoadSnapshot seeds an empty DB with the snapshot read from r if it was signed by one of the
+//trusted nodes and its last block is in the best chain. The registrations themselves aren't
+//checked against the chain, that's what the signer is trusted for, and scanning resumes after
+//the snapshot height
+func (db *DB) LoadSnapshot(r io.Reader, bitcoind ChainBackend, trustedSigners [][33]byte) error {
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	digest, err := snapshot.digest()
+	if err != nil {
+		return err
+	}
+	signer, err := recoverSigner(digest, snapshot.Signature)
+	if err != nil {
+		return err
+	}
+	trusted := false
+	for _, trustedSigner := range trustedSigners {
+		trusted = trusted || trustedSigner == signer
+	}
+	if !trusted {
+		return errors.New("Snapshot was signed by untrusted node " + PubKeyArrayToString(signer))
+	}
+
+	hash, err := db.checkImport(snapshot.Network, snapshot.Height, snapshot.BlockHash, bitcoind)
+	if err != nil {
+		return err
+	}
+
+	infos, err := decodeExportedAddresses(snapshot.Addresses, snapshot.Height)
+	if err != nil {
+		return err
+	}
+
+	err = db.loadImport(snapshot.Height, hash, infos)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Loaded snapshot of", len(infos), "addresses up to block", snapshot.Height,
+		"signed by", PubKeyArrayToString(signer))
+
+	return nil
+}
+
+//recoverSigner returns the public key of the node whose lnd signed message with signature.
+//Unlike VerifyMessage the signer doesn't need to be in the graph of the local node
+func recoverSigner(message []byte, signature string) ([33]byte, error) {
+
+	var signer [33]byte
+
+	sig, err := zbase32.DecodeString(signature)
+	if err != nil {
+		return signer, err
+	}
+
+	digest := chainhash.DoubleHashB(append(append([]byte{}, lnSignedMsgPrefix...), message...))
+	pubKey, _, err := btcec.RecoverCompact(btcec.S256(), sig, digest)
+	if err != nil {
+		return signer, err
+	}
+	copy(signer[:], pubKey.SerializeCompressed())
+
+	return signer, nil
+}
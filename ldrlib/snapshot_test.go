@@ -0,0 +1,134 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+func TestLoadSnapshot(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	carol := newTestNode(t, graph, "carol")
+	chain := chainfake.New()
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	carolAddress := [4]byte{10, 0, 0, 3}
+	aliceTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolTx, err := chainfake.RegistrationTx(0, carolAddress, SignMessage(carol, carolAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(aliceTx)
+	chain.MineEmpty(2)
+
+	//Alice snapshots her DB at height 3
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(1)
+	db.UpdateAddressDB(chain, alice)
+	var snapshot bytes.Buffer
+	if err = db.WriteSnapshot(&snapshot, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(snapshot *Snapshot)
+		signers [][33]byte
+		valid   bool
+	}{
+		{"trusted signer", func(snapshot *Snapshot) {}, [][33]byte{carol.PubKey(), alice.PubKey()}, true},
+		{"untrusted signer", func(snapshot *Snapshot) {}, [][33]byte{carol.PubKey()}, false},
+		{"tampered address", func(snapshot *Snapshot) { snapshot.Addresses[0].Address = "10.0.0.2" }, [][33]byte{alice.PubKey()}, false},
+		{"tampered height", func(snapshot *Snapshot) { snapshot.Height = 2 }, [][33]byte{alice.PubKey()}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var decoded Snapshot
+			if err := json.Unmarshal(snapshot.Bytes(), &decoded); err != nil {
+				t.Fatal(err)
+			}
+			test.tamper(&decoded)
+			tampered, err := json.Marshal(&decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bobDB := ReadDBFromDisk(newTestDataPath(t), RegTest, bob)
+			defer bobDB.Close()
+			bobDB.SetConfirmationDepth(1)
+
+			err = bobDB.LoadSnapshot(bytes.NewReader(tampered), chain, test.signers)
+			if (err == nil) != test.valid {
+				t.Fatalf("LoadSnapshot wants valid %v and got %v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+
+			if !bobDB.IsAddressRegistered(aliceAddress) || bobDB.getBlockHeight() != 3 {
+				t.Fatalf("snapshot wasn't loaded")
+			}
+		})
+	}
+
+	//Scanning resumes after the snapshot
+	bobDB := ReadDBFromDisk(newTestDataPath(t), RegTest, bob)
+	defer bobDB.Close()
+	bobDB.SetConfirmationDepth(1)
+	if err = bobDB.LoadSnapshot(bytes.NewReader(snapshot.Bytes()), chain, [][33]byte{alice.PubKey()}); err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(carolTx)
+	bobDB.UpdateAddressDB(chain, bob)
+	if !bobDB.IsAddressRegistered(carolAddress) || bobDB.getBlockHeight() != 4 {
+		t.Errorf("scan didn't resume after the snapshot height")
+	}
+}
+
+func TestActivationHeight(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	chain := chainfake.New()
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	bobAddress := [4]byte{10, 0, 0, 2}
+	aliceTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobTx, err := chainfake.RegistrationTx(0, bobAddress, SignMessage(bob, bobAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(aliceTx)
+	chain.MineEmpty(2)
+	chain.Mine(bobTx)
+
+	//Blocks below the activation height are never scanned
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(1)
+	db.SetActivationHeight(3)
+	db.UpdateAddressDB(chain, alice)
+
+	if db.IsAddressRegistered(aliceAddress) || !db.IsAddressRegistered(bobAddress) {
+		t.Errorf("scan didn't start at the activation height")
+	}
+	if db.getBlockHeight() != 4 {
+		t.Errorf("UpdateAddressDB wants height %v and got %v", 4, db.getBlockHeight())
+	}
+}
@@ -0,0 +1,514 @@
+package ldrlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	//storeFileName is the bbolt file holding the address, routing and block hash DBs
+	storeFileName string = "ldr.db"
+	//How long to wait for another client holding the store open
+	storeOpenTimeout = time.Second
+	//Suffix given to the flat DB files once they were imported into the store
+	legacyFileSuffix string = ".imported"
+)
+
+//Every change to the DB is committed in a single bbolt transaction, so a crash
+//leaves the store either before or after the change
+var (
+	//metaBucket holds the height of the last scanned block and the network of the DB
+	metaBucket = []byte("meta")
+	//addressBucket maps every registered address to its serialized addressInfo
+	addressBucket = []byte("addresses")
+	//routingBucket maps every destination to its serialized routingEntry
+	routingBucket = []byte("routing")
+	//blockHashBucket maps the big endian heights of the last scanned blocks to their hashes
+	blockHashBucket = []byte("blockhashes")
+	//trackedBucket maps the addresses registered by this client to their serialized RegistrationTx
+	//until the registrations are accepted
+	trackedBucket = []byte("tracked")
+	//undoBucket maps the big endian height of the last scanned blocks followed by the big endian index of a
+	//revocation or transfer in them to the serialized addressInfo it replaced, to undo it if the block is reorged
+	undoBucket = []byte("undo")
+
+	heightKey  = []byte("height")
+	networkKey = []byte("network")
+)
+
+//openStore opens the store in dataPath, creating it if it doesn't exist.
+//The buckets added by later format versions are created by their migrations
+func openStore(dataPath string) (*bolt.DB, error) {
+
+	store, err := bolt.Open(path.Join(dataPath, storeFileName), 0600, &bolt.Options{Timeout: storeOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{metaBucket, addressBucket, routingBucket, blockHashBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+//Close closes the store, every change is already on disk
+func (db *DB) Close() error {
+
+	if db.store == nil {
+		return nil
+	}
+
+	err := db.store.Close()
+	db.store = nil
+	return err
+}
+
+func heightToKey(height uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, height)
+	return key
+}
+
+//checkNetwork makes sure the DB was built from network and stamps new DBs with it
+func (db *DB) checkNetwork(network *Network) error {
+
+	return db.store.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+
+		dbNetwork := meta.Get(networkKey)
+		if dbNetwork == nil {
+			log.Println("Stamping DB with network", network.Name)
+			return meta.Put(networkKey, []byte(network.Name))
+		}
+
+		if string(dbNetwork) != network.Name {
+			return errors.New("DB in " + db.filePath + " belongs to " + string(dbNetwork) + ", not " + network.Name)
+		}
+		return nil
+	})
+}
+
+//loadStore reads the whole store into memory
+func (db *DB) loadStore() error {
+
+	return db.store.View(func(tx *bolt.Tx) error {
+
+		if heightBytes := tx.Bucket(metaBucket).Get(heightKey); heightBytes != nil {
+			db.height = deserializeBlockHeight(heightBytes)
+		}
+		log.Println("DB block height is", db.height)
+
+		err := tx.Bucket(addressBucket).ForEach(func(_, infoBytes []byte) error {
+			if !validAddressInfoSize(len(infoBytes)) {
+				return errors.New("Found an address record with an invalid size")
+			}
+			db.addAddressToDB(deserializeAddressInfo(infoBytes))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(blockHashBucket).ForEach(func(heightBytes, hashBytes []byte) error {
+			var hash chainhash.Hash
+			copy(hash[:], hashBytes)
+			db.blockHashes[binary.BigEndian.Uint64(heightBytes)] = hash
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(routingBucket).ForEach(func(_, entryBytes []byte) error {
+			if len(entryBytes) != routingEntrySerializedSize {
+				return errors.New("Found a routing entry with an invalid size")
+			}
+			entry := deserializeRoutingEntry(entryBytes)
+			//Entries are removed together with their addresses but never trust the disk
+			if !db.IsAddressRegistered(entry.destination) {
+				log.Println("Skipping routing entry to unregistered destination", entry.destination)
+				return nil
+			}
+			db.addRoutingEntryToDB(entry)
+			return nil
+		})
+	})
+}
+
+//commitScannedBlocks stores the address changes made by the blocks scanned starting at fromBlock,
+//their hashes and the new DB height in a single transaction and then updates the block hashes and height in memory.
+//The address changes are left to the caller, which has to keep them out of the memory if the commit fails
+func (db *DB) commitScannedBlocks(fromBlock uint64, hashes []chainhash.Hash, changes []*addressChange) error {
+
+	if len(hashes) == 0 {
+		return nil
+	}
+	lastBlock := fromBlock + uint64(len(hashes)) - 1
+
+	if db.store != nil {
+		err := db.store.Update(func(tx *bolt.Tx) error {
+
+			addresses := tx.Bucket(addressBucket)
+			undo := tx.Bucket(undoBucket)
+			var undoHeight uint64
+			var index uint32
+			for _, change := range changes {
+				if change.info != nil {
+					if err := addresses.Put(change.info.address[:], serializeAddressInfo(change.info)); err != nil {
+						return err
+					}
+				} else if err := addresses.Delete(change.previous.address[:]); err != nil {
+					return err
+				}
+
+				//Keep what the revocations and transfers replaced in case their block is reorged
+				if change.previous == nil {
+					continue
+				}
+				if change.height != undoHeight {
+					undoHeight, index = change.height, 0
+				}
+				if err := undo.Put(undoKey(change.height, index), serializeAddressInfo(change.previous)); err != nil {
+					return err
+				}
+				index++
+			}
+
+			blockHashes := tx.Bucket(blockHashBucket)
+			for i, hash := range hashes {
+				if err := blockHashes.Put(heightToKey(fromBlock+uint64(i)), hash[:]); err != nil {
+					return err
+				}
+			}
+			//Forget the hashes and changes too deep to be reorged
+			if lastBlock >= maxReorgDepth {
+				if err := deleteKeysBelow(blockHashes, heightToKey(lastBlock-maxReorgDepth+1)); err != nil {
+					return err
+				}
+				if err := deleteKeysBelow(undo, heightToKey(lastBlock-maxReorgDepth+1)); err != nil {
+					return err
+				}
+			}
+
+			return tx.Bucket(metaBucket).Put(heightKey, serializeBlockHeight(lastBlock))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, hash := range hashes {
+		db.blockHashes[fromBlock+uint64(i)] = hash
+	}
+	for height := range db.blockHashes {
+		if height+maxReorgDepth <= lastBlock {
+			delete(db.blockHashes, height)
+		}
+	}
+	db.height = lastBlock
+
+	return nil
+}
+
+//commitRollback removes the orphaned addresses, puts back the addresses restored from before the revocations
+//and transfers after height, removes the routing entries to or through any of them and the hashes and undo
+//records of the blocks after height in a single transaction, rewinding the stored DB height.
+//The memory is left to the caller
+func (db *DB) commitRollback(height uint64, orphaned []*addressInfo, restored []*addressInfo) error {
+
+	if db.store == nil {
+		return nil
+	}
+
+	var orphanedAddresses = make(map[[4]byte]bool)
+	for _, info := range orphaned {
+		orphanedAddresses[info.address] = true
+	}
+	for _, info := range restored {
+		orphanedAddresses[info.address] = true
+	}
+
+	return db.store.Update(func(tx *bolt.Tx) error {
+
+		addresses := tx.Bucket(addressBucket)
+		for address := range orphanedAddresses {
+			if err := addresses.Delete(address[:]); err != nil {
+				return err
+			}
+		}
+		for _, info := range restored {
+			if err := addresses.Put(info.address[:], serializeAddressInfo(info)); err != nil {
+				return err
+			}
+		}
+
+		var orphanedEntries [][]byte
+		routing := tx.Bucket(routingBucket)
+		err := routing.ForEach(func(destination, entryBytes []byte) error {
+			entry := deserializeRoutingEntry(entryBytes)
+			if orphanedAddresses[entry.destination] || orphanedAddresses[entry.nextHop] {
+				orphanedEntries = append(orphanedEntries, append([]byte{}, destination...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		//Keys can't be deleted while iterating
+		for _, destination := range orphanedEntries {
+			if err := routing.Delete(destination); err != nil {
+				return err
+			}
+		}
+
+		for _, bucket := range []*bolt.Bucket{tx.Bucket(blockHashBucket), tx.Bucket(undoBucket)} {
+			if err := deleteKeysFrom(bucket, heightToKey(height+1)); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(metaBucket).Put(heightKey, serializeBlockHeight(height))
+	})
+}
+
+//undoKey returns the key of the undo record of the index-th revocation or transfer in the block at height
+func undoKey(height uint64, index uint32) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key[:8], height)
+	binary.BigEndian.PutUint32(key[8:], index)
+	return key
+}
+
+//loadUndoRecords returns the address infos replaced by the revocations and transfers after height,
+//latest first
+func (db *DB) loadUndoRecords(height uint64) ([]*addressInfo, error) {
+
+	var previous []*addressInfo
+
+	if db.store == nil {
+		return nil, nil
+	}
+
+	err := db.store.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(undoBucket).Cursor()
+		for key, infoBytes := cursor.Last(); key != nil && string(key) >= string(heightToKey(height+1)); key, infoBytes = cursor.Prev() {
+			if !validAddressInfoSize(len(infoBytes)) {
+				return errors.New("Found an undo record with an invalid size")
+			}
+			previous = append(previous, deserializeAddressInfo(infoBytes))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return previous, nil
+}
+
+//deleteKeysBelow removes every key of bucket sorting before limit
+func deleteKeysBelow(bucket *bolt.Bucket, limit []byte) error {
+
+	cursor := bucket.Cursor()
+	for key, _ := cursor.First(); key != nil && string(key) < string(limit); key, _ = cursor.First() {
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//deleteKeysFrom removes every key of bucket sorting from start onwards
+func deleteKeysFrom(bucket *bolt.Bucket, start []byte) error {
+
+	var keys [][]byte
+	cursor := bucket.Cursor()
+	for key, _ := cursor.Seek(start); key != nil; key, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, key...))
+	}
+	//Keys can't be deleted while iterating
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//saveRoutingEntry stores entry, replacing the stored entry for its destination
+func (db *DB) saveRoutingEntry(entry *routingEntry) error {
+
+	if db.store == nil {
+		return nil
+	}
+
+	return db.store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(routingBucket).Put(entry.destination[:], serializeRoutingEntry(entry))
+	})
+}
+
+//saveTrackedRegistration stores registration, replacing the stored registration of its address
+func (db *DB) saveTrackedRegistration(registration *RegistrationTx) error {
+
+	if db.store == nil {
+		return nil
+	}
+
+	registrationBytes, err := serializeRegistrationTx(registration)
+	if err != nil {
+		return err
+	}
+
+	return db.store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(trackedBucket).Put(registration.Address[:], registrationBytes)
+	})
+}
+
+//deleteTrackedRegistration stops tracking the registration of address
+func (db *DB) deleteTrackedRegistration(address [4]byte) error {
+
+	if db.store == nil {
+		return nil
+	}
+
+	return db.store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(trackedBucket).Delete(address[:])
+	})
+}
+
+//loadTrackedRegistrations returns every registration tracked by the store
+func (db *DB) loadTrackedRegistrations() ([]*RegistrationTx, error) {
+
+	var registrations []*RegistrationTx
+
+	if db.store == nil {
+		return nil, nil
+	}
+
+	err := db.store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(trackedBucket).ForEach(func(_, registrationBytes []byte) error {
+			registration, err := deserializeRegistrationTx(registrationBytes)
+			if err != nil {
+				return err
+			}
+			registrations = append(registrations, registration)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return registrations, nil
+}
+
+//importLegacyFiles moves the flat files written by released clients before the store (address.db and routing.db)
+//into a new store in a single transaction.
+//The address records are imported verbatim and the files are renamed once imported
+func (db *DB) importLegacyFiles() error {
+
+	var addressDBPath = path.Join(db.filePath, addressDBFileName)
+	var legacyPaths = []string{addressDBPath, path.Join(db.filePath, routingDBFileName)}
+
+	addressDBBytes, err := ioutil.ReadFile(addressDBPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var initialized bool
+	err = db.store.View(func(tx *bolt.Tx) error {
+		initialized = tx.Bucket(metaBucket).Get(heightKey) != nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if initialized {
+		return errors.New("Found both " + storeFileName + " and " + addressDBFileName + " in " + db.filePath)
+	}
+
+	log.Println("Importing flat DB files into", storeFileName)
+	err = db.store.Update(func(tx *bolt.Tx) error {
+
+		height := uint64(genesisBlock)
+		if len(addressDBBytes) >= blockHeightSerializedSize {
+			height = deserializeBlockHeight(addressDBBytes[:blockHeightSerializedSize])
+			addressDBBytes = addressDBBytes[blockHeightSerializedSize:]
+		}
+		if err := tx.Bucket(metaBucket).Put(heightKey, serializeBlockHeight(height)); err != nil {
+			return err
+		}
+
+		addresses := tx.Bucket(addressBucket)
+		for ; len(addressDBBytes) >= addressInfoSerializedSize; addressDBBytes = addressDBBytes[addressInfoSerializedSize:] {
+			record := addressDBBytes[:addressInfoSerializedSize]
+			if err := addresses.Put(record[0:4], record); err != nil {
+				return err
+			}
+		}
+		if len(addressDBBytes) != 0 {
+			log.Println("Dropped", len(addressDBBytes), "bytes of a partially written address")
+		}
+
+		return importRecords(legacyPaths[1], routingEntrySerializedSize, func(record []byte) error {
+			return tx.Bucket(routingBucket).Put(record[0:4], record)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, legacyPath := range legacyPaths {
+		if err = os.Rename(legacyPath, legacyPath+legacyFileSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//importRecords calls importRecord with every fixed size record of the file in filePath, if it exists
+func importRecords(filePath string, recordSize int, importRecord func([]byte) error) error {
+
+	fileBytes, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for ; len(fileBytes) >= recordSize; fileBytes = fileBytes[recordSize:] {
+		if err = importRecord(fileBytes[:recordSize]); err != nil {
+			return err
+		}
+	}
+	if len(fileBytes) != 0 {
+		log.Println("Dropped", len(fileBytes), "trailing bytes of", filePath)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package ldrlib
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+func TestImportLegacyFiles(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	dataPath := newTestDataPath(t)
+
+	aliceInfo := &addressInfo{address: [4]byte{10, 0, 0, 1}, nodePubKey: alice.PubKey(), registrationHeight: 3}
+	aliceEntry := &routingEntry{destination: aliceInfo.address, nextHop: aliceInfo.address, capacity: 5000, height: 4}
+
+	//An address DB at height 7 holding alice's address and half of an address being appended when the client crashed
+	addressDB := serializeBlockHeight(7)
+	addressDB = append(addressDB, serializeAddressInfo(aliceInfo)...)
+	addressDB = append(addressDB, serializeAddressInfo(aliceInfo)[:40]...)
+	legacyFiles := map[string][]byte{addressDBFileName: addressDB, routingDBFileName: serializeRoutingEntry(aliceEntry)}
+	for fileName, fileBytes := range legacyFiles {
+		if err := ioutil.WriteFile(path.Join(dataPath, fileName), fileBytes, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := ReadDBFromDisk(dataPath, RegTest, alice)
+	defer db.Close()
+
+	if db.getBlockHeight() != 7 {
+		t.Errorf("imported DB wants height %v and got %v", 7, db.getBlockHeight())
+	}
+	if address, registered := db.GetNodeAddress(alice.PubKey()); !registered || address != aliceInfo.address {
+		t.Errorf("alice's address wasn't imported")
+	}
+	if entry := db.getRoutingEntry(aliceInfo.address); entry == nil || *entry != *aliceEntry {
+		t.Errorf("imported routing entry wants %v and got %v", aliceEntry, entry)
+	}
+	if err := db.checkNetwork(MainNet); err == nil {
+		t.Errorf("imported DB didn't keep its network")
+	}
+
+	for fileName := range legacyFiles {
+		if _, err := os.Stat(path.Join(dataPath, fileName)); !os.IsNotExist(err) {
+			t.Errorf("%v wasn't moved out of the way after the import", fileName)
+		}
+	}
+}
+
+func TestRoutingEntryPersistence(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	graph.OpenChannel(alice, bob, 100000, 60000)
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	bobAddress := [4]byte{10, 0, 0, 2}
+	infos := []*addressInfo{{address: aliceAddress, nodePubKey: alice.PubKey(), registrationHeight: 1},
+		{address: bobAddress, nodePubKey: bob.PubKey(), registrationHeight: 1}}
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	var changes []*addressChange
+	for _, info := range infos {
+		db.addAddressToDB(info)
+		changes = append(changes, &addressChange{height: 1, info: info})
+	}
+	if err := db.commitScannedBlocks(1, make([]chainhash.Hash, 1), changes); err != nil {
+		t.Fatal(err)
+	}
+
+	//Routing entries are stored as soon as they are learned, closing the DB writes nothing
+	db.addNewDestinationToDB(&destination{address: bobAddress, capacity: 80000}, bob.PubKey(), alice)
+	db.Close()
+	restarted := ReadDBFromDisk(db.filePath, RegTest, alice)
+	defer restarted.Close()
+
+	if entry := restarted.getRoutingEntry(bobAddress); entry == nil || entry.nextHop != bobAddress || entry.capacity != 60000 {
+		t.Errorf("routing entry to bob wasn't persisted, got %v", entry)
+	}
+}
+
+func TestUpdateAddressDBCommitFailure(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	chain := chainfake.New()
+
+	aliceAddress := [4]byte{10, 0, 0, 1}
+	registrationTx, err := chainfake.RegistrationTx(0, aliceAddress, SignMessage(alice, aliceAddress[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(registrationTx)
+
+	db := ReadDBFromDisk(newTestDataPath(t), RegTest, alice)
+	defer db.Close()
+	db.SetConfirmationDepth(1)
+
+	//Closing the store under the DB makes every commit fail
+	db.store.Close()
+	if err = db.UpdateAddressDB(chain, alice); err == nil {
+		t.Fatal("UpdateAddressDB stored the scanned blocks in a closed store")
+	}
+	if db.IsAddressRegistered(aliceAddress) || db.IsNodeRegistered(alice.PubKey()) || db.getBlockHeight() != 0 {
+		t.Fatalf("failed commit left alice's registration in memory")
+	}
+
+	//The next update scans the blocks again
+	if db.store, err = openStore(db.filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.UpdateAddressDB(chain, alice); err != nil {
+		t.Fatal(err)
+	}
+	if address, registered := db.GetNodeAddress(alice.PubKey()); !registered || address != aliceAddress {
+		t.Errorf("UpdateAddressDB didn't register %v for alice after the failed commit", aliceAddress)
+	}
+}
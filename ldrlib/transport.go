@@ -0,0 +1,118 @@
+package ldrlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	//The size of the length preceding every frame (in bytes)
+	frameHeaderSize = 4
+	//maxFrameSize is the largest frame accepted on an LDR connection (in bytes), enough for a table response
+	//holding as many destinations as its 2 byte count allows
+	maxFrameSize = 1 << 20
+
+	//defaultFrameTimeout bounds reading or writing a single frame during handshakes and route exchanges
+	defaultFrameTimeout = 30 * time.Second
+	//peerIdleTimeout is how long a peer connection can go without a frame, peers send table requests every 5 minutes
+	peerIdleTimeout = 15 * time.Minute
+	//routeTimeout is how long a sender waits for the destination to return its route
+	routeTimeout = 2 * time.Minute
+	//handshakeTimeout bounds a whole peer handshake, from the connection type to the last act
+	handshakeTimeout = time.Minute
+)
+
+//frameConn is the transport used by every LDR connection. Messages are sent in frames preceded by their
+//length and read in full, whatever the size of the TCP segments carrying them
+//maxFrameSize: the largest frame that will be read
+//readTimeout: how long to wait for a frame, no limit if 0
+//writeTimeout: how long to wait for a frame to be written, no limit if 0
+//deadline: if set, no frame is read or written after it whatever the timeouts, bounding exchanges of several frames
+type frameConn struct {
+	net.Conn
+	maxFrameSize uint32
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	deadline     time.Time
+}
+
+//newFrameConn wraps conn in the framed transport with the default limits
+func newFrameConn(conn net.Conn) *frameConn {
+	return &frameConn{Conn: conn, maxFrameSize: maxFrameSize, readTimeout: defaultFrameTimeout, writeTimeout: defaultFrameTimeout}
+}
+
+//nextDeadline returns the deadline of an operation limited by timeout, the earliest of it and the connection deadline
+func (conn *frameConn) nextDeadline(timeout time.Duration) time.Time {
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if !conn.deadline.IsZero() && (deadline.IsZero() || conn.deadline.Before(deadline)) {
+		deadline = conn.deadline
+	}
+
+	return deadline
+}
+
+//readFull fills b with the next bytes from the connection
+func (conn *frameConn) readFull(b []byte) error {
+
+	if err := conn.SetReadDeadline(conn.nextDeadline(conn.readTimeout)); err != nil {
+		return err
+	}
+
+	_, err := io.ReadFull(conn.Conn, b)
+	return err
+}
+
+//writeAll writes every byte of b to the connection
+func (conn *frameConn) writeAll(b []byte) error {
+
+	if err := conn.SetWriteDeadline(conn.nextDeadline(conn.writeTimeout)); err != nil {
+		return err
+	}
+
+	_, err := conn.Conn.Write(b)
+	return err
+}
+
+//readFrame reads the next frame from the connection
+//<length> (4 bytes) + <frame> (length bytes)
+func (conn *frameConn) readFrame() ([]byte, error) {
+
+	header := make([]byte, frameHeaderSize)
+	if err := conn.readFull(header); err != nil {
+		return nil, err
+	}
+
+	frameSize := binary.BigEndian.Uint32(header)
+	if frameSize > conn.maxFrameSize {
+		return nil, errors.New("Frame of " + strconv.FormatUint(uint64(frameSize), 10) + " bytes is larger than the maximum of " +
+			strconv.FormatUint(uint64(conn.maxFrameSize), 10))
+	}
+
+	frame := make([]byte, frameSize)
+	if err := conn.readFull(frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+//writeFrame writes frame to the connection preceded by its length
+func (conn *frameConn) writeFrame(frame []byte) error {
+
+	if len(frame) > maxFrameSize {
+		return errors.New("Frame of " + strconv.Itoa(len(frame)) + " bytes is larger than the maximum of " + strconv.Itoa(maxFrameSize))
+	}
+
+	message := make([]byte, frameHeaderSize, frameHeaderSize+len(frame))
+	binary.BigEndian.PutUint32(message, uint32(len(frame)))
+
+	return conn.writeAll(append(message, frame...))
+}
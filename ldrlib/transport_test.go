@@ -0,0 +1,71 @@
+package ldrlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameConn(t *testing.T) {
+
+	largeFrame := bytes.Repeat([]byte{7}, 70000)
+	oversizedHeader := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(oversizedHeader, maxFrameSize+1)
+
+	tests := []struct {
+		name  string
+		write func(conn net.Conn)
+		frame []byte
+		valid bool
+	}{
+		{"frame", func(conn net.Conn) {
+			newFrameConn(conn).writeFrame([]byte("table request"))
+		}, []byte("table request"), true},
+		{"empty frame", func(conn net.Conn) {
+			newFrameConn(conn).writeFrame(nil)
+		}, []byte{}, true},
+		{"frame larger than 16 bits", func(conn net.Conn) {
+			newFrameConn(conn).writeFrame(largeFrame)
+		}, largeFrame, true},
+		{"frame split in single bytes", func(conn net.Conn) {
+			message := append([]byte{0, 0, 0, 5}, []byte("route")...)
+			for i := range message {
+				conn.Write(message[i : i+1])
+			}
+		}, []byte("route"), true},
+		{"frame larger than the maximum", func(conn net.Conn) {
+			conn.Write(oversizedHeader)
+		}, nil, false},
+		{"truncated frame", func(conn net.Conn) {
+			conn.Write([]byte{0, 0, 0, 5, 'r'})
+			conn.Close()
+		}, nil, false},
+		{"silent peer", func(conn net.Conn) {}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			readerConn, writerConn := net.Pipe()
+			defer readerConn.Close()
+			defer writerConn.Close()
+
+			go test.write(writerConn)
+			reader := newFrameConn(readerConn)
+			reader.readTimeout = 100 * time.Millisecond
+			frame, err := reader.readFrame()
+			if (err == nil) != test.valid {
+				t.Fatalf("readFrame wants valid %v and got %v", test.valid, err)
+			}
+			if !bytes.Equal(frame, test.frame) {
+				t.Errorf("readFrame wants %d bytes and got %d", len(test.frame), len(frame))
+			}
+		})
+	}
+
+	//Frames that wouldn't be read aren't written either
+	if err := newFrameConn(nil).writeFrame(make([]byte, maxFrameSize+1)); err == nil {
+		t.Errorf("writeFrame wrote a frame larger than the maximum")
+	}
+}
@@ -1,9 +1,14 @@
 package ldrlib
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"log"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 )
 
 func routingEntryToDestination(entry *routingEntry) *destination {
@@ -179,14 +184,24 @@ func serializeAddressInfo(info *addressInfo) []byte {
 	binary.LittleEndian.PutUint32(versionBytes, info.version)
 	buf = append(buf, versionBytes...)
 
-	if len(buf) != addressInfoSerializedSize {
+	//Prefixes end with their length, single addresses keep the original format
+	if info.prefixLen != 0 {
+		buf = append(buf, info.prefixLen)
+	}
+
+	if !validAddressInfoSize(len(buf)) {
 		log.Fatalln("Error serializing addressInfo: inconsistent sizes.")
 	}
 
 	return buf
 }
 
-// Deserialize in the following order: address, nodePubKey, blockHeight, txID, version)
+//validAddressInfoSize checks if size is the size of a serialized address or prefix
+func validAddressInfoSize(size int) bool {
+	return size == addressInfoSerializedSize || size == prefixInfoSerializedSize
+}
+
+// Deserialize in the following order: address, nodePubKey, blockHeight, txID, version, prefix length (prefixes only))
 func deserializeAddressInfo(infoBytes []byte) *addressInfo {
 
 	info := addressInfo{}
@@ -194,8 +209,11 @@ func deserializeAddressInfo(infoBytes []byte) *addressInfo {
 	copy(info.address[:], infoBytes[0:4])
 	copy(info.nodePubKey[:], infoBytes[4:37])
 	info.registrationHeight = binary.LittleEndian.Uint64(infoBytes[37:45])
-	copy(info.registrationTxID[:], infoBytes[36:68])
-	info.version = binary.LittleEndian.Uint32(infoBytes[45:49])
+	copy(info.registrationTxID[:], infoBytes[45:77])
+	info.version = binary.LittleEndian.Uint32(infoBytes[77:81])
+	if len(infoBytes) == prefixInfoSerializedSize {
+		info.prefixLen = infoBytes[81]
+	}
 
 	return &info
 }
@@ -227,6 +245,17 @@ func serializeRoute(route *Route) []byte {
 	return serializedRoute
 }
 
+//validRouteSize checks that routeBytes holds a serialized route with as many hops as its header says
+func validRouteSize(routeBytes []byte) bool {
+
+	if len(routeBytes) < forwardRouteHeaderSize {
+		return false
+	}
+	numberHops := binary.LittleEndian.Uint16(routeBytes[22:24])
+
+	return len(routeBytes) == forwardRouteHeaderSize+4*int(numberHops)
+}
+
 func deserializeRoute(routeBytes []byte) *Route {
 
 	route := &Route{}
@@ -246,3 +275,70 @@ func deserializeRoute(routeBytes []byte) *Route {
 
 	return route
 }
+
+//Serialize in the following order: address, funding, fee, child fee, tx size, tx, child tx (if any)
+func serializeRegistrationTx(registration *RegistrationTx) ([]byte, error) {
+
+	var txBuffer, childBuffer bytes.Buffer
+	if err := registration.tx.Serialize(&txBuffer); err != nil {
+		return nil, err
+	}
+	if registration.child != nil {
+		if err := registration.child.Serialize(&childBuffer); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := append([]byte{}, registration.Address[:]...)
+	buf = append(buf, byte(registration.funding))
+
+	feeBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(feeBytes, uint64(registration.fee))
+	buf = append(buf, feeBytes...)
+
+	childFeeBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(childFeeBytes, uint64(registration.childFee))
+	buf = append(buf, childFeeBytes...)
+
+	txSizeBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(txSizeBytes, uint32(txBuffer.Len()))
+	buf = append(buf, txSizeBytes...)
+
+	buf = append(buf, txBuffer.Bytes()...)
+	buf = append(buf, childBuffer.Bytes()...)
+
+	return buf, nil
+}
+
+//Deserialize in the following order: address, funding, fee, child fee, tx size, tx, child tx (if any)
+func deserializeRegistrationTx(registrationBytes []byte) (*RegistrationTx, error) {
+
+	if len(registrationBytes) < registrationTxHeaderSize {
+		return nil, errors.New("Tracked registration is too short")
+	}
+
+	registration := &RegistrationTx{}
+	copy(registration.Address[:], registrationBytes[0:4])
+	registration.funding = registrationFunding(registrationBytes[4])
+	registration.fee = btcutil.Amount(binary.LittleEndian.Uint64(registrationBytes[5:13]))
+	registration.childFee = btcutil.Amount(binary.LittleEndian.Uint64(registrationBytes[13:21]))
+	txSize := binary.LittleEndian.Uint32(registrationBytes[21:25])
+
+	txBytes := registrationBytes[registrationTxHeaderSize:]
+	if uint64(len(txBytes)) < uint64(txSize) {
+		return nil, errors.New("Tracked registration is too short")
+	}
+
+	registration.tx = &wire.MsgTx{}
+	if err := registration.tx.Deserialize(bytes.NewReader(txBytes[:txSize])); err != nil {
+		return nil, err
+	}
+	if childBytes := txBytes[txSize:]; len(childBytes) != 0 {
+		registration.child = &wire.MsgTx{}
+		if err := registration.child.Deserialize(bytes.NewReader(childBytes)); err != nil {
+			return nil, err
+		}
+	}
+
+	return registration, nil
+}
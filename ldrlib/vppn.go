@@ -0,0 +1,300 @@
+package ldrlib
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+const (
+	//overlayMessageType wraps a table request, table response or forward route message exchanged within a VPPN
+	overlayMessageType uint16 = 3
+
+	//The size of the id of a VPPN (in bytes)
+	vppnIDSize = 32
+)
+
+//VPPN is a Virtual Private Payment Network, the VPN equivalent of LDR. Its members share a private
+//address space that isn't registered on-chain and exchange routing tables only among themselves,
+//over the peer connections they already have
+//Name: the name of the VPPN, members find each other's messages by its hash
+//id: the hash of the name
+//db: the in memory DB holding the private addresses of the members and the routing entries to them
+type VPPN struct {
+	Name string
+	id   [vppnIDSize]byte
+	db   *DB
+}
+
+//VPPNDefinition is the JSON representation of a VPPN, shared by its members out of band
+//name: the name of the VPPN, it has to be the same for every member
+//members: the lightning nodes in the VPPN and their private addresses
+type VPPNDefinition struct {
+	Name    string       `json:"name"`
+	Members []VPPNMember `json:"members"`
+}
+
+//VPPNMember is a member of a VPPN
+//node_pub_key: the hex encoded 33 byte compressed pubkey of the member's lightning node
+//address: the private address of the member in dotted notation, or the private prefix it is the gateway of in CIDR notation
+type VPPNMember struct {
+	NodePubKey string `json:"node_pub_key"`
+	Address    string `json:"address"`
+}
+
+//ReadVPPN reads the definition of a VPPN from filePath. The local node has to be one of its members
+func ReadVPPN(filePath string, lnClient LightningBackend) (*VPPN, error) {
+
+	definition, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVPPN(definition, lnClient)
+}
+
+//newVPPN builds a VPPN from its JSON definition, with the same rules as on-chain registrations:
+//a node has a single address and no two members share a network address
+func newVPPN(definition []byte, lnClient LightningBackend) (*VPPN, error) {
+
+	var vppnDefinition VPPNDefinition
+
+	if err := json.Unmarshal(definition, &vppnDefinition); err != nil {
+		return nil, err
+	}
+	if vppnDefinition.Name == "" {
+		return nil, errors.New("VPPN has no name")
+	}
+
+	vppn := &VPPN{Name: vppnDefinition.Name, id: sha256.Sum256([]byte(vppnDefinition.Name)), db: createDB("")}
+
+	for _, member := range vppnDefinition.Members {
+
+		address, prefixLen, err := parseExportedPrefix(member.Address)
+		if err != nil {
+			return nil, err
+		}
+		nodePubKeyBytes, err := hex.DecodeString(member.NodePubKey)
+		if err == nil {
+			_, err = btcec.ParsePubKey(nodePubKeyBytes, btcec.S256())
+		}
+		if err != nil {
+			return nil, errors.New("Invalid node public key " + member.NodePubKey)
+		}
+
+		info := &addressInfo{address: address, prefixLen: prefixLen}
+		copy(info.nodePubKey[:], nodePubKeyBytes)
+		if vppn.db.IsAddressRegistered(address) {
+			return nil, errors.New("More than one member with address " + net.IP(address[:]).String())
+		}
+		if vppn.db.IsNodeRegistered(info.nodePubKey) {
+			return nil, errors.New("Node " + member.NodePubKey + " has more than one address")
+		}
+		vppn.db.addAddressToDB(info)
+	}
+
+	localAddress, member := vppn.db.GetNodeAddress(GetLocalNodePubKey(lnClient))
+	if !member {
+		return nil, errors.New("The local node isn't a member of " + vppn.Name)
+	}
+	vppn.db.SaveLocalAddress(localAddress)
+
+	return vppn, nil
+}
+
+//JoinVPPN starts exchanging the routing table of vppn with the members we have a peer connection with
+func (db *DB) JoinVPPN(vppn *VPPN) error {
+
+	if _, joined := db.vppns[vppn.id]; joined {
+		return errors.New("Already joined " + vppn.Name)
+	}
+	db.vppns[vppn.id] = vppn
+	log.Println("Joined VPPN", vppn.Name, "as", net.IP(vppn.db.localAddress[:]))
+
+	return nil
+}
+
+//GetVPPN returns the joined VPPN called name, nil if there's none
+func (db *DB) GetVPPN(name string) *VPPN {
+	return db.vppns[sha256.Sum256([]byte(name))]
+}
+
+//memberVPPNs returns the joined VPPNs the node identified by pubKey is a member of
+func (db *DB) memberVPPNs(pubKey [33]byte) []*VPPN {
+
+	var vppns []*VPPN
+
+	for _, vppn := range db.vppns {
+		if vppn.db.IsNodeRegistered(pubKey) {
+			vppns = append(vppns, vppn)
+		}
+	}
+
+	return vppns
+}
+
+//createOverlayMessage wraps a message so it is processed within vppn
+//<type> (2 bytes) + <vppn id> (32 bytes) + <message>
+func createOverlayMessage(vppn *VPPN, message []byte) []byte {
+
+	overlayMessage := make([]byte, messageTypeSize, messageTypeSize+vppnIDSize+len(message))
+	binary.BigEndian.PutUint16(overlayMessage, overlayMessageType)
+	overlayMessage = append(overlayMessage, vppn.id[:]...)
+
+	return append(overlayMessage, message...)
+}
+
+//errUnknownEvenOverlayType is returned for VPPN messages of an unknown even type, which end the connection
+var errUnknownEvenOverlayType = errors.New("Unknown even VPPN message type")
+
+//processOverlayMessage processes a message sent by a member of a joined VPPN against the VPPN's DB
+//and returns the response to send back to the peer, if there is one
+func processOverlayMessage(db *DB, message []byte, peerPubKey [33]byte, lnClient LightningBackend) ([]byte, error) {
+
+	var id [vppnIDSize]byte
+
+	//Check if the message has enough length for it to be valid
+	if len(message) < 2*messageTypeSize+vppnIDSize {
+		return nil, errors.New("Invalid VPPN message size")
+	}
+	if binary.BigEndian.Uint16(message[:messageTypeSize]) != overlayMessageType {
+		return nil, errors.New("Invalid VPPN message type")
+	}
+
+	//Only members can read or change the routing table of a VPPN
+	copy(id[:], message[messageTypeSize:messageTypeSize+vppnIDSize])
+	vppn, joined := db.vppns[id]
+	if !joined {
+		return nil, errors.New("Message for a VPPN we haven't joined")
+	}
+	if !vppn.db.IsNodeRegistered(peerPubKey) {
+		return nil, errors.New("Peer " + PubKeyArrayToString(peerPubKey) + " isn't a member of " + vppn.Name)
+	}
+
+	message = message[messageTypeSize+vppnIDSize:]
+	switch binary.BigEndian.Uint16(message[:messageTypeSize]) {
+	case tableRequestType:
+		log.Println("New", vppn.Name, "Table Request")
+		response, err := processTableRequest(vppn.db, message)
+		if err != nil {
+			return nil, err
+		}
+		return createOverlayMessage(vppn, response), nil
+
+	case tableResponseType:
+		log.Println("New", vppn.Name, "Table Response")
+		return nil, processTableResponse(message, vppn.db, peerPubKey, lnClient)
+
+	case forwardRouteType:
+		log.Println("New", vppn.Name, "route forward request")
+		route, err := processForwardRouteMessage(message)
+		if err != nil {
+			return nil, err
+		}
+
+		//Routes are returned to the sender over the destination connection, like public ones
+		if vppn.db.isLocalDestination(route.destination) {
+			log.Println("Destination is local node. Sending route to sender.")
+			sendRouteToSender(db, route)
+			return nil, nil
+		}
+		localHop, err := addHopToRoute(lnClient, vppn.db, route)
+		if err != nil {
+			return nil, err
+		}
+		return nil, vppn.forwardRoute(route, localHop)
+	}
+
+	//Like public messages, unknown odd types are ignored
+	if messageType := binary.BigEndian.Uint16(message[:messageTypeSize]); messageType%2 == 1 {
+		log.Println("Ignoring", vppn.Name, "message of unknown odd type", messageType)
+		return nil, nil
+	}
+	return nil, errUnknownEvenOverlayType
+}
+
+//forwardRoute forwards the route to the member identified by its private address
+func (vppn *VPPN) forwardRoute(route *Route, address [4]byte) error {
+
+	log.Println("Forwarding", vppn.Name, "route:")
+	PrintRoute(route)
+
+	info := vppn.db.getAddressInfo(address)
+	if info == nil || info.peerConn == nil {
+		return errors.New("No peer connection to " + vppn.Name + " member " + net.IP(address[:]).String())
+	}
+	forwardRouteMessage, err := createForwardRouteMessage(route)
+	if err != nil {
+		return err
+	}
+
+	return writePeerMessage(info.peerConn, createOverlayMessage(vppn, forwardRouteMessage))
+}
+
+//sendTableRequestPeriodically asks the member with the private address for its routing table of the VPPN
+func (vppn *VPPN) sendTableRequestPeriodically(address [4]byte) {
+
+	connInfo := vppn.db.getPeerConn(address)
+
+	for {
+		request, err := createTableRequest(genesisBlock)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		connInfo.mutex.Lock()
+		log.Println("Sending new", vppn.Name, "table request to", net.IP(address[:]))
+		err = writePeerMessage(connInfo, createOverlayMessage(vppn, request))
+		connInfo.mutex.Unlock()
+		if err != nil {
+			log.Println("Error writing:", err)
+			return
+		}
+
+		time.Sleep(5 * time.Minute)
+	}
+}
+
+//GetRoute gets a route to a private address of the VPPN, which can be any address of a member's private prefix.
+//The probe only travels through members of the VPPN
+func (vppn *VPPN) GetRoute(client LightningBackend, db *DB, destination [4]byte) (*Route, error) {
+
+	route := createRoute(destination)
+
+	destinationInfo := vppn.db.resolveAddress(destination)
+	if destinationInfo == nil {
+		return nil, errors.New("Destination is not an address of " + vppn.Name)
+	}
+
+	//The destination sends the route back over a direct connection, stored with the public ones
+	connectToDestinationNode(client, db, destinationInfo.nodePubKey, destination, route.token)
+	if db.getDestConn(route.token) == nil {
+		return nil, errors.New("Couldn't connect to the destination node")
+	}
+
+	//Add the first hop to the route and send forward the request through the VPPN
+	localHop, err := addHopToRoute(client, vppn.db, route)
+	if err == nil {
+		err = vppn.forwardRoute(route, localHop)
+	}
+	if err != nil {
+		closeDestConnection(db, route.token)
+		return nil, err
+	}
+
+	return ReceiveRouteFromDestination(db, route.token)
+}
+
+//PrintRoutingTable prints the routing table of the VPPN
+func (vppn *VPPN) PrintRoutingTable() {
+	vppn.db.PrintRoutingTable()
+}
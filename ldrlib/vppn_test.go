@@ -0,0 +1,200 @@
+package ldrlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+//vppnDefinition returns the JSON definition of a VPPN called name with the members and addresses, in order
+func vppnDefinition(name string, members []*lndfake.Node, addresses []string) []byte {
+
+	definition := fmt.Sprintf(`{"name": %q, "members": [`, name)
+	for i, member := range members {
+		if i > 0 {
+			definition += ", "
+		}
+		definition += fmt.Sprintf(`{"node_pub_key": %q, "address": %q}`, PubKeyArrayToString(member.PubKey()), addresses[i])
+	}
+
+	return []byte(definition + "]}")
+}
+
+func TestReadVPPN(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+
+	tests := []struct {
+		name       string
+		definition []byte
+		valid      bool
+	}{
+		{"members", vppnDefinition("acme", []*lndfake.Node{alice, bob}, []string{"10.0.0.1", "10.1.0.0/16"}), true},
+		{"no name", vppnDefinition("", []*lndfake.Node{alice, bob}, []string{"10.0.0.1", "10.0.0.2"}), false},
+		{"local node isn't a member", vppnDefinition("acme", []*lndfake.Node{bob}, []string{"10.0.0.2"}), false},
+		{"shared address", vppnDefinition("acme", []*lndfake.Node{alice, bob}, []string{"10.0.0.1", "10.0.0.1"}), false},
+		{"node with two addresses", vppnDefinition("acme", []*lndfake.Node{alice, alice}, []string{"10.0.0.1", "10.0.0.2"}), false},
+		{"invalid address", vppnDefinition("acme", []*lndfake.Node{alice}, []string{"10.0.0"}), false},
+		{"invalid node", []byte(`{"name": "acme", "members": [{"node_pub_key": "02ff", "address": "10.0.0.1"}]}`), false},
+		{"not JSON", []byte("acme"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vppn, err := newVPPN(test.definition, alice)
+			if (err == nil) != test.valid {
+				t.Fatalf("newVPPN wants valid %v and got %v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+			if vppn.db.getLocalAddress() != [4]byte{10, 0, 0, 1} {
+				t.Errorf("alice has private address %v", vppn.db.getLocalAddress())
+			}
+			if owner := vppn.db.resolveAddress([4]byte{10, 1, 3, 4}); owner == nil || owner.nodePubKey != bob.PubKey() {
+				t.Errorf("bob isn't the gateway of his private prefix")
+			}
+		})
+	}
+}
+
+func TestOverlayMessages(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+	bob := newTestNode(t, graph, "bob")
+	carol := newTestNode(t, graph, "carol")
+	dave := newTestNode(t, graph, "dave")
+	graph.OpenChannel(alice, bob, 100000, 50000)
+	graph.OpenChannel(alice, dave, 100000, 50000)
+
+	aliceAddress, bobAddress, carolAddress := [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, [4]byte{10, 0, 0, 3}
+	members := []*lndfake.Node{alice, bob, carol}
+	addresses := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+	//Only dave is registered on-chain
+	db := createDB("")
+	db.addAddressToDB(&addressInfo{address: [4]byte{20, 0, 0, 4}, nodePubKey: dave.PubKey()})
+	vppn, err := newVPPN(vppnDefinition("acme", members, addresses), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.JoinVPPN(vppn); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.JoinVPPN(vppn); err == nil {
+		t.Errorf("joined the same VPPN twice")
+	}
+	if db.GetVPPN("acme") != vppn || len(db.memberVPPNs(bob.PubKey())) != 1 || len(db.memberVPPNs(dave.PubKey())) != 0 {
+		t.Fatalf("VPPN membership doesn't match the definition")
+	}
+	other, err := newVPPN(vppnDefinition("other", members, addresses), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//bob shares his route to carol, it only goes into the VPPN's routing table
+	tableResponse := make([]byte, messageTypeSize+tableResponseHeaderSize)
+	binary.BigEndian.PutUint16(tableResponse, tableResponseType)
+	binary.BigEndian.PutUint16(tableResponse[messageTypeSize:], 1)
+	tableResponse = append(tableResponse, serializeDestination(&destination{address: carolAddress, capacity: 80000})...)
+	if _, err = processOverlayMessage(db, createOverlayMessage(vppn, tableResponse), bob.PubKey(), alice); err != nil {
+		t.Fatal(err)
+	}
+	entry := vppn.db.getRoutingEntry(carolAddress)
+	if entry == nil || entry.nextHop != bobAddress || entry.capacity != 50000 {
+		t.Fatalf("alice's route to carol is %v", entry)
+	}
+	if len(db.getLastRoutingEntries(genesisBlock)) != 0 {
+		t.Errorf("the private route leaked into the public routing table")
+	}
+
+	tableRequest, err := createTableRequest(genesisBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		message []byte
+		peer    *lndfake.Node
+		valid   bool
+	}{
+		{"table request", createOverlayMessage(vppn, tableRequest), bob, true},
+		{"table request by a non member", createOverlayMessage(vppn, tableRequest), dave, false},
+		{"VPPN we haven't joined", createOverlayMessage(other, tableRequest), bob, false},
+		{"too short", createOverlayMessage(vppn, nil), bob, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := processOverlayMessage(db, test.message, test.peer.PubKey(), alice)
+			if (err == nil) != test.valid {
+				t.Fatalf("processOverlayMessage wants valid %v and got %v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+			expected, err := processTableRequest(vppn.db, tableRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(response) != string(createOverlayMessage(vppn, expected)) {
+				t.Errorf("processOverlayMessage didn't answer with the VPPN's table")
+			}
+		})
+	}
+
+	//Unknown even types end the connection and unknown odd ones are ignored, like public messages
+	if _, err = processOverlayMessage(db, createOverlayMessage(vppn, []byte{0, 100}), bob.PubKey(), alice); err != errUnknownEvenOverlayType {
+		t.Errorf("processOverlayMessage wants %v for an unknown even type and got %v", errUnknownEvenOverlayType, err)
+	}
+	if response, err := processOverlayMessage(db, createOverlayMessage(vppn, []byte{0, 101}), bob.PubKey(), alice); err != nil || response != nil {
+		t.Errorf("processOverlayMessage didn't ignore an unknown odd type: %v, %v", response, err)
+	}
+
+	//Probes to carol are forwarded to bob within the VPPN
+	aliceConn, bobConn := net.Pipe()
+	defer aliceConn.Close()
+	defer bobConn.Close()
+	var sessionKey [32]byte
+	bobConnInfo := &connInfo{conn: newFrameConn(aliceConn), sendCipher: newSessionCipher(sessionKey, sessionKey)}
+	vppn.db.addPeerConnToDB(bobAddress, bobConnInfo)
+	probe := createRoute(carolAddress)
+	probe.hops, probe.capacity = [][4]byte{aliceAddress}, 60000
+	forwardRouteMessage, err := createForwardRouteMessage(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwarded := make(chan []byte)
+	go func() {
+		encryptedMessage, err := newFrameConn(bobConn).readFrame()
+		if err != nil {
+			forwarded <- nil
+			return
+		}
+		message, _ := newSessionCipher(sessionKey, sessionKey).open(encryptedMessage)
+		forwarded <- message
+	}()
+	if _, err = processOverlayMessage(db, createOverlayMessage(vppn, forwardRouteMessage), carol.PubKey(), alice); err != nil {
+		t.Fatal(err)
+	}
+
+	message := <-forwarded
+	if len(message) < messageTypeSize+vppnIDSize || binary.BigEndian.Uint16(message) != overlayMessageType {
+		t.Fatalf("bob didn't get a VPPN message")
+	}
+	route, err := processForwardRouteMessage(message[messageTypeSize+vppnIDSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.destination != carolAddress || route.token != probe.token || len(route.hops) != 2 || route.hops[1] != bobAddress ||
+		route.capacity != 50000 {
+		t.Errorf("alice forwarded %v", route)
+	}
+}
@@ -0,0 +1,305 @@
+package ldrlib
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	//Number of blocks a registration should take to confirm, used to estimate its fee rate
+	registrationConfTarget = 6
+	//Fee rate used when the chain backend can't estimate one, like on a new regtest chain (sat/vB)
+	fallbackFeeRate btcutil.Amount = 10
+	//Lowest fee rate relayed by bitcoind (sat/vB)
+	minRelayFeeRate btcutil.Amount = 1
+	//Fee rate used by bitcoind to tell dust outputs apart (sat/vB)
+	dustRelayFeeRate btcutil.Amount = 3
+
+	//DefaultChangeAddressType is the wallet address type of the change outputs, "bech32m" creates Taproot
+	//change on bitcoind 22 or newer
+	DefaultChangeAddressType = "bech32"
+
+	//Virtual size of the version, locktime, input and output counts and segwit marker of a transaction
+	txOverheadVSize = 11
+	//Virtual size of the outpoint, sequence and empty script of an input spending a witness program
+	witnessInputBaseVSize = 41
+
+	//Input sequence signaling the transaction can be replaced by one paying a higher fee (BIP 125)
+	rbfSequence = wire.MaxTxInSequenceNum - 2
+)
+
+//InsufficientFundsError is returned when the wallet can't pay for a transaction
+//Required: value of the outputs plus the fee of spending every usable coin
+//Available: value of the usable coins of the wallet
+type InsufficientFundsError struct {
+	Required  btcutil.Amount
+	Available btcutil.Amount
+}
+
+func (e InsufficientFundsError) Error() string {
+	return fmt.Sprintf("Insufficient funds: %v required and %v available", e.Required, e.Available)
+}
+
+//coin is a wallet output that can fund a transaction
+//outPoint: the output being spent
+//amount: the value of the output
+//pkScript: the output script, needed by the signers of PSBTs
+//redeemScript: the script committed to by P2SH outputs, nil for other outputs
+//address: the wallet address the output pays to
+//spendVSize: the estimated virtual size of the input spending it
+type coin struct {
+	outPoint     wire.OutPoint
+	amount       btcutil.Amount
+	pkScript     []byte
+	redeemScript []byte
+	address      string
+	spendVSize   int64
+}
+
+//coinSelection is the set of coins funding a transaction and the change it gets back
+//coins: the selected coins
+//change: the value of the change output, 0 when the excess is too small and goes to the fee
+//fee: the fee paid by the transaction
+type coinSelection struct {
+	coins  []*coin
+	change btcutil.Amount
+	fee    btcutil.Amount
+}
+
+//estimateFeeRate returns the fee rate (sat/vB) for a transaction to confirm within confTarget blocks
+//The fallback fee rate is used when the backend doesn't have enough data for an estimate
+func estimateFeeRate(bitcoind ChainBackend, confTarget uint64) (btcutil.Amount, error) {
+
+	estimate, err := bitcoind.EstimateSmartFee(confTarget)
+	if err != nil {
+		return 0, err
+	}
+	if estimate.FeeRate <= 0 {
+		return fallbackFeeRate, nil
+	}
+
+	//Estimates are given in BTC/kvB
+	feeRate, err := btcutil.NewAmount(estimate.FeeRate)
+	if err != nil {
+		return 0, err
+	}
+	feeRate = (feeRate + 999) / 1000
+	if feeRate < minRelayFeeRate {
+		feeRate = minRelayFeeRate
+	}
+
+	return feeRate, nil
+}
+
+//newChangeScript returns the output script of a new wallet change address of addressType
+func newChangeScript(bitcoind ChainBackend, addressType string) ([]byte, error) {
+
+	address, err := bitcoind.GetRawChangeAddress(addressType)
+	if err != nil {
+		return nil, err
+	}
+	info, err := bitcoind.GetAddressInfo(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(info.ScriptPubKey)
+}
+
+//isTaprootScript tells whether pkScript is a segwit version 1 output
+func isTaprootScript(pkScript []byte) bool {
+	return len(pkScript) == 34 && pkScript[0] == txscript.OP_1 && pkScript[1] == txscript.OP_DATA_32
+}
+
+//inputVSize estimates the virtual size of an input spending pkScript, assuming the wallet
+//signs it with a single key
+func inputVSize(pkScript []byte) int64 {
+
+	switch {
+	case isTaprootScript(pkScript):
+		//Schnorr signature
+		return witnessInputBaseVSize + 17
+	case txscript.GetScriptClass(pkScript) == txscript.WitnessV0PubKeyHashTy:
+		//Signature and public key
+		return witnessInputBaseVSize + 27
+	case txscript.GetScriptClass(pkScript) == txscript.ScriptHashTy:
+		//Nested P2WPKH, the only kind of P2SH output created by bitcoind wallets
+		return witnessInputBaseVSize + 23 + 27
+	default:
+		//P2PKH with the signature and public key in the script
+		return 148
+	}
+}
+
+//outputVSize returns the size of an output paying to pkScript
+func outputVSize(pkScript []byte) int64 {
+	return int64(8 + wire.VarIntSerializeSize(uint64(len(pkScript))) + len(pkScript))
+}
+
+//dustThreshold returns the lowest value an output paying to pkScript can have to be relayed
+//Like bitcoind it is the fee of creating and spending the output at the dust relay fee rate
+func dustThreshold(pkScript []byte) btcutil.Amount {
+
+	spendVSize := int64(148)
+	if txscript.IsWitnessProgram(pkScript) {
+		spendVSize = witnessInputBaseVSize + 26
+	}
+
+	return btcutil.Amount(outputVSize(pkScript)+spendVSize) * dustRelayFeeRate
+}
+
+//walletCoins returns the confirmed and spendable wallet outputs worth spending at feeRate
+//With watchOnly the outputs the wallet knows how to spend but holds no keys for are returned too,
+//for transactions signed somewhere else
+func walletCoins(bitcoind ChainBackend, feeRate btcutil.Amount, watchOnly bool) ([]*coin, error) {
+
+	unspentOutputs, err := bitcoind.ListUnspent()
+	if err != nil {
+		return nil, err
+	}
+
+	var coins []*coin
+	for _, unspentOutput := range unspentOutputs {
+
+		usable := unspentOutput.Spendable || (watchOnly && unspentOutput.Solvable)
+		if !usable || unspentOutput.Confirmations < 1 {
+			continue
+		}
+		hash, err := chainhash.NewHashFromStr(unspentOutput.TxID)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := btcutil.NewAmount(unspentOutput.Amount)
+		if err != nil {
+			return nil, err
+		}
+		pkScript, err := hex.DecodeString(unspentOutput.ScriptPubKey)
+		if err != nil {
+			return nil, err
+		}
+		redeemScript, err := hex.DecodeString(unspentOutput.RedeemScript)
+		if err != nil {
+			return nil, err
+		}
+
+		//Outputs that cost more to spend than they are worth are left alone
+		spendVSize := inputVSize(pkScript)
+		if amount <= btcutil.Amount(spendVSize)*feeRate {
+			continue
+		}
+
+		coins = append(coins, &coin{outPoint: *wire.NewOutPoint(hash, unspentOutput.Vout), amount: amount,
+			pkScript: pkScript, redeemScript: redeemScript, address: unspentOutput.Address, spendVSize: spendVSize})
+	}
+
+	return coins, nil
+}
+
+//selectCoins picks the coins paying for outputs at feeRate, with change going to changeScript.
+//The smallest coin able to pay for everything alone is preferred, otherwise the largest coins are
+//added until the outputs and fee are covered. Change below the dust threshold is added to the fee
+func selectCoins(coins []*coin, outputs []*wire.TxOut, changeScript []byte, feeRate btcutil.Amount) (*coinSelection, error) {
+
+	var target btcutil.Amount
+	var vSize int64 = txOverheadVSize
+	for _, output := range outputs {
+		target += btcutil.Amount(output.Value)
+		vSize += outputVSize(output.PkScript)
+	}
+	changeVSize := outputVSize(changeScript)
+	dust := dustThreshold(changeScript)
+
+	//fund returns the selection made of coins, if they are enough
+	fund := func(coins []*coin) (*coinSelection, bool) {
+
+		var total btcutil.Amount
+		inputsVSize := vSize
+		for _, coin := range coins {
+			total += coin.amount
+			inputsVSize += coin.spendVSize
+		}
+
+		fee := btcutil.Amount(inputsVSize+changeVSize) * feeRate
+		if change := total - target - fee; change >= dust {
+			return &coinSelection{coins: coins, change: change, fee: fee}, true
+		}
+		fee = btcutil.Amount(inputsVSize) * feeRate
+		if total >= target+fee {
+			return &coinSelection{coins: coins, fee: total - target}, true
+		}
+
+		return nil, false
+	}
+
+	sorted := append([]*coin{}, coins...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].amount < sorted[j].amount })
+
+	for _, candidate := range sorted {
+		if selection, funded := fund([]*coin{candidate}); funded {
+			return selection, nil
+		}
+	}
+
+	var selected []*coin
+	var available btcutil.Amount
+	for i := len(sorted) - 1; i >= 0; i-- {
+		selected = append(selected, sorted[i])
+		available += sorted[i].amount
+		if selection, funded := fund(selected); funded {
+			return selection, nil
+		}
+	}
+
+	required := target
+	for _, coin := range selected {
+		vSize += coin.spendVSize
+	}
+	required += btcutil.Amount(vSize) * feeRate
+
+	return nil, InsufficientFundsError{Required: required, Available: available}
+}
+
+//fundTx adds to tx the wallet inputs paying for its outputs at the estimated fee rate and the change output
+//going to a new wallet address of changeAddressType. watchOnly also spends the watch-only coins of the wallet
+func fundTx(bitcoind ChainBackend, tx *wire.MsgTx, changeAddressType string, watchOnly bool) (*coinSelection, error) {
+
+	if len(tx.TxIn) != 0 {
+		return nil, errors.New("Transaction is already funded")
+	}
+
+	feeRate, err := estimateFeeRate(bitcoind, registrationConfTarget)
+	if err != nil {
+		return nil, err
+	}
+	coins, err := walletCoins(bitcoind, feeRate, watchOnly)
+	if err != nil {
+		return nil, err
+	}
+	changeScript, err := newChangeScript(bitcoind, changeAddressType)
+	if err != nil {
+		return nil, err
+	}
+
+	selection, err := selectCoins(coins, tx.TxOut, changeScript, feeRate)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, coin := range selection.coins {
+		txIn := wire.NewTxIn(&coin.outPoint, nil, nil)
+		txIn.Sequence = rbfSequence
+		tx.AddTxIn(txIn)
+	}
+	if selection.change != 0 {
+		tx.AddTxOut(wire.NewTxOut(int64(selection.change), changeScript))
+	}
+
+	return selection, nil
+}
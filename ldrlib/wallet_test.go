@@ -0,0 +1,145 @@
+package ldrlib
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/jsmvalente/ldRouting/chainfake"
+	"github.com/jsmvalente/ldRouting/lndfake"
+)
+
+func TestSelectCoins(t *testing.T) {
+
+	p2wpkh := []byte{txscript.OP_0, txscript.OP_DATA_20, 21: 0}
+	outputs := []*wire.TxOut{wire.NewTxOut(registerOpRetOutAmount, make([]byte, 79))}
+	newCoins := func(amounts ...btcutil.Amount) []*coin {
+		var coins []*coin
+		for i, amount := range amounts {
+			coins = append(coins, &coin{outPoint: wire.OutPoint{Index: uint32(i)}, amount: amount, spendVSize: inputVSize(p2wpkh)})
+		}
+		return coins
+	}
+
+	tests := []struct {
+		name     string
+		coins    []*coin
+		selected []btcutil.Amount
+		change   bool
+		valid    bool
+	}{
+		{"smallest single coin", newCoins(50000, 5000, 20000), []btcutil.Amount{5000}, true, true},
+		{"several coins", newCoins(1000, 1500, 1600), []btcutil.Amount{1600, 1500}, true, true},
+		{"dust change goes to the fee", newCoins(1800), []btcutil.Amount{1800}, false, true},
+		{"insufficient funds", newCoins(500, 700), nil, false, false},
+		{"no coins", nil, nil, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			selection, err := selectCoins(test.coins, outputs, p2wpkh, 10)
+			if !test.valid {
+				if _, ok := err.(InsufficientFundsError); !ok {
+					t.Fatalf("selectCoins wants InsufficientFundsError and got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(selection.coins) != len(test.selected) {
+				t.Fatalf("selectCoins wants %v coins and got %v", len(test.selected), len(selection.coins))
+			}
+			var total btcutil.Amount
+			for i, coin := range selection.coins {
+				if coin.amount != test.selected[i] {
+					t.Errorf("selectCoins wants coin %v and got %v", test.selected[i], coin.amount)
+				}
+				total += coin.amount
+			}
+			if (selection.change != 0) != test.change {
+				t.Errorf("selectCoins wants change %v and got %v", test.change, selection.change)
+			}
+			if selection.change != 0 && selection.change < dustThreshold(p2wpkh) {
+				t.Errorf("selectCoins made dust change %v", selection.change)
+			}
+			if total != registerOpRetOutAmount+selection.change+selection.fee {
+				t.Errorf("selectCoins doesn't add up: %v in, %v change and %v fee", total, selection.change, selection.fee)
+			}
+		})
+	}
+}
+
+func TestEstimateFeeRate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		feeRate float64
+		want    btcutil.Amount
+	}{
+		{"no estimate", 0, fallbackFeeRate},
+		{"estimate", 0.00020001, 21},
+		{"below relay fee", 0.000001, minRelayFeeRate},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := chainfake.New()
+			chain.SetFeeRate(test.feeRate)
+			feeRate, err := estimateFeeRate(chain, registrationConfTarget)
+			if err != nil || feeRate != test.want {
+				t.Errorf("estimateFeeRate wants %v and got %v, %v", test.want, feeRate, err)
+			}
+		})
+	}
+}
+
+func TestBroadcastNewAddressTxFunding(t *testing.T) {
+
+	graph := lndfake.NewGraph()
+	alice := newTestNode(t, graph, "alice")
+
+	tests := []struct {
+		name       string
+		amounts    []float64
+		changeType string
+		inputs     int
+		outputs    int
+		valid      bool
+	}{
+		{"several utxos without change", []float64{0.000004, 0.000004, 0.000004}, DefaultChangeAddressType, 3, 1, true},
+		{"legacy change", []float64{0.001}, "legacy", 1, 2, true},
+		{"insufficient funds", []float64{0.000004}, DefaultChangeAddressType, 0, 0, false},
+		{"unknown change type", []float64{0.001}, "unknown", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			chain := chainfake.New()
+			chain.SetFeeRate(0.00002)
+			for _, amount := range test.amounts {
+				fundTestWallet(t, chain, amount)
+			}
+
+			_, err := BroadcastNewAddressTx(chain, alice, test.changeType, [4]byte{10, 0, 0, 1})
+			if (err == nil) != test.valid {
+				t.Fatalf("BroadcastNewAddressTx wants valid %v and got %v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+
+			mempool := chain.Mempool()
+			if len(mempool) != 1 || len(mempool[0].TxIn) != test.inputs || len(mempool[0].TxOut) != test.outputs {
+				t.Fatalf("BroadcastNewAddressTx wants %v inputs and %v outputs", test.inputs, test.outputs)
+			}
+			if _, err = decodeRegistrationTx(mempool[0], 0); err != nil {
+				t.Errorf("broadcasted transaction isn't a registration: %v", err)
+			}
+		})
+	}
+}
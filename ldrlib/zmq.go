@@ -0,0 +1,72 @@
+package ldrlib
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/lightninglabs/gozmq"
+)
+
+const (
+	//Topics bitcoind publishes when a new block is connected
+	rawBlockTopic  string = "rawblock"
+	hashBlockTopic string = "hashblock"
+	//Block messages are made of the topic, the block or its hash and a sequence number
+	blockMessageParts = 3
+
+	//How long to wait for a zmq message before checking the connection again
+	zmqReadTimeout = time.Minute
+
+	//DefaultPollInterval is how often the chain is polled for new blocks,
+	//block notifications make the address DB update between polls
+	DefaultPollInterval = 10 * time.Minute
+)
+
+//SubscribeToBlocks connects to the zmq publisher of the bitcoin client (e.g. "tcp://127.0.0.1:28332")
+//and returns a channel that receives a notification every time a block is connected.
+//Notifications that arrive while the previous one wasn't handled yet are merged.
+//The channel is closed if the subscription fails for good.
+func SubscribeToBlocks(zmqAddress string) (<-chan struct{}, error) {
+
+	conn, err := gozmq.Subscribe(zmqAddress, []string{rawBlockTopic, hashBlockTopic}, zmqReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := make(chan struct{}, 1)
+
+	go func() {
+		defer conn.Close()
+		defer close(notifications)
+
+		for {
+			msg, err := conn.Receive(nil)
+			if err != nil {
+				//Timeouts happen when there are no new blocks and while gozmq reconnects
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue
+				}
+				log.Println("Block notifications stopped:", err)
+				return
+			}
+
+			if len(msg) < blockMessageParts {
+				log.Println("Skipping zmq message with", len(msg), "parts")
+				continue
+			}
+			topic := string(msg[0])
+			if topic != rawBlockTopic && topic != hashBlockTopic {
+				continue
+			}
+
+			log.Println("Received", topic, "notification")
+			select {
+			case notifications <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return notifications, nil
+}
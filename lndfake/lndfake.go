@@ -0,0 +1,382 @@
+package lndfake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jsmvalente/ldRouting/lndwrapper"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/tv42/zbase32"
+)
+
+//signedMsgPrefix is prepended by lnd to every message it signs or verifies
+var signedMsgPrefix = []byte("Lightning Signed Message:")
+
+//feeRateFloor is the lowest fee rate used by lnd (sat/kw)
+const feeRateFloor = 253
+
+//Publisher receives the transactions published by the on-chain wallets of the nodes, chainfake.Chain is one
+type Publisher interface {
+	SendRawTransaction(signedTx string) (string, error)
+}
+
+//A Graph is an in-memory lightning network shared by the fake nodes added to it
+type Graph struct {
+	mutex      sync.Mutex
+	nodes      map[string]*Node
+	channels   []*channel
+	nextChanID uint64
+	network    string
+}
+
+//channel is an edge between two fake nodes
+//balance1 is the balance held by node1, the rest of the capacity belongs to node2
+type channel struct {
+	id       uint64
+	node1    *Node
+	node2    *Node
+	capacity int64
+	balance1 int64
+}
+
+// A Node is a fake lnd instance that answers from the graph it belongs to
+type Node struct {
+	graph     *Graph
+	privKey   *btcec.PrivateKey
+	pubKey    string
+	alias     string
+	addresses []string
+	//balance and publisher make up the on-chain wallet, nodes without a publisher don't have one
+	balance   int64
+	publisher Publisher
+	spent     uint32
+}
+
+//NewGraph returns an empty lightning network
+func NewGraph() *Graph {
+	return &Graph{nodes: make(map[string]*Node), nextChanID: 1, network: "regtest"}
+}
+
+//SetNetwork changes the bitcoin network the nodes report, regtest by default
+func (g *Graph) SetNetwork(network string) {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.network = network
+}
+
+//AddNode creates a new node with a random identity key announcing the given
+//"host:port" addresses
+func (g *Graph) AddNode(alias string, addresses ...string) (*Node, error) {
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	return g.AddNodeWithKey(privKey, alias, addresses...), nil
+}
+
+//AddNodeWithKey creates a new node using privKey as its identity key
+func (g *Graph) AddNodeWithKey(privKey *btcec.PrivateKey, alias string, addresses ...string) *Node {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	node := &Node{graph: g, privKey: privKey, alias: alias, addresses: addresses,
+		pubKey: hex.EncodeToString(privKey.PubKey().SerializeCompressed())}
+	g.nodes[node.pubKey] = node
+
+	return node
+}
+
+//OpenChannel opens a channel between a and b where a holds localBalance of the capacity
+func (g *Graph) OpenChannel(a *Node, b *Node, capacity int64, localBalance int64) uint64 {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	//lnd orders the edge nodes by their serialized public keys
+	c := &channel{id: g.nextChanID, node1: a, node2: b, capacity: capacity, balance1: localBalance}
+	if a.pubKey > b.pubKey {
+		c.node1, c.node2 = b, a
+		c.balance1 = capacity - localBalance
+	}
+	g.channels = append(g.channels, c)
+	g.nextChanID++
+
+	return c.id
+}
+
+//SetLocalBalance changes the balance held by node on the channel identified by chanID
+func (g *Graph) SetLocalBalance(chanID uint64, node *Node, localBalance int64) error {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, c := range g.channels {
+		if c.id != chanID {
+			continue
+		}
+		switch node {
+		case c.node1:
+			c.balance1 = localBalance
+		case c.node2:
+			c.balance1 = c.capacity - localBalance
+		default:
+			return errors.New("node is not an end of the channel")
+		}
+		return nil
+	}
+
+	return errors.New("unknown channel")
+}
+
+//PubKey returns the 33 byte compressed identity key of the node
+func (n *Node) PubKey() [33]byte {
+	var pubKey [33]byte
+	copy(pubKey[:], n.privKey.PubKey().SerializeCompressed())
+	return pubKey
+}
+
+//PrivKey returns the identity private key of the node
+func (n *Node) PrivKey() *btcec.PrivateKey {
+	return n.privKey
+}
+
+//GetInfo returns some info about the node
+func (n *Node) GetInfo() (*lndwrapper.GetInfoResponse, error) {
+
+	n.graph.mutex.Lock()
+	defer n.graph.mutex.Unlock()
+
+	var numChannels uint32
+	for _, c := range n.graph.channels {
+		if c.node1 == n || c.node2 == n {
+			numChannels++
+		}
+	}
+
+	return &lndwrapper.GetInfoResponse{IdentityPubkey: n.pubKey, Alias: n.alias,
+		NumActiveChannels: numChannels, SyncedToChain: true, SyncedToGraph: true,
+		Chains: []*lnrpc.Chain{{Chain: "bitcoin", Network: n.graph.network}}}, nil
+}
+
+//GetNodeInfo returns some info about a node identified by pubkey
+func (n *Node) GetNodeInfo(pubkey string, includeChannels bool) (*lndwrapper.NodeInfo, error) {
+
+	n.graph.mutex.Lock()
+	defer n.graph.mutex.Unlock()
+
+	node, ok := n.graph.nodes[pubkey]
+	if !ok {
+		return nil, errors.New("unable to find node")
+	}
+
+	info := &lndwrapper.NodeInfo{Node: &lnrpc.LightningNode{PubKey: node.pubKey, Alias: node.alias}}
+	for _, address := range node.addresses {
+		info.Node.Addresses = append(info.Node.Addresses, &lnrpc.NodeAddress{Network: "tcp", Addr: address})
+	}
+
+	for _, c := range n.graph.channels {
+		if c.node1 != node && c.node2 != node {
+			continue
+		}
+		info.NumChannels++
+		info.TotalCapacity += c.capacity
+		if includeChannels {
+			info.Channels = append(info.Channels, &lnrpc.ChannelEdge{ChannelId: c.id,
+				Node1Pub: c.node1.pubKey, Node2Pub: c.node2.pubKey, Capacity: c.capacity})
+		}
+	}
+
+	return info, nil
+}
+
+//DescribeGraph returns every node and channel of the graph, nodes sorted by their public keys
+func (n *Node) DescribeGraph() (*lndwrapper.ChannelGraph, error) {
+
+	n.graph.mutex.Lock()
+	defer n.graph.mutex.Unlock()
+
+	graph := &lndwrapper.ChannelGraph{}
+	for _, node := range n.graph.nodes {
+		graph.Nodes = append(graph.Nodes, &lnrpc.LightningNode{PubKey: node.pubKey, Alias: node.alias})
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].PubKey < graph.Nodes[j].PubKey })
+	for _, c := range n.graph.channels {
+		graph.Edges = append(graph.Edges, &lnrpc.ChannelEdge{ChannelId: c.id, Node1Pub: c.node1.pubKey,
+			Node2Pub: c.node2.pubKey, Capacity: c.capacity})
+	}
+
+	return graph, nil
+}
+
+//ListChannels returns the channels of the node as seen from its side
+func (n *Node) ListChannels() (*lndwrapper.ListChannelsResponse, error) {
+
+	n.graph.mutex.Lock()
+	defer n.graph.mutex.Unlock()
+
+	resp := &lndwrapper.ListChannelsResponse{}
+	for _, c := range n.graph.channels {
+		var remote *Node
+		var localBalance int64
+
+		switch n {
+		case c.node1:
+			remote, localBalance = c.node2, c.balance1
+		case c.node2:
+			remote, localBalance = c.node1, c.capacity-c.balance1
+		default:
+			continue
+		}
+
+		resp.Channels = append(resp.Channels, &lnrpc.Channel{Active: true, ChanId: c.id,
+			RemotePubkey: remote.pubKey, Capacity: c.capacity,
+			LocalBalance: localBalance, RemoteBalance: c.capacity - localBalance})
+	}
+
+	//Keep the answer stable like lnd does when reading from its DB
+	sort.Slice(resp.Channels, func(i, j int) bool {
+		return resp.Channels[i].ChanId < resp.Channels[j].ChanId
+	})
+
+	return resp, nil
+}
+
+//SignMessage signs a message with the node's identity key the same way lnd does
+func (n *Node) SignMessage(message []byte) (*lndwrapper.SignMessageResponse, error) {
+
+	if message == nil {
+		return nil, errors.New("need a message to sign")
+	}
+
+	digest := chainhash.DoubleHashB(append(signedMsgPrefix, message...))
+	sig, err := btcec.SignCompact(btcec.S256(), n.privKey, digest, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lndwrapper.SignMessageResponse{Signature: zbase32.EncodeToString(sig)}, nil
+}
+
+//VerifyMessage recovers the signing key and reports the signature as valid
+//only if it belongs to a node in the graph, mirroring lnd
+func (n *Node) VerifyMessage(message []byte, signature string) (*lndwrapper.VerifyMessageResponse, error) {
+
+	if message == nil {
+		return nil, errors.New("need a message to verify")
+	}
+
+	sig, err := zbase32.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := chainhash.DoubleHashB(append(signedMsgPrefix, message...))
+	pubKey, _, err := btcec.RecoverCompact(btcec.S256(), sig, digest)
+	if err != nil {
+		return &lndwrapper.VerifyMessageResponse{Valid: false}, nil
+	}
+	pubKeyHex := hex.EncodeToString(pubKey.SerializeCompressed())
+
+	n.graph.mutex.Lock()
+	_, known := n.graph.nodes[pubKeyHex]
+	n.graph.mutex.Unlock()
+
+	return &lndwrapper.VerifyMessageResponse{Valid: known, Pubkey: pubKeyHex}, nil
+}
+
+//DeriveSharedKey returns the sha256 of the point shared by ephemeralPubKey and the node's identity key, like lnd's signer does
+func (n *Node) DeriveSharedKey(ephemeralPubKey []byte) (*lndwrapper.SharedKeyResponse, error) {
+
+	pubKey, err := btcec.ParsePubKey(ephemeralPubKey, btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	var shared btcec.PublicKey
+	shared.Curve = btcec.S256()
+	shared.X, shared.Y = btcec.S256().ScalarMult(pubKey.X, pubKey.Y, n.privKey.D.Bytes())
+	sharedKey := sha256.Sum256(shared.SerializeCompressed())
+
+	return &lndwrapper.SharedKeyResponse{SharedKey: sharedKey[:]}, nil
+}
+
+//SetWallet gives the node an on-chain wallet holding balance satoshis that publishes its transactions to publisher
+func (n *Node) SetWallet(balance int64, publisher Publisher) {
+
+	n.graph.mutex.Lock()
+	defer n.graph.mutex.Unlock()
+
+	n.balance = balance
+	n.publisher = publisher
+}
+
+//EstimateFee returns the lowest fee rate used by lnd
+func (n *Node) EstimateFee(confTarget int32) (*lndwrapper.EstimateFeeResponse, error) {
+	return &lndwrapper.EstimateFeeResponse{SatPerKw: feeRateFloor}, nil
+}
+
+//SendOutputs publishes a transaction paying to outputs funded by the wallet balance, with the change
+//going back to the wallet
+func (n *Node) SendOutputs(satPerKw int64, outputs []*lndwrapper.TxOut) (*lndwrapper.SendOutputsResponse, error) {
+
+	n.graph.mutex.Lock()
+	defer n.graph.mutex.Unlock()
+
+	if n.publisher == nil {
+		return nil, errors.New("unknown service walletrpc.WalletKit")
+	}
+	if len(outputs) == 0 {
+		return nil, errors.New("must specify at least one output to create")
+	}
+
+	//Spend a made up output of the wallet holding the whole balance
+	var prevHash chainhash.Hash
+	copy(prevHash[:], n.privKey.PubKey().SerializeCompressed())
+	binary.BigEndian.PutUint32(prevHash[:], n.spent)
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, nil))
+
+	var total int64
+	for _, output := range outputs {
+		tx.AddTxOut(wire.NewTxOut(output.Value, output.PkScript))
+		total += output.Value
+	}
+	changeScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(make([]byte, 20)).Script()
+	if err != nil {
+		return nil, err
+	}
+	tx.AddTxOut(wire.NewTxOut(0, changeScript))
+
+	//Weight of the transaction with a signed P2WPKH input
+	fee := (int64(tx.SerializeSizeStripped())*4 + 108) * satPerKw / 1000
+	if total+fee > n.balance {
+		return nil, errors.New("insufficient funds available to construct transaction")
+	}
+	tx.TxOut[len(tx.TxOut)-1].Value = n.balance - total - fee
+
+	var buffer bytes.Buffer
+	if err = tx.Serialize(&buffer); err != nil {
+		return nil, err
+	}
+	if _, err = n.publisher.SendRawTransaction(hex.EncodeToString(buffer.Bytes())); err != nil {
+		return nil, err
+	}
+	n.balance = tx.TxOut[len(tx.TxOut)-1].Value
+	n.spent++
+
+	return &lndwrapper.SendOutputsResponse{RawTx: buffer.Bytes()}, nil
+}
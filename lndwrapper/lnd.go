@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/signrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/walletrpc"
 	"github.com/lightningnetwork/lnd/macaroons"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -14,7 +16,9 @@ import (
 
 // An Lnd represents an lnd client
 type Lnd struct {
-	client lnrpc.LightningClient
+	client    lnrpc.LightningClient
+	walletKit walletrpc.WalletKitClient
+	signer    signrpc.SignerClient
 }
 
 //GetInfoResponse is an alias for the wrapped lnrpc type
@@ -23,6 +27,9 @@ type GetInfoResponse = lnrpc.GetInfoResponse
 //NodeInfo is an alias for the wrapped lnrpc type
 type NodeInfo = lnrpc.NodeInfo
 
+//ChannelGraph is an alias for the wrapped lnrpc type
+type ChannelGraph = lnrpc.ChannelGraph
+
 //ListChannelsResponse is an alias for the wrapped lnrpc type
 type ListChannelsResponse = lnrpc.ListChannelsResponse
 
@@ -32,6 +39,22 @@ type SignMessageResponse = lnrpc.SignMessageResponse
 //VerifyMessageResponse is an alias for the wrapped lnrpc type
 type VerifyMessageResponse = lnrpc.VerifyMessageResponse
 
+//TxOut is an alias for the wrapped signrpc type
+type TxOut = signrpc.TxOut
+
+//SharedKeyResponse is an alias for the wrapped signrpc type
+type SharedKeyResponse = signrpc.SharedKeyResponse
+
+//EstimateFeeResponse is an alias for the wrapped walletrpc type
+type EstimateFeeResponse = walletrpc.EstimateFeeResponse
+
+//SendOutputsResponse is an alias for the wrapped walletrpc type
+type SendOutputsResponse = walletrpc.SendOutputsResponse
+
+//maxGraphMessageSize is the size of the largest graph description accepted from lnd,
+//the mainnet graph is well above the default grpc limit of 4MB
+const maxGraphMessageSize = 256 * 1024 * 1024
+
 // New return a new lnd
 func New(host string, port int, macaroonPath string, tlsCertPath string) (*Lnd, error) {
 
@@ -66,7 +89,7 @@ func New(host string, port int, macaroonPath string, tlsCertPath string) (*Lnd,
 		return nil, err
 	}
 
-	return &Lnd{lnrpc.NewLightningClient(conn)}, nil
+	return &Lnd{lnrpc.NewLightningClient(conn), walletrpc.NewWalletKitClient(conn), signrpc.NewSignerClient(conn)}, nil
 }
 
 //GetInfo returns some info about the node
@@ -97,6 +120,20 @@ func (lnd *Lnd) GetNodeInfo(pubkey string, includeChannels bool) (*NodeInfo, err
 	return info, nil
 }
 
+//DescribeGraph returns the nodes and channels announced in the lightning network
+func (lnd *Lnd) DescribeGraph() (*ChannelGraph, error) {
+
+	ctxb := context.Background()
+	req := &lnrpc.ChannelGraphRequest{}
+
+	graph, err := lnd.client.DescribeGraph(ctxb, req, grpc.MaxCallRecvMsgSize(maxGraphMessageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return graph, nil
+}
+
 //ListChannels returns a list of active channels
 func (lnd *Lnd) ListChannels() (*ListChannelsResponse, error) {
 	ctxb := context.Background()
@@ -142,3 +179,48 @@ func (lnd *Lnd) VerifyMessage(message []byte, signature string) (*VerifyMessageR
 
 	return resp, nil
 }
+
+//EstimateFee returns the fee rate (in sat/kw) for a transaction to confirm within confTarget blocks.
+//The wallet RPCs are only available when lnd is built with the walletrpc tag
+func (lnd *Lnd) EstimateFee(confTarget int32) (*EstimateFeeResponse, error) {
+
+	ctxb := context.Background()
+	req := &walletrpc.EstimateFeeRequest{ConfTarget: confTarget}
+
+	resp, err := lnd.walletKit.EstimateFee(ctxb, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+//SendOutputs creates a transaction paying to outputs at satPerKw, funded and signed by lnd's on-chain
+//wallet, and publishes it
+func (lnd *Lnd) SendOutputs(satPerKw int64, outputs []*TxOut) (*SendOutputsResponse, error) {
+
+	ctxb := context.Background()
+	req := &walletrpc.SendOutputsRequest{SatPerKw: satPerKw, Outputs: outputs}
+
+	resp, err := lnd.walletKit.SendOutputs(ctxb, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+//DeriveSharedKey returns the sha256 of the point shared by ephemeralPubKey and the identity key of the node.
+//The signer RPCs are only available when lnd is built with the signrpc tag
+func (lnd *Lnd) DeriveSharedKey(ephemeralPubKey []byte) (*SharedKeyResponse, error) {
+
+	ctxb := context.Background()
+	req := &signrpc.SharedKeyRequest{EphemeralPubkey: ephemeralPubKey}
+
+	resp, err := lnd.signer.DeriveSharedKey(ctxb, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}